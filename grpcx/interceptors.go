@@ -19,9 +19,10 @@ func WithMetrics(m metrics.Metrics) grpc.UnaryServerInterceptor {
 }
 
 // WithMetricsUnary returns a gRPC interceptor for UNARY calls that instrument requests with a metric for the request duration.
+// The metric is tagged with the tags of the context of the call, see metrics.ContextWithTags.
 func WithMetricsUnary(m metrics.Metrics) grpc.UnaryServerInterceptor {
 	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
-		timer := m.Timer("grpc.request_duration")
+		timer := metrics.FromContext(ctx, m).Timer("grpc.request_duration")
 		timer.Start()
 
 		resp, err := handler(ctx, req)
@@ -35,9 +36,10 @@ func WithMetricsUnary(m metrics.Metrics) grpc.UnaryServerInterceptor {
 }
 
 // WithMetricsStream returns a gRPC interceptor for STREAM calls that instrument requests with a metric for the request duration.
+// The metric is tagged with the tags of the context of the stream, see metrics.ContextWithTags.
 func WithMetricsStream(m metrics.Metrics) grpc.StreamServerInterceptor {
 	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
-		timer := m.Timer("grpc.request_duration")
+		timer := metrics.FromContext(ss.Context(), m).Timer("grpc.request_duration")
 		timer.Start()
 
 		err := handler(srv, ss)
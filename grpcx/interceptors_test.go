@@ -85,6 +85,39 @@ func TestWithMetricsStream(t *testing.T) {
 	a.Contains(timer.Tags(), metrics.NewTag("success", true))
 }
 
+func TestWithMetricsContextTags(t *testing.T) {
+	a := assert.New(t)
+	t.Parallel()
+
+	ctx := metrics.ContextWithTags(context.Background(), metrics.NewTag("tenant", "acme"))
+
+	m := metrics.NewRecorder()
+	unary := grpcx.WithMetricsUnary(m)
+	_, err := unary(ctx, "my-request", &grpc.UnaryServerInfo{FullMethod: method}, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return "my-response", nil
+	})
+	a.NoError(err)
+
+	timer := m.Get("grpc.request_duration")
+	if a.NotNil(timer) {
+		a.Contains(timer.Tags(), metrics.NewTag("tenant", "acme"))
+		a.Contains(timer.Tags(), metrics.NewTag("rpc_method", method))
+	}
+
+	m = metrics.NewRecorder()
+	stream := grpcx.WithMetricsStream(m)
+	err = stream(nil, contextServerStream{ctx: ctx}, &grpc.StreamServerInfo{FullMethod: method}, func(srv interface{}, stream grpc.ServerStream) error {
+		return nil
+	})
+	a.NoError(err)
+
+	timer = m.Get("grpc.request_duration")
+	if a.NotNil(timer) {
+		a.Contains(timer.Tags(), metrics.NewTag("tenant", "acme"))
+		a.Contains(timer.Tags(), metrics.NewTag("rpc_method", method))
+	}
+}
+
 func TestWithRequestResponseLogsUnary(t *testing.T) {
 	t.Parallel()
 	a := assert.New(t)
@@ -356,7 +389,7 @@ func (dummyServerStream) SetTrailer(md metadata.MD) {
 }
 
 func (dummyServerStream) Context() context.Context {
-	return nil
+	return context.Background()
 }
 
 func (dummyServerStream) SendMsg(m interface{}) error {
@@ -366,3 +399,13 @@ func (dummyServerStream) SendMsg(m interface{}) error {
 func (dummyServerStream) RecvMsg(m interface{}) error {
 	return nil
 }
+
+// contextServerStream is a dummyServerStream with a context
+type contextServerStream struct {
+	dummyServerStream
+	ctx context.Context
+}
+
+func (s contextServerStream) Context() context.Context {
+	return s.ctx
+}
@@ -69,11 +69,12 @@ func FaultTolerance(attempts int, backoff time.Duration) ClientDecorator {
 	}
 }
 
-// InstrumentRequestDurationMetric returns an adapter that instruments metrics about the request duration
+// InstrumentRequestDurationMetric returns an adapter that instruments metrics about the request duration,
+// tagged with the tags of the context of the request, see metrics.ContextWithTags
 func InstrumentRequestDurationMetric(m metrics.Metrics, t ...metrics.Tag) ClientDecorator {
 	return func(c Client) Client {
 		return ClientFunc(func(r *http.Request) (*http.Response, error) {
-			timer := m.Timer(requestMetricName).
+			timer := metrics.FromContext(r.Context(), m).Timer(requestMetricName).
 				WithTags(t...).
 				WithTag("method", strings.ToLower(r.Method))
 
@@ -2,6 +2,7 @@ package httpx_test
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -152,6 +153,29 @@ func TestInstrumentRequestDurationMetric(t *testing.T) {
 	assert.Equal(200, resp.StatusCode)
 }
 
+func TestInstrumentRequestDurationMetricWithContextTags(t *testing.T) {
+	assert := assert.New(t)
+
+	recorder := metrics.NewRecorder()
+	client := httpx.DecorateClient(&NoopClient{}, httpx.InstrumentRequestDurationMetric(recorder))
+
+	ctx := metrics.ContextWithTags(context.Background(), metrics.NewTag("tenant", "acme"))
+	req, err := http.NewRequestWithContext(ctx, "GET", "http://example.com", nil)
+	assert.NoError(err)
+
+	_, err = client.Do(req)
+	assert.NoError(err)
+
+	timer := recorder.Get("httpx.request_duration")
+	if assert.NotNil(timer) {
+		assert.ElementsMatch(metrics.Tags{
+			metrics.NewTag("tenant", "acme"),
+			metrics.NewTag("method", "get"),
+			metrics.NewTag("code", http.StatusOK),
+		}, timer.Tags())
+	}
+}
+
 func TestLogger(t *testing.T) {
 	assert := assert.New(t)
 
@@ -12,11 +12,12 @@ import (
 // - http.request_duration: requests duration
 // - http.requests: number of requests
 //
-// Metrics are tagged with the HTTP method, requests path, response status code and response status class.
+// Metrics are tagged with the HTTP method, requests path, response status code and response status class,
+// and with the tags of the context of the request, see metrics.ContextWithTags.
 func InstrumentDecorator(met metrics.Metrics, t ...metrics.Tag) Decorator {
 	return func(h http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			timer := met.Timer("http.request_duration")
+			timer := metrics.FromContext(r.Context(), met).Timer("http.request_duration")
 			timer.Start()
 
 			delegate := &responseWriterDelegator{ResponseWriter: w}
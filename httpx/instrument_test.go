@@ -1,6 +1,7 @@
 package httpx_test
 
 import (
+	"context"
 	"net/http"
 	"net/http/httptest"
 	"testing"
@@ -58,3 +59,30 @@ func TestInstrument_RequestsDuration(t *testing.T) {
 		a.Equal(http.StatusNoContent, w.Code)
 	}
 }
+
+func TestInstrument_ContextTags(t *testing.T) {
+	a := assert.New(t)
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	recorder := metrics.NewRecorder()
+	h := httpx.InstrumentDecorator(recorder, metrics.NewTag("service", "api"))(handler)
+
+	ctx := metrics.ContextWithTags(context.Background(), metrics.NewTag("tenant", "acme"))
+	r := httptest.NewRequest(http.MethodGet, "/players", nil).WithContext(ctx)
+	h.ServeHTTP(httptest.NewRecorder(), r)
+
+	timer := recorder.Get("http.request_duration")
+	if a.NotNil(timer) {
+		a.ElementsMatch(metrics.Tags{
+			metrics.NewTag("tenant", "acme"),
+			metrics.NewTag("service", "api"),
+			metrics.NewTag("method", "get"),
+			metrics.NewTag("path", "/players"),
+			metrics.NewTag("code", http.StatusNoContent),
+			metrics.NewTag("class", "2xx"),
+		}, timer.Tags())
+	}
+}
@@ -0,0 +1,125 @@
+package metrics
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// aggregator accumulates counters (sum), gauges (last value) and sets (unique
+// values) per series, a series being the combination of operation, name and
+// tags, so the publisher can emit a single line per series on every flush.
+type aggregator struct {
+	series map[string]*series
+	keys   []string   // keeps the insertion order of the series
+	mu     sync.Mutex // protects the whole struct
+}
+
+type series struct {
+	op    Op
+	name  string
+	tags  Tags
+	rate  float64
+	value interface{}
+	count uint64 // the sum of a counter, kept unboxed to not allocate on every observation
+}
+
+// renderedTags caches the series key of a metric whose tags and sample rate do not
+// change, so it is rendered only once instead of on every observation
+type renderedTags struct {
+	once sync.Once
+	key  string
+}
+
+// seriesKey returns the cached series key, or renders it if there is no cache
+func (r *renderedTags) seriesKey(op Op, name string, tags Tags, rate float64) string {
+	if r == nil {
+		return seriesKey(op, name, tags, rate)
+	}
+
+	r.once.Do(func() {
+		r.key = seriesKey(op, name, tags, rate)
+	})
+	return r.key
+}
+
+func newAggregator() *aggregator {
+	return &aggregator{series: make(map[string]*series)}
+}
+
+// aggregate stores the observation and returns whether it was aggregated.
+// Observations that cannot be aggregated must be published as they come.
+//
+// The sample rate is part of the series so sampled counters are still
+// scaled properly by the receiving end.
+//
+// The series key is taken from the rendered tags when they are cached.
+func (a *aggregator) aggregate(op Op, name string, value interface{}, tags Tags, rate float64, rendered *renderedTags) bool {
+	switch op {
+	case OpCounterAdd:
+		if _, ok := value.(uint64); !ok {
+			return false
+		}
+	case OpGaugeUpdate, OpSetAdd:
+	default:
+		return false
+	}
+
+	key := rendered.seriesKey(op, name, tags, rate)
+	if op == OpSetAdd {
+		// every unique value of a set is a series on its own
+		key = fmt.Sprintf("%s|%v", key, value)
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	s, ok := a.series[key]
+	if !ok {
+		s = &series{op: op, name: name, tags: append(Tags(nil), tags...), rate: rate}
+		a.series[key] = s
+		a.keys = append(a.keys, key)
+	}
+
+	switch op {
+	case OpCounterAdd:
+		s.count += value.(uint64)
+	case OpGaugeUpdate, OpSetAdd:
+		s.value = value
+	}
+
+	return true
+}
+
+// drain returns the aggregated series in insertion order and resets the aggregator.
+func (a *aggregator) drain() []*series {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if len(a.keys) == 0 {
+		return nil
+	}
+
+	out := make([]*series, len(a.keys))
+	for i, key := range a.keys {
+		s := a.series[key]
+		if s.op == OpCounterAdd {
+			s.value = s.count
+		}
+		out[i] = s
+	}
+
+	a.series = make(map[string]*series, len(a.keys))
+	a.keys = a.keys[:0]
+
+	return out
+}
+
+func seriesKey(op Op, name string, tags Tags, rate float64) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d|%s|%v", op, name, rate)
+	for _, t := range tags {
+		fmt.Fprintf(&b, "|%v:%v", t.Key, t.Value)
+	}
+	return b.String()
+}
@@ -0,0 +1,596 @@
+package metrics
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultCardinalityPlaceholder is the value that replaces the offending tag values
+const DefaultCardinalityPlaceholder = "other"
+
+// CardinalityLimitError is reported to the ErrorHandler of a cardinality limiter
+// the first time a metric exceeds the limit of distinct tag combinations.
+type CardinalityLimitError struct {
+	Name  string
+	Limit int
+}
+
+func (e *CardinalityLimitError) Error() string {
+	return fmt.Sprintf("metrics: metric `%s` exceeded the limit of %d tag combinations", e.Name, e.Limit)
+}
+
+// A CardinalityOption is a functional option for building a cardinality limiter
+type CardinalityOption func(*cardinalityLimiter)
+
+// WithCardinalityPlaceholder returns an option that sets the value that replaces the offending tag values
+func WithCardinalityPlaceholder(placeholder string) CardinalityOption {
+	return func(l *cardinalityLimiter) {
+		l.placeholder = placeholder
+	}
+}
+
+// WithAllowedTagValues returns an option that only allows the given values for the tag
+// with the given key, any other value is replaced by the placeholder.
+func WithAllowedTagValues(key string, values ...interface{}) CardinalityOption {
+	return func(l *cardinalityLimiter) {
+		l.allowed[key] = valueSet(values)
+	}
+}
+
+// WithDeniedTagValues returns an option that replaces the given values of the tag with
+// the given key by the placeholder. All the values are replaced if none is given.
+func WithDeniedTagValues(key string, values ...interface{}) CardinalityOption {
+	return func(l *cardinalityLimiter) {
+		l.denied[key] = valueSet(values)
+	}
+}
+
+// cardinalityLimiter is a metrics publisher decorator that limits the number of
+// distinct tag combinations of every metric
+type cardinalityLimiter struct {
+	m           Metrics
+	limit       int
+	eh          ErrorHandler
+	placeholder string
+	allowed     map[string]map[string]struct{}
+	denied      map[string]map[string]struct{}
+
+	series map[string]*cardinalitySeries
+	mu     sync.Mutex // protects the series
+}
+
+// cardinalitySeries holds the tag combinations seen for a metric name
+type cardinalitySeries struct {
+	combinations map[string]struct{}
+	values       map[string]map[string]struct{}
+	overflowed   bool
+}
+
+// NewCardinalityLimitedMetrics returns a new metrics publisher that tracks the distinct
+// tag combinations of every metric name. Once a metric reaches the limit, the tag values
+// never seen for it are replaced by a placeholder, or all of them if the combination is
+// new but its values aren't, so the values of every tag are bounded by the ones seen
+// before reaching the limit. The first overflow of every metric is reported to the
+// error handler as a *CardinalityLimitError.
+//
+// The tags of a metric are limited the first time it is published, so reusing the
+// metric costs the same as reusing the metric of the decorated publisher.
+func NewCardinalityLimitedMetrics(m Metrics, limit int, eh ErrorHandler, opts ...CardinalityOption) Metrics {
+	if eh == nil {
+		eh = DiscardErrors
+	}
+
+	l := &cardinalityLimiter{
+		m:           m,
+		limit:       limit,
+		eh:          eh,
+		placeholder: DefaultCardinalityPlaceholder,
+		allowed:     make(map[string]map[string]struct{}),
+		denied:      make(map[string]map[string]struct{}),
+		series:      make(map[string]*cardinalitySeries),
+	}
+
+	for _, o := range opts {
+		o(l)
+	}
+
+	return l
+}
+
+func valueSet(values []interface{}) map[string]struct{} {
+	set := make(map[string]struct{}, len(values))
+	for _, v := range values {
+		set[fmt.Sprint(v)] = struct{}{}
+	}
+	return set
+}
+
+// limitTags returns the tags to publish for the metric with the given name
+func (l *cardinalityLimiter) limitTags(name string, tags Tags) Tags {
+	if len(tags) == 0 {
+		return tags
+	}
+
+	limited := make(Tags, len(tags))
+	values := make([]string, len(tags))
+	for i, tag := range tags {
+		limited[i] = tag
+		values[i] = fmt.Sprint(tag.Value)
+		if !l.isAllowed(tag.Key, values[i]) {
+			limited[i].Value = l.placeholder
+			values[i] = l.placeholder
+		}
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	s, ok := l.series[name]
+	if !ok {
+		s = &cardinalitySeries{
+			combinations: make(map[string]struct{}),
+			values:       make(map[string]map[string]struct{}),
+		}
+		l.series[name] = s
+	}
+
+	combination := combinationKey(limited, values)
+	if _, ok := s.combinations[combination]; ok {
+		return limited
+	}
+
+	if len(s.combinations) < l.limit {
+		s.add(combination, limited, values)
+		return limited
+	}
+
+	if !s.overflowed {
+		s.overflowed = true
+		l.eh(&CardinalityLimitError{Name: name, Limit: l.limit})
+	}
+
+	// replace the values never seen for the metric, or all of them if it is
+	// a new combination of seen values
+	replaced := false
+	for i, tag := range limited {
+		if _, ok := s.values[tag.Key][values[i]]; !ok {
+			limited[i].Value = l.placeholder
+			values[i] = l.placeholder
+			replaced = true
+		}
+	}
+	if !replaced {
+		for i := range limited {
+			limited[i].Value = l.placeholder
+			values[i] = l.placeholder
+		}
+	}
+	s.combinations[combinationKey(limited, values)] = struct{}{}
+
+	return limited
+}
+
+func (l *cardinalityLimiter) isAllowed(key, value string) bool {
+	if allowed, ok := l.allowed[key]; ok {
+		if _, ok := allowed[value]; !ok {
+			return false
+		}
+	}
+
+	if denied, ok := l.denied[key]; ok {
+		if _, ok := denied[value]; ok || len(denied) == 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (s *cardinalitySeries) add(combination string, tags Tags, values []string) {
+	s.combinations[combination] = struct{}{}
+	for i, tag := range tags {
+		if s.values[tag.Key] == nil {
+			s.values[tag.Key] = make(map[string]struct{})
+		}
+		s.values[tag.Key][values[i]] = struct{}{}
+	}
+}
+
+func combinationKey(tags Tags, values []string) string {
+	var b strings.Builder
+	for i, tag := range tags {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(tag.Key)
+		b.WriteByte(':')
+		b.WriteString(values[i])
+	}
+	return b.String()
+}
+
+// Counter implements the Metrics behaviour to return a new Counter
+func (l *cardinalityLimiter) Counter(name string, tags ...Tag) Counter {
+	return limitedCounter{l.metric(name, tags)}
+}
+
+// Gauge implements the Metrics behaviour to return a new Gauge
+func (l *cardinalityLimiter) Gauge(name string, tags ...Tag) Gauge {
+	return limitedGauge{l.metric(name, tags)}
+}
+
+// Event implements the Metrics behaviour to return a new Event
+func (l *cardinalityLimiter) Event(name string, tags ...Tag) Event {
+	return limitedEvent{limitedMetric: l.metric(name, tags)}
+}
+
+// Timer implements the Metrics behaviour to return a new Timer
+func (l *cardinalityLimiter) Timer(name string, tags ...Tag) Timer {
+	return &limitedTimer{limitedMetric: l.metric(name, tags)}
+}
+
+// Histogram implements the Metrics behaviour to return a new Histogram
+func (l *cardinalityLimiter) Histogram(name string, tags ...Tag) Histogram {
+	return limitedHistogram{l.metric(name, tags)}
+}
+
+// Distribution implements the Metrics behaviour to return a new Distribution
+func (l *cardinalityLimiter) Distribution(name string, tags ...Tag) Distribution {
+	return limitedDistribution{l.metric(name, tags)}
+}
+
+// Set implements the Metrics behaviour to return a new Set
+func (l *cardinalityLimiter) Set(name string, tags ...Tag) Set {
+	return limitedSet{l.metric(name, tags)}
+}
+
+// ServiceCheck implements the Metrics behaviour to return a new ServiceCheck
+func (l *cardinalityLimiter) ServiceCheck(name string, tags ...Tag) ServiceCheck {
+	return limitedServiceCheck{limitedMetric: l.metric(name, tags)}
+}
+
+func (l *cardinalityLimiter) metric(name string, tags Tags) limitedMetric {
+	return limitedMetric{l: l, name: name, tags: tags, resolved: &resolvedMetric{}}
+}
+
+// resolvedMetric caches the metric of the decorated publisher with the limited tags,
+// so the tags are limited on the first observation instead of on every one of them
+type resolvedMetric struct {
+	once   sync.Once
+	metric interface{}
+}
+
+// limitedMetric keeps the tags of a metric, that are limited the first time the
+// metric is published to the decorated publisher
+type limitedMetric struct {
+	l    *cardinalityLimiter
+	name string
+	tags Tags
+	rate float64
+
+	// resolved is the metric of the decorated publisher, a new one is assigned
+	// when the tags or the options of the metric change
+	resolved *resolvedMetric
+}
+
+func (m limitedMetric) Name() string {
+	return m.name
+}
+
+func (m limitedMetric) Tags() Tags {
+	return m.tags
+}
+
+func (m limitedMetric) limitedTags() Tags {
+	return m.l.limitTags(m.name, m.tags)
+}
+
+// withTags returns a copy of the metric with the given tags, without sharing
+// the underlying array with the original one
+func (m limitedMetric) withTags(tags ...Tag) limitedMetric {
+	m.tags = append(m.tags[:len(m.tags):len(m.tags)], tags...)
+	m.resolved = &resolvedMetric{}
+	return m
+}
+
+// withRate returns a copy of the metric with the given sample rate
+func (m limitedMetric) withRate(rate float64) limitedMetric {
+	m.rate = rate
+	m.resolved = &resolvedMetric{}
+	return m
+}
+
+type limitedCounter struct {
+	limitedMetric
+}
+
+func (c limitedCounter) Inc() {
+	c.Add(1)
+}
+
+func (c limitedCounter) Add(delta uint64) {
+	c.counter().Add(delta)
+}
+
+func (c limitedCounter) counter() Counter {
+	c.resolved.once.Do(func() {
+		counter := c.l.m.Counter(c.name, c.limitedTags()...)
+		if c.rate != 0 {
+			counter = counter.WithSampleRate(c.rate)
+		}
+		c.resolved.metric = counter
+	})
+	return c.resolved.metric.(Counter)
+}
+
+func (c limitedCounter) WithTags(tags ...Tag) Counter {
+	return limitedCounter{c.withTags(tags...)}
+}
+
+func (c limitedCounter) WithTag(key string, value interface{}) Counter {
+	return limitedCounter{c.withTags(NewTag(key, value))}
+}
+
+func (c limitedCounter) WithSampleRate(rate float64) Counter {
+	return limitedCounter{c.withRate(rate)}
+}
+
+type limitedGauge struct {
+	limitedMetric
+}
+
+func (g limitedGauge) Update(value interface{}) {
+	g.gauge().Update(value)
+}
+
+func (g limitedGauge) gauge() Gauge {
+	g.resolved.once.Do(func() {
+		gauge := g.l.m.Gauge(g.name, g.limitedTags()...)
+		if g.rate != 0 {
+			gauge = gauge.WithSampleRate(g.rate)
+		}
+		g.resolved.metric = gauge
+	})
+	return g.resolved.metric.(Gauge)
+}
+
+func (g limitedGauge) WithTags(tags ...Tag) Gauge {
+	return limitedGauge{g.withTags(tags...)}
+}
+
+func (g limitedGauge) WithTag(key string, value interface{}) Gauge {
+	return limitedGauge{g.withTags(NewTag(key, value))}
+}
+
+func (g limitedGauge) WithSampleRate(rate float64) Gauge {
+	return limitedGauge{g.withRate(rate)}
+}
+
+type limitedEvent struct {
+	limitedMetric
+	opts []EventOption
+}
+
+func (e limitedEvent) Send() {
+	e.event().Send()
+}
+
+func (e limitedEvent) SendWithText(text string) {
+	e.event().SendWithText(text)
+}
+
+func (e limitedEvent) event() Event {
+	e.resolved.once.Do(func() {
+		e.resolved.metric = e.l.m.Event(e.name, e.limitedTags()...).WithOptions(e.opts...)
+	})
+	return e.resolved.metric.(Event)
+}
+
+func (e limitedEvent) WithTags(tags ...Tag) Event {
+	return limitedEvent{limitedMetric: e.withTags(tags...), opts: e.opts}
+}
+
+func (e limitedEvent) WithTag(key string, value interface{}) Event {
+	return limitedEvent{limitedMetric: e.withTags(NewTag(key, value)), opts: e.opts}
+}
+
+func (e limitedEvent) WithOptions(opts ...EventOption) Event {
+	e.opts = append(e.opts[:len(e.opts):len(e.opts)], opts...)
+	e.resolved = &resolvedMetric{}
+	return e
+}
+
+// limitedTimer measures the durations itself, its tags are limited when they are first recorded
+type limitedTimer struct {
+	limitedMetric
+	started time.Time
+}
+
+func (t *limitedTimer) Start() {
+	t.started = time.Now()
+}
+
+func (t *limitedTimer) Stop() {
+	if !t.started.IsZero() {
+		t.Record(time.Since(t.started))
+		t.started = time.Time{}
+	}
+}
+
+func (t *limitedTimer) Record(d time.Duration) {
+	t.timer().Record(d)
+}
+
+func (t *limitedTimer) timer() Timer {
+	resolved := t.resolved
+	resolved.once.Do(func() {
+		timer := t.l.m.Timer(t.name, t.limitedTags()...)
+		if t.rate != 0 {
+			timer = timer.WithSampleRate(t.rate)
+		}
+		resolved.metric = timer
+	})
+	return resolved.metric.(Timer)
+}
+
+func (t *limitedTimer) Time(f func()) {
+	started := time.Now()
+	f()
+	t.Record(time.Since(started))
+}
+
+func (t *limitedTimer) StartStopwatch() *Stopwatch {
+	return NewStopwatch(t)
+}
+
+func (t *limitedTimer) WithTags(tags ...Tag) Timer {
+	t.tags = append(t.tags[:len(t.tags):len(t.tags)], tags...)
+	t.resolved = &resolvedMetric{}
+	return t
+}
+
+func (t *limitedTimer) WithTag(key string, value interface{}) Timer {
+	return t.WithTags(NewTag(key, value))
+}
+
+func (t *limitedTimer) WithSampleRate(rate float64) Timer {
+	t.limitedMetric = t.withRate(rate)
+	return t
+}
+
+type limitedHistogram struct {
+	limitedMetric
+}
+
+func (h limitedHistogram) AddValue(value uint64) {
+	h.histogram().AddValue(value)
+}
+
+func (h limitedHistogram) histogram() Histogram {
+	h.resolved.once.Do(func() {
+		histogram := h.l.m.Histogram(h.name, h.limitedTags()...)
+		if h.rate != 0 {
+			histogram = histogram.WithSampleRate(h.rate)
+		}
+		h.resolved.metric = histogram
+	})
+	return h.resolved.metric.(Histogram)
+}
+
+func (h limitedHistogram) WithTags(tags ...Tag) Histogram {
+	return limitedHistogram{h.withTags(tags...)}
+}
+
+func (h limitedHistogram) WithTag(key string, value interface{}) Histogram {
+	return limitedHistogram{h.withTags(NewTag(key, value))}
+}
+
+func (h limitedHistogram) WithSampleRate(rate float64) Histogram {
+	return limitedHistogram{h.withRate(rate)}
+}
+
+type limitedDistribution struct {
+	limitedMetric
+}
+
+func (d limitedDistribution) AddValue(value float64) {
+	d.distribution().AddValue(value)
+}
+
+func (d limitedDistribution) distribution() Distribution {
+	d.resolved.once.Do(func() {
+		distribution := d.l.m.Distribution(d.name, d.limitedTags()...)
+		if d.rate != 0 {
+			distribution = distribution.WithSampleRate(d.rate)
+		}
+		d.resolved.metric = distribution
+	})
+	return d.resolved.metric.(Distribution)
+}
+
+func (d limitedDistribution) WithTags(tags ...Tag) Distribution {
+	return limitedDistribution{d.withTags(tags...)}
+}
+
+func (d limitedDistribution) WithTag(key string, value interface{}) Distribution {
+	return limitedDistribution{d.withTags(NewTag(key, value))}
+}
+
+func (d limitedDistribution) WithSampleRate(rate float64) Distribution {
+	return limitedDistribution{d.withRate(rate)}
+}
+
+type limitedSet struct {
+	limitedMetric
+}
+
+func (s limitedSet) Add(value interface{}) {
+	s.set().Add(value)
+}
+
+func (s limitedSet) set() Set {
+	s.resolved.once.Do(func() {
+		s.resolved.metric = s.l.m.Set(s.name, s.limitedTags()...)
+	})
+	return s.resolved.metric.(Set)
+}
+
+func (s limitedSet) WithTags(tags ...Tag) Set {
+	return limitedSet{s.withTags(tags...)}
+}
+
+func (s limitedSet) WithTag(key string, value interface{}) Set {
+	return limitedSet{s.withTags(NewTag(key, value))}
+}
+
+type limitedServiceCheck struct {
+	limitedMetric
+	hostname  string
+	timestamp time.Time
+}
+
+func (sc limitedServiceCheck) Send(status ServiceCheckStatus) {
+	sc.serviceCheck().Send(status)
+}
+
+func (sc limitedServiceCheck) SendWithMessage(status ServiceCheckStatus, message string) {
+	sc.serviceCheck().SendWithMessage(status, message)
+}
+
+func (sc limitedServiceCheck) serviceCheck() ServiceCheck {
+	sc.resolved.once.Do(func() {
+		check := sc.l.m.ServiceCheck(sc.name, sc.limitedTags()...)
+		if sc.hostname != "" {
+			check = check.WithHostname(sc.hostname)
+		}
+		if !sc.timestamp.IsZero() {
+			check = check.WithTimestamp(sc.timestamp)
+		}
+		sc.resolved.metric = check
+	})
+	return sc.resolved.metric.(ServiceCheck)
+}
+
+func (sc limitedServiceCheck) WithHostname(hostname string) ServiceCheck {
+	sc.hostname = hostname
+	sc.resolved = &resolvedMetric{}
+	return sc
+}
+
+func (sc limitedServiceCheck) WithTimestamp(t time.Time) ServiceCheck {
+	sc.timestamp = t
+	sc.resolved = &resolvedMetric{}
+	return sc
+}
+
+func (sc limitedServiceCheck) WithTags(tags ...Tag) ServiceCheck {
+	sc.limitedMetric = sc.withTags(tags...)
+	return sc
+}
+
+func (sc limitedServiceCheck) WithTag(key string, value interface{}) ServiceCheck {
+	sc.limitedMetric = sc.withTags(NewTag(key, value))
+	return sc
+}
@@ -0,0 +1,103 @@
+package metrics_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/socialpoint-labs/bsk/metrics"
+)
+
+func TestCardinalityLimitedMetrics(t *testing.T) {
+	a := assert.New(t)
+
+	var errs []error
+	recorder := metrics.NewRecorder()
+	m := metrics.NewCardinalityLimitedMetrics(recorder, 2, func(err error) { errs = append(errs, err) })
+
+	gauge := func(path string) interface{} {
+		if g := recorder.Find("requests", metrics.NewTag("path", path)); g != nil {
+			return g.(*metrics.RecorderGauge).Value()
+		}
+		return nil
+	}
+
+	m.Gauge("requests", metrics.NewTag("path", "/a")).Update(1)
+	a.Equal(1, gauge("/a"))
+	m.Gauge("requests").WithTag("path", "/b").Update(2)
+	a.Equal(2, gauge("/b"))
+	a.Empty(errs)
+
+	m.Gauge("requests", metrics.NewTag("path", "/c")).Update(3)
+	a.Nil(gauge("/c"))
+	a.Equal(3, gauge(metrics.DefaultCardinalityPlaceholder))
+	m.Gauge("requests", metrics.NewTag("path", "/d")).Update(4)
+	a.Nil(gauge("/d"))
+	a.Equal(4, gauge(metrics.DefaultCardinalityPlaceholder))
+	m.Gauge("requests", metrics.NewTag("path", "/a")).Update(5)
+	a.Equal(5, gauge("/a"))
+
+	a.Equal([]error{&metrics.CardinalityLimitError{Name: "requests", Limit: 2}}, errs)
+
+	// other metrics have their own limit
+	m.Counter("other_requests", metrics.NewTag("path", "/c")).Inc()
+	a.True(metrics.HasTag(recorder.Get("other_requests"), "path", "/c"))
+}
+
+func TestCardinalityLimitedMetricsNewCombinationOfSeenValues(t *testing.T) {
+	a := assert.New(t)
+
+	recorder := metrics.NewRecorder()
+	m := metrics.NewCardinalityLimitedMetrics(recorder, 2, nil)
+
+	m.Gauge("gauge", metrics.NewTag("method", "get"), metrics.NewTag("path", "/a")).Update(1)
+	m.Gauge("gauge", metrics.NewTag("method", "post"), metrics.NewTag("path", "/b")).Update(2)
+	m.Gauge("gauge", metrics.NewTag("method", "get"), metrics.NewTag("path", "/b")).Update(3)
+
+	a.Equal(metrics.Tags{metrics.NewTag("method", "other"), metrics.NewTag("path", "other")}, recorder.Get("gauge").Tags())
+	a.Equal(3, recorder.Get("gauge").(*metrics.RecorderGauge).Value())
+}
+
+func TestCardinalityLimitedMetricsAllowedAndDeniedValues(t *testing.T) {
+	a := assert.New(t)
+
+	recorder := metrics.NewRecorder()
+	m := metrics.NewCardinalityLimitedMetrics(recorder, 100, nil,
+		metrics.WithCardinalityPlaceholder("redacted"),
+		metrics.WithAllowedTagValues("method", "get", "post"),
+		metrics.WithDeniedTagValues("user"),
+		metrics.WithDeniedTagValues("code", 500),
+	)
+
+	m.Histogram("histogram", metrics.NewTag("method", "get"), metrics.NewTag("code", 200)).AddValue(1)
+	a.Equal(metrics.Tags{metrics.NewTag("method", "get"), metrics.NewTag("code", 200)}, recorder.Get("histogram").Tags())
+
+	m.Histogram("histogram", metrics.NewTag("method", "put"), metrics.NewTag("code", 500), metrics.NewTag("user", 42)).AddValue(1)
+	a.Equal(metrics.Tags{
+		metrics.NewTag("method", "redacted"),
+		metrics.NewTag("code", "redacted"),
+		metrics.NewTag("user", "redacted"),
+	}, recorder.Get("histogram").Tags())
+}
+
+func TestCardinalityLimitedMetricsTimer(t *testing.T) {
+	a := assert.New(t)
+
+	recorder := metrics.NewRecorder()
+	m := metrics.NewCardinalityLimitedMetrics(recorder, 1, nil)
+
+	for _, path := range []string{"/a", "/b"} {
+		timer := m.Timer("timer", metrics.NewTag("method", "get"))
+		timer.Start()
+		timer.WithTag("path", path).Stop()
+	}
+
+	a.Nil(recorder.Find("timer", metrics.NewTag("method", "get"), metrics.NewTag("path", "/b")))
+	a.NotNil(recorder.Find("timer", metrics.NewTag("method", "get"), metrics.NewTag("path", "other")))
+
+	m.Timer("timer", metrics.NewTag("method", "get"), metrics.NewTag("path", "/a")).Record(time.Second)
+	timer := recorder.Find("timer", metrics.NewTag("method", "get"), metrics.NewTag("path", "/a"))
+	a.Contains(timer.(*metrics.RecorderTimer).Durations(), time.Second)
+
+}
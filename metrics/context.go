@@ -0,0 +1,55 @@
+package metrics
+
+import "context"
+
+type contextKey int
+
+const (
+	tagsKey contextKey = iota
+)
+
+// ContextWithTags returns a copy of the context with the given tags merged into the tags it
+// already has, so they can be attached once, e.g. in a middleware, and inherited by all the
+// metrics created from the context with FromContext. A tag replaces the tag of the context
+// with the same key.
+func ContextWithTags(ctx context.Context, tags ...Tag) context.Context {
+	if len(tags) == 0 {
+		return ctx
+	}
+
+	merged := append(Tags(nil), TagsFromContext(ctx)...)
+	for _, tag := range tags {
+		merged = mergeTag(merged, tag)
+	}
+
+	return context.WithValue(ctx, tagsKey, merged)
+}
+
+// TagsFromContext returns the tags of the context, see ContextWithTags, or nil if it has none.
+func TagsFromContext(ctx context.Context) Tags {
+	tags, _ := ctx.Value(tagsKey).(Tags)
+	return tags
+}
+
+// FromContext returns a metrics decorator that adds the tags of the context, see ContextWithTags,
+// to all the metrics, or the given metrics if the context has no tags.
+func FromContext(ctx context.Context, m Metrics) Metrics {
+	tags := TagsFromContext(ctx)
+	if len(tags) == 0 {
+		return m
+	}
+
+	return NewTaggedMetrics(m, tags...)
+}
+
+// mergeTag replaces the tag with the same key, or appends the tag if there is none
+func mergeTag(tags Tags, tag Tag) Tags {
+	for i := range tags {
+		if tags[i].Key == tag.Key {
+			tags[i] = tag
+			return tags
+		}
+	}
+
+	return append(tags, tag)
+}
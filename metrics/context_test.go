@@ -0,0 +1,64 @@
+package metrics_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/socialpoint-labs/bsk/metrics"
+)
+
+func TestContextWithTags(t *testing.T) {
+	a := assert.New(t)
+
+	ctx := context.Background()
+	a.Nil(metrics.TagsFromContext(ctx))
+	a.Equal(ctx, metrics.ContextWithTags(ctx))
+
+	parent := metrics.ContextWithTags(ctx, metrics.NewTag("tenant", "acme"), metrics.NewTag("region", "eu"))
+	a.Equal(metrics.Tags{metrics.NewTag("tenant", "acme"), metrics.NewTag("region", "eu")}, metrics.TagsFromContext(parent))
+
+	// the tags are merged, replacing the ones with the same key
+	child := metrics.ContextWithTags(parent, metrics.NewTag("region", "us"), metrics.NewTag("game", "dragons"))
+	a.Equal(metrics.Tags{metrics.NewTag("tenant", "acme"), metrics.NewTag("region", "us"), metrics.NewTag("game", "dragons")}, metrics.TagsFromContext(child))
+
+	// the parent is not modified
+	a.Equal(metrics.Tags{metrics.NewTag("tenant", "acme"), metrics.NewTag("region", "eu")}, metrics.TagsFromContext(parent))
+}
+
+func TestFromContext(t *testing.T) {
+	a := assert.New(t)
+
+	recorder := metrics.NewRecorder()
+	a.Equal(recorder, metrics.FromContext(context.Background(), recorder), "no tags in the context")
+
+	ctx := metrics.ContextWithTags(context.Background(), metrics.NewTag("tenant", "acme"))
+	m := metrics.FromContext(ctx, recorder)
+
+	m.Counter("requests", metrics.NewTag("code", 200)).Inc()
+	m.Timer("latency").WithTag("cached", true).Record(0)
+
+	a.NotNil(recorder.Find("requests", metrics.NewTag("tenant", "acme"), metrics.NewTag("code", 200)))
+	a.NotNil(recorder.Find("latency", metrics.NewTag("tenant", "acme"), metrics.NewTag("cached", true)))
+}
+
+func TestFromContextDoesNotShareTags(t *testing.T) {
+	a := assert.New(t)
+
+	rec := make(recorder)
+	publisher := metrics.NewPublisher(rec, metrics.StatsDEncoder, time.Hour, nil, metrics.WithoutAggregation())
+	go publisher.Run(context.Background())
+	waitRunning(t, publisher)
+
+	// three tags, so the merged slice has room for one more
+	ctx := metrics.ContextWithTags(context.Background(), metrics.NewTag("a", 1), metrics.NewTag("b", 2), metrics.NewTag("c", 3))
+
+	x := metrics.FromContext(ctx, publisher).Timer("x").WithTag("route", "one")
+	y := metrics.FromContext(ctx, publisher).Timer("y").WithTag("route", "two")
+
+	a.Equal(metrics.Tags{metrics.NewTag("a", 1), metrics.NewTag("b", 2), metrics.NewTag("c", 3), metrics.NewTag("route", "one")}, x.Tags())
+	a.Equal(metrics.Tags{metrics.NewTag("a", 1), metrics.NewTag("b", 2), metrics.NewTag("c", 3), metrics.NewTag("route", "two")}, y.Tags())
+	a.Len(metrics.TagsFromContext(ctx), 3)
+}
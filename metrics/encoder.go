@@ -2,49 +2,136 @@ package metrics
 
 import (
 	"fmt"
+	"math"
+	"strconv"
 	"strings"
 	"time"
 )
 
+var (
+	serviceCheckMessageEscaper = strings.NewReplacer("\n", "\\n", "m:", "m\\:")
+
+	// influxMeasurementEscaper and influxTagEscaper escape the characters that are special in the
+	// InfluxDB line protocol, and replace the new lines that cannot be escaped
+	influxMeasurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `, "\n", "_", "\r", "_")
+	influxTagEscaper         = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `, "\n", "_", "\r", "_")
+)
+
+// characters that corrupt the encoded lines, tag values can contain colons
+// because only the first one separates the key from the value
+const (
+	invalidNameChars       = ":|@#,\n\r"
+	invalidEventTitleChars = "\n\r"
+	invalidTagKeyChars     = ":|#,\n\r"
+	invalidTagValueChars   = "|#,\n\r"
+
+	// characters that corrupt the Graphite plaintext lines, dots separate the segments
+	// of the paths so they are not valid in the tags encoded as segments
+	invalidGraphitePathChars        = " ;\n\r"
+	invalidGraphiteTagSegmentChars  = " ;.\n\r"
+	invalidGraphiteTaggedKeyChars   = " ;!^=~\n\r"
+	invalidGraphiteTaggedValueChars = " ;~\n\r"
+)
+
+// SanitizeMode is the way a sanitized encoder handles the names, tag keys
+// and tag values containing characters that would corrupt the encoded lines
+type SanitizeMode uint8
+
+// Available sanitize modes
+const (
+	// SanitizeReplace replaces the invalid characters by underscores, it is what the encoders do by default
+	SanitizeReplace SanitizeMode = iota
+	// SanitizeDrop drops the tags with invalid characters, and the metrics with an invalid name
+	SanitizeDrop
+	// SanitizeError returns an *InvalidMetricError, so the metric is not published and
+	// the error is reported to the ErrorHandler of the publisher
+	SanitizeError
+)
+
+// InvalidMetricError is returned by a sanitized encoder in SanitizeError mode when a metric
+// name, tag key or tag value contains characters that would corrupt the encoded line.
+type InvalidMetricError struct {
+	Name   string
+	Reason string
+}
+
+func (e *InvalidMetricError) Error() string {
+	return fmt.Sprintf("metrics: invalid metric `%s`: %s", e.Name, e.Reason)
+}
+
 // Encoder is the signature for encoders
 type Encoder func(name string, op Op, value interface{}, tags Tags, rate float64) (string, error)
 
+// AppendEncoder is the signature for encoders that append the encoded observation to dst and
+// return the extended buffer, so publishers can encode into reusable buffers without allocating.
+type AppendEncoder func(dst []byte, name string, op Op, value interface{}, tags Tags, rate float64) ([]byte, error)
+
 // StdoutEncoder is a simple encoder to be used to write to stdout.
 func StdoutEncoder(name string, op Op, value interface{}, tags Tags, rate float64) (string, error) {
 	return fmt.Sprintf("METRIC: %s | %d | %v | %v | %f\n", name, op, value, tags, rate), nil
 }
 
-// StatsDEncoder implements statsd protocol
+// StatsDEncoder implements statsd protocol, with the DogStatsD extensions for tags, events and distributions
 func StatsDEncoder(name string, op Op, value interface{}, tags Tags, rate float64) (string, error) {
-	ct := make([]string, len(tags))
-	for k, t := range tags {
-		ct[k] = fmt.Sprintf("%v:%v", t.Key, t.Value)
-	}
-	st := strings.Join(ct, ",")
-	if st != "" {
-		st = "|#" + st
+	b := bufferPool.Get().(*[]byte)
+	defer putBuffer(b)
+
+	var err error
+	*b, err = AppendStatsDEncoder((*b)[:0], name, op, value, tags, rate)
+	if err != nil {
+		return "", err
 	}
+	return string(*b), nil
+}
 
+// AppendStatsDEncoder is the AppendEncoder version of StatsDEncoder. Counters, gauges, histograms,
+// timers, distributions and sets with numeric or string values are encoded without allocating.
+func AppendStatsDEncoder(dst []byte, name string, op Op, value interface{}, tags Tags, rate float64) ([]byte, error) {
+	var typ string
 	switch op {
 	case OpCounterAdd:
-		return fmt.Sprintf("%s:%v|c|@%.4f%s\n", name, value, rate, st), nil
+		typ = "c"
 	case OpGaugeUpdate:
-		return fmt.Sprintf("%s:%v|g|@%.4f%s\n", name, value, rate, st), nil
+		typ = "g"
 	case OpHistogramUpdate:
-		return fmt.Sprintf("%s:%v|h|@%.4f%s\n", name, value, rate, st), nil
+		typ = "h"
+	case OpTimerStop:
+		typ = "ms"
+	case OpDistributionUpdate:
+		typ = "d"
+	case OpSetAdd:
+		typ = "s"
 	case OpEventSend:
-		title := fmt.Sprintf("%v", name)
+		title := replaceInvalidChars(name, invalidEventTitleChars)
 		text := fmt.Sprintf("%v", value)
-		return fmt.Sprintf("_e{%d,%d}:%s|%s%s\n", len(title), len(text), title, text, st), nil
-	case OpTimerStop:
-		return fmt.Sprintf("%s:%v|ms|@%.4f%s\n", name, value, rate, st), nil
+		dst = fmt.Appendf(dst, "_e{%d,%d}:%s|%s%s", len(title), len(text), title, text, formatEventAttributes(value))
+		return append(appendTags(dst, tags), '\n'), nil
+	case OpServiceCheckSend:
+		if sc, ok := value.(ServiceCheckValue); ok {
+			return appendServiceCheck(dst, name, sc, tags), nil
+		}
+		return dst, fmt.Errorf("statsd encoder: invalid service check value %v", value)
+	default:
+		return dst, fmt.Errorf("statsd encoder: operation %v not supported", op)
 	}
 
-	return "", fmt.Errorf("statsd encoder: operation %v not supported", op)
+	dst = appendSanitized(dst, name, invalidNameChars)
+	dst = append(dst, ':')
+	dst = appendValue(dst, value)
+	dst = append(dst, '|')
+	dst = append(dst, typ...)
+	dst = append(dst, "|@"...)
+	dst = strconv.AppendFloat(dst, rate, 'f', 4, 64)
+	dst = appendTags(dst, tags)
+
+	return append(dst, '\n'), nil
 }
 
-// LibratoStatsDEncoder implements StatsD protocol but ignores tags to comply with Librato API
+// LibratoStatsDEncoder implements StatsD protocol but ignores tags to comply with Librato API.
+// Distributions and service checks are NOT supported.
 func LibratoStatsDEncoder(name string, op Op, value interface{}, _ Tags, rate float64) (string, error) {
+	name = replaceInvalidChars(name, nameChars(op))
+
 	switch op {
 	case OpCounterAdd:
 		return fmt.Sprintf("%s:%v|c|@%.4f\n", name, value, rate), nil
@@ -58,6 +145,8 @@ func LibratoStatsDEncoder(name string, op Op, value interface{}, _ Tags, rate fl
 		return fmt.Sprintf("_e{%d,%d}:%s|%s\n", len(title), len(text), title, text), nil
 	case OpTimerStop:
 		return fmt.Sprintf("%s:%v|ms|@%.4f\n", name, value, rate), nil
+	case OpSetAdd:
+		return fmt.Sprintf("%s:%v|s|@%.4f\n", name, value, rate), nil
 	}
 
 	return "", fmt.Errorf("librato encoder: operation %v not supported", op)
@@ -65,18 +154,15 @@ func LibratoStatsDEncoder(name string, op Op, value interface{}, _ Tags, rate fl
 
 // DataDogLambdaEncoder implements generating DataDog metrics from AWS Lambda functions.
 // Supported metrics are: count, gauge, histogram.
-// Events are NOT supported.
+// Events, timers, distributions, sets and service checks are NOT supported.
 // See https://docs.datadoghq.com/integrations/amazon_lambda/
 func DataDogLambdaEncoder(name string, op Op, value interface{}, tags Tags, rate float64) (string, error) {
 	return formatDataDogLambdaMetric(name, op, value, tags, time.Now())
 }
 
 func formatDataDogLambdaMetric(name string, op Op, value interface{}, tags Tags, t time.Time) (string, error) {
-	ct := make([]string, len(tags))
-	for k, t := range tags {
-		ct[k] = fmt.Sprintf("%v:%v", t.Key, t.Value)
-	}
-	st := strings.Join(ct, ",")
+	name = replaceInvalidChars(name, invalidNameChars)
+	st := formatTags(tags)
 
 	switch op {
 	case OpCounterAdd:
@@ -90,6 +176,311 @@ func formatDataDogLambdaMetric(name string, op Op, value interface{}, tags Tags,
 	return "", fmt.Errorf("datadog-lambda encoder: operation %q not supported", op)
 }
 
+// GraphiteEncoder implements the Graphite plaintext protocol, encoding every tag as two segments,
+// key and value, appended to the path of the metric, e.g. `requests.code.200 1 1700000000`.
+// Events, sets and service checks are NOT supported. Graphite doesn't know about sample rates,
+// so the sampled counters are scaled by the inverse of their rate, see unsampledCounter.
+// See https://graphite.readthedocs.io/en/latest/feeding-carbon.html
+func GraphiteEncoder(name string, op Op, value interface{}, tags Tags, rate float64) (string, error) {
+	return formatGraphiteMetric(name, op, value, tags, rate, false, time.Now())
+}
+
+// GraphiteTaggedEncoder implements the Graphite plaintext protocol with the tags of Graphite 1.1,
+// e.g. `requests;code=200 1 1700000000`.
+// Events, sets and service checks are NOT supported, and the sampled counters are scaled like
+// in GraphiteEncoder.
+// See https://graphite.readthedocs.io/en/latest/tags.html
+func GraphiteTaggedEncoder(name string, op Op, value interface{}, tags Tags, rate float64) (string, error) {
+	return formatGraphiteMetric(name, op, value, tags, rate, true, time.Now())
+}
+
+func formatGraphiteMetric(name string, op Op, value interface{}, tags Tags, rate float64, tagged bool, t time.Time) (string, error) {
+	switch op {
+	case OpCounterAdd, OpGaugeUpdate, OpHistogramUpdate, OpTimerStop, OpDistributionUpdate:
+	default:
+		return "", fmt.Errorf("graphite encoder: operation %v not supported", op)
+	}
+
+	v, err := valueAsFloat64(value)
+	if err != nil {
+		return "", fmt.Errorf("graphite encoder: %w", err)
+	}
+
+	b := appendSanitized(nil, name, invalidGraphitePathChars)
+	for _, tag := range tags {
+		if tagged {
+			b = append(b, ';')
+			b = appendSanitized(b, tag.Key, invalidGraphiteTaggedKeyChars)
+			b = append(b, '=')
+			start := len(b)
+			b = appendValue(b, tag.Value)
+			replaceInvalidBytes(b[start:], invalidGraphiteTaggedValueChars)
+			continue
+		}
+
+		b = append(b, '.')
+		b = appendSanitized(b, tag.Key, invalidGraphiteTagSegmentChars)
+		b = append(b, '.')
+		start := len(b)
+		b = appendValue(b, tag.Value)
+		replaceInvalidBytes(b[start:], invalidGraphiteTagSegmentChars)
+	}
+	b = append(b, ' ')
+	if unsampled, ok := unsampledCounter(op, v, rate); ok {
+		b = append(b, formatFloat(unsampled)...)
+	} else {
+		b = appendValue(b, value)
+	}
+	b = append(b, ' ')
+	b = strconv.AppendInt(b, t.Unix(), 10)
+
+	return string(append(b, '\n')), nil
+}
+
+// InfluxLineEncoder implements the InfluxDB line protocol, encoding the observations in the `value`
+// field, an integer for the counters and a float for the rest, and the tags as tags.
+// Events, sets and service checks are NOT supported. InfluxDB doesn't know about sample rates,
+// so the sampled counters are scaled by the inverse of their rate, rounded to an integer.
+// See https://docs.influxdata.com/influxdb/v1/write_protocols/line_protocol_reference/
+func InfluxLineEncoder(name string, op Op, value interface{}, tags Tags, rate float64) (string, error) {
+	return formatInfluxLine(name, op, value, tags, rate, time.Now())
+}
+
+func formatInfluxLine(name string, op Op, value interface{}, tags Tags, rate float64, t time.Time) (string, error) {
+	switch op {
+	case OpCounterAdd, OpGaugeUpdate, OpHistogramUpdate, OpTimerStop, OpDistributionUpdate:
+	default:
+		return "", fmt.Errorf("influx encoder: operation %v not supported", op)
+	}
+
+	v, err := valueAsFloat64(value)
+	if err != nil {
+		return "", fmt.Errorf("influx encoder: %w", err)
+	}
+
+	var b strings.Builder
+	b.WriteString(influxMeasurementEscaper.Replace(name))
+	for _, tag := range tags {
+		b.WriteByte(',')
+		b.WriteString(influxTagEscaper.Replace(tag.Key))
+		b.WriteByte('=')
+		b.WriteString(influxTagEscaper.Replace(fmt.Sprint(tag.Value)))
+	}
+	b.WriteString(" value=")
+	if op == OpCounterAdd {
+		if unsampled, ok := unsampledCounter(op, v, rate); ok {
+			v = math.Round(unsampled)
+		}
+		fmt.Fprintf(&b, "%di", uint64(v))
+	} else {
+		b.WriteString(formatFloat(v))
+	}
+	fmt.Fprintf(&b, " %d\n", t.UnixNano())
+
+	return b.String(), nil
+}
+
+// formatEventAttributes formats the optional DogStatsD event fields, if the value has any
+func formatEventAttributes(value interface{}) string {
+	ev, ok := value.(EventValue)
+	if !ok {
+		return ""
+	}
+
+	var b strings.Builder
+	if !ev.Date.IsZero() {
+		fmt.Fprintf(&b, "|d:%d", ev.Date.Unix())
+	}
+	if ev.Priority != "" {
+		fmt.Fprintf(&b, "|p:%s", ev.Priority)
+	}
+	if ev.AlertType != "" {
+		fmt.Fprintf(&b, "|t:%s", ev.AlertType)
+	}
+	// the free-form fields are sanitized like tag values
+	if ev.AggregationKey != "" {
+		fmt.Fprintf(&b, "|k:%s", replaceInvalidChars(ev.AggregationKey, invalidTagValueChars))
+	}
+	if ev.SourceType != "" {
+		fmt.Fprintf(&b, "|s:%s", replaceInvalidChars(ev.SourceType, invalidTagValueChars))
+	}
+
+	return b.String()
+}
+
+// appendServiceCheck appends a DogStatsD service check, the message must be the last field
+func appendServiceCheck(dst []byte, name string, sc ServiceCheckValue, tags Tags) []byte {
+	dst = append(dst, "_sc|"...)
+	dst = appendSanitized(dst, name, invalidNameChars)
+	dst = append(dst, '|')
+	dst = strconv.AppendUint(dst, uint64(sc.Status), 10)
+	if !sc.Timestamp.IsZero() {
+		dst = append(dst, "|d:"...)
+		dst = strconv.AppendInt(dst, sc.Timestamp.Unix(), 10)
+	}
+	if sc.Hostname != "" {
+		dst = append(dst, "|h:"...)
+		dst = appendSanitized(dst, sc.Hostname, invalidTagValueChars)
+	}
+	dst = appendTags(dst, tags)
+	if sc.Message != "" {
+		dst = append(dst, "|m:"...)
+		dst = append(dst, serviceCheckMessageEscaper.Replace(sc.Message)...)
+	}
+
+	return append(dst, '\n')
+}
+
+// formatTags formats the tags as a comma separated list of key:value pairs,
+// replacing the invalid characters of the keys and values
+func formatTags(tags Tags) string {
+	return string(appendTagList(nil, tags))
+}
+
+// appendTags appends the DogStatsD tags section, if there are tags
+func appendTags(dst []byte, tags Tags) []byte {
+	if len(tags) == 0 {
+		return dst
+	}
+	return appendTagList(append(dst, "|#"...), tags)
+}
+
+func appendTagList(dst []byte, tags Tags) []byte {
+	for i, t := range tags {
+		if i > 0 {
+			dst = append(dst, ',')
+		}
+		dst = appendSanitized(dst, t.Key, invalidTagKeyChars)
+		dst = append(dst, ':')
+		start := len(dst)
+		dst = appendValue(dst, t.Value)
+		replaceInvalidBytes(dst[start:], invalidTagValueChars)
+	}
+	return dst
+}
+
+// appendValue appends the value formatted like the %v verb does, without allocating for the basic types
+func appendValue(dst []byte, value interface{}) []byte {
+	switch v := value.(type) {
+	case string:
+		return append(dst, v...)
+	case int:
+		return strconv.AppendInt(dst, int64(v), 10)
+	case int8:
+		return strconv.AppendInt(dst, int64(v), 10)
+	case int16:
+		return strconv.AppendInt(dst, int64(v), 10)
+	case int32:
+		return strconv.AppendInt(dst, int64(v), 10)
+	case int64:
+		return strconv.AppendInt(dst, v, 10)
+	case uint:
+		return strconv.AppendUint(dst, uint64(v), 10)
+	case uint8:
+		return strconv.AppendUint(dst, uint64(v), 10)
+	case uint16:
+		return strconv.AppendUint(dst, uint64(v), 10)
+	case uint32:
+		return strconv.AppendUint(dst, uint64(v), 10)
+	case uint64:
+		return strconv.AppendUint(dst, v, 10)
+	case float32:
+		return strconv.AppendFloat(dst, float64(v), 'g', -1, 32)
+	case float64:
+		return strconv.AppendFloat(dst, v, 'g', -1, 64)
+	case bool:
+		return strconv.AppendBool(dst, v)
+	}
+
+	return fmt.Append(dst, value)
+}
+
+// appendSanitized appends the string replacing its invalid characters by underscores
+func appendSanitized(dst []byte, s string, chars string) []byte {
+	start := len(dst)
+	dst = append(dst, s...)
+	replaceInvalidBytes(dst[start:], chars)
+	return dst
+}
+
+// replaceInvalidBytes replaces in place the invalid characters, that are all ASCII, by underscores
+func replaceInvalidBytes(b []byte, chars string) {
+	for i, c := range b {
+		if strings.IndexByte(chars, c) >= 0 {
+			b[i] = '_'
+		}
+	}
+}
+
+// unsampledCounter returns the value of a sampled counter scaled by the inverse of its rate,
+// for the backends that don't scale it themselves, and whether the value had to be scaled
+func unsampledCounter(op Op, v float64, rate float64) (float64, bool) {
+	if op != OpCounterAdd || rate <= 0 || rate >= 1 {
+		return v, false
+	}
+	return v / rate, true
+}
+
+// nameChars returns the characters that are invalid in the name of a metric of the given operation,
+// event titles are prefixed with their length so only new lines corrupt them
+func nameChars(op Op) string {
+	if op == OpEventSend {
+		return invalidEventTitleChars
+	}
+	return invalidNameChars
+}
+
+func replaceInvalidChars(s, chars string) string {
+	if !strings.ContainsAny(s, chars) {
+		return s
+	}
+
+	return strings.Map(func(r rune) rune {
+		if strings.ContainsRune(chars, r) {
+			return '_'
+		}
+		return r
+	}, s)
+}
+
+// SanitizedEncoder creates a new encoder from a given encoder that handles the names, tag keys and
+// tag values with characters that would corrupt the encoded lines according to the given mode.
+func SanitizedEncoder(e Encoder, mode SanitizeMode) Encoder {
+	return func(name string, op Op, value interface{}, tags Tags, rate float64) (string, error) {
+		if strings.ContainsAny(name, nameChars(op)) {
+			switch mode {
+			case SanitizeDrop:
+				return "", nil
+			case SanitizeError:
+				return "", &InvalidMetricError{Name: name, Reason: "invalid characters in the name"}
+			}
+			name = replaceInvalidChars(name, nameChars(op))
+		}
+
+		sanitized := make(Tags, 0, len(tags))
+		for _, t := range tags {
+			v := fmt.Sprint(t.Value)
+			if !strings.ContainsAny(t.Key, invalidTagKeyChars) && !strings.ContainsAny(v, invalidTagValueChars) {
+				sanitized = append(sanitized, t)
+				continue
+			}
+
+			switch mode {
+			case SanitizeDrop:
+				continue
+			case SanitizeError:
+				return "", &InvalidMetricError{Name: name, Reason: fmt.Sprintf("invalid characters in the tag %q", t.Key)}
+			}
+			sanitized = append(sanitized, Tag{
+				Key:   replaceInvalidChars(t.Key, invalidTagKeyChars),
+				Value: replaceInvalidChars(v, invalidTagValueChars),
+			})
+		}
+
+		return e(name, op, value, sanitized, rate)
+	}
+}
+
 // NamespacedEncoder creates a new encoder from a given encoder and namespace
 func NamespacedEncoder(e Encoder, namespace string) Encoder {
 	return func(name string, op Op, value interface{}, tags Tags, rate float64) (string, error) {
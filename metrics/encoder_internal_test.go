@@ -38,6 +38,7 @@ func TestFormatDataDogLambdaMetric(t *testing.T) {
 		{"x", OpCounterAdd, 123, []Tag{{Key: "x", Value: "1"}}, 1, "MONITORING|0|123|count|x|#x:1\n"},
 		{"x", OpCounterAdd, 123, []Tag{{Key: "x", Value: "1"}, {Key: "y", Value: 2}}, 1, "MONITORING|0|123|count|x|#x:1,y:2\n"},
 		{"x", OpCounterAdd, 123, []Tag{{Key: "x", Value: "1"}, {Key: "y", Value: 2}, {Key: "z", Value: "value"}}, 1, "MONITORING|0|123|count|x|#x:1,y:2,z:value\n"},
+		{"x|y", OpCounterAdd, 123, []Tag{{Key: "x#", Value: "1,2"}}, 1, "MONITORING|0|123|count|x_y|#x_:1_2\n"},
 	}
 
 	for _, test := range tests {
@@ -51,4 +52,84 @@ func TestFormatDataDogLambdaMetric(t *testing.T) {
 
 	_, err = formatDataDogLambdaMetric("some.metric", OpTimerStop, now, Tags{}, time.Now())
 	a.Equal(errors.New(`datadog-lambda encoder: operation "timer stop" not supported`), err)
+
+	_, err = formatDataDogLambdaMetric("some.metric", OpDistributionUpdate, 1.5, Tags{}, time.Now())
+	a.Equal(errors.New(`datadog-lambda encoder: operation "distribution update" not supported`), err)
+
+	_, err = formatDataDogLambdaMetric("some.metric", OpSetAdd, "value", Tags{}, time.Now())
+	a.Equal(errors.New(`datadog-lambda encoder: operation "set add" not supported`), err)
+}
+
+func TestFormatGraphiteMetric(t *testing.T) {
+	t.Parallel()
+	a := assert.New(t)
+
+	now := time.Unix(1700000000, 0)
+
+	var tests = []struct {
+		name   string
+		op     Op
+		value  interface{}
+		tags   Tags
+		rate   float64
+		tagged bool
+		out    string
+	}{
+		{"x", OpCounterAdd, uint64(123), nil, 1, false, "x 123 1700000000\n"},
+		{"x.y", OpGaugeUpdate, 1.5, nil, 1, false, "x.y 1.5 1700000000\n"},
+		{"x", OpTimerStop, 12.5, nil, 1, false, "x 12.5 1700000000\n"},
+		{"x", OpHistogramUpdate, uint64(5), Tags{NewTag("code", 200), NewTag("path", "/a.b")}, 1, false, "x.code.200.path./a_b 5 1700000000\n"},
+		{"x", OpDistributionUpdate, 5.0, Tags{NewTag("code", 200), NewTag("path", "/a.b")}, 1, true, "x;code=200;path=/a.b 5 1700000000\n"},
+		{"x y;z", OpGaugeUpdate, 1, Tags{NewTag("a=b", "c~d")}, 1, true, "x_y_z;a_b=c_d 1 1700000000\n"},
+
+		// the sampled counters are scaled, the rest of the observations are not
+		{"x", OpCounterAdd, uint64(3), nil, 0.25, false, "x 12 1700000000\n"},
+		{"x", OpGaugeUpdate, 3, nil, 0.25, false, "x 3 1700000000\n"},
+		{"x", OpTimerStop, 12.5, nil, 0.5, true, "x 12.5 1700000000\n"},
+	}
+
+	for _, test := range tests {
+		out, err := formatGraphiteMetric(test.name, test.op, test.value, test.tags, test.rate, test.tagged, now)
+		a.NoError(err)
+		a.Equal(test.out, out)
+	}
+
+	_, err := formatGraphiteMetric("x", OpGaugeUpdate, "not a number", nil, 1, false, now)
+	a.EqualError(err, "graphite encoder: value `not a number` cannot be casted to float64")
+}
+
+func TestFormatInfluxLine(t *testing.T) {
+	t.Parallel()
+	a := assert.New(t)
+
+	now := time.Unix(1700000000, 5)
+
+	var tests = []struct {
+		name  string
+		op    Op
+		value interface{}
+		tags  Tags
+		rate  float64
+		out   string
+	}{
+		{"x", OpCounterAdd, uint64(123), nil, 1, "x value=123i 1700000000000000005\n"},
+		{"x", OpGaugeUpdate, 1.5, nil, 1, "x value=1.5 1700000000000000005\n"},
+		{"x", OpGaugeUpdate, 2, nil, 1, "x value=2 1700000000000000005\n"},
+		{"x", OpTimerStop, 12.5, Tags{NewTag("code", 200), NewTag("host", "life")}, 1, "x,code=200,host=life value=12.5 1700000000000000005\n"},
+		{"x y,z", OpHistogramUpdate, uint64(5), Tags{NewTag("a b", "c,d=e")}, 1, `x\ y\,z,a\ b=c\,d\=e value=5 1700000000000000005` + "\n"},
+
+		// the sampled counters are scaled and rounded, the rest of the observations are not
+		{"x", OpCounterAdd, uint64(3), nil, 0.25, "x value=12i 1700000000000000005\n"},
+		{"x", OpCounterAdd, uint64(1), nil, 0.3, "x value=3i 1700000000000000005\n"},
+		{"x", OpGaugeUpdate, 1.5, nil, 0.5, "x value=1.5 1700000000000000005\n"},
+	}
+
+	for _, test := range tests {
+		out, err := formatInfluxLine(test.name, test.op, test.value, test.tags, test.rate, now)
+		a.NoError(err)
+		a.Equal(test.out, out)
+	}
+
+	_, err := formatInfluxLine("x", OpGaugeUpdate, "not a number", nil, 1, now)
+	a.EqualError(err, "influx encoder: value `not a number` cannot be casted to float64")
 }
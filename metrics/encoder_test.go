@@ -1,6 +1,7 @@
 package metrics_test
 
 import (
+	"fmt"
 	"testing"
 	"time"
 
@@ -39,8 +40,39 @@ func TestStatsDEncoder(t *testing.T) {
 
 		{"event title", metrics.OpEventSend, "event text", nil, 1, "_e{11,10}:event title|event text\n"},
 		{"event title", metrics.OpEventSend, "event text", []metrics.Tag{{Key: "x", Value: "1"}, {Key: "y", Value: 2}, {Key: "z", Value: "value"}}, 1, "_e{11,10}:event title|event text|#x:1,y:2,z:value\n"},
+		{"event title", metrics.OpEventSend, metrics.EventValue{Text: "event text"}, nil, 1, "_e{11,10}:event title|event text\n"},
+		{"event title", metrics.OpEventSend, metrics.EventValue{
+			Text:           "event text",
+			Priority:       metrics.EventPriorityLow,
+			AlertType:      metrics.EventAlertError,
+			AggregationKey: "deploy-123",
+			SourceType:     "jenkins",
+			Date:           time.Unix(1500000000, 0),
+		}, []metrics.Tag{{Key: "x", Value: "1"}}, 1, "_e{11,10}:event title|event text|d:1500000000|p:low|t:error|k:deploy-123|s:jenkins|#x:1\n"},
+		{"event title", metrics.OpEventSend, metrics.EventValue{
+			Text:           "event text",
+			AggregationKey: "deploy|123#x",
+			SourceType:     "jenkins,ci\n",
+		}, nil, 1, "_e{11,10}:event title|event text|k:deploy_123_x|s:jenkins_ci_\n"},
+
+		{"x|y:z", metrics.OpCounterAdd, 1, []metrics.Tag{{Key: "a,b", Value: "c|d#e"}, {Key: "url", Value: "http://x\ny"}}, 1, "x_y_z:1|c|@1.0000|#a_b:c_d_e,url:http://x_y\n"},
+		{"event: title", metrics.OpEventSend, "event text", nil, 1, "_e{12,10}:event: title|event text\n"},
 
 		{"timer", metrics.OpTimerStop, 123.321, nil, 1, "timer:123.321|ms|@1.0000\n"},
+
+		{"distribution", metrics.OpDistributionUpdate, 1.5, nil, 1, "distribution:1.5|d|@1.0000\n"},
+		{"distribution", metrics.OpDistributionUpdate, 1.5, []metrics.Tag{{Key: "x", Value: "1"}}, 0.5, "distribution:1.5|d|@0.5000|#x:1\n"},
+		{"set", metrics.OpSetAdd, "player1", nil, 1, "set:player1|s|@1.0000\n"},
+		{"set", metrics.OpSetAdd, 42, []metrics.Tag{{Key: "x", Value: "1"}}, 1, "set:42|s|@1.0000|#x:1\n"},
+
+		{"check", metrics.OpServiceCheckSend, metrics.ServiceCheckValue{}, nil, 1, "_sc|check|0\n"},
+		{"check", metrics.OpServiceCheckSend, metrics.ServiceCheckValue{
+			Status:    metrics.ServiceCheckCritical,
+			Hostname:  "host1",
+			Timestamp: time.Unix(1500000000, 0),
+			Message:   "connection refused\nm:retrying",
+		}, []metrics.Tag{{Key: "x", Value: "1"}}, 1, "_sc|check|2|d:1500000000|h:host1|#x:1|m:connection refused\\nm\\:retrying\n"},
+		{"check", metrics.OpServiceCheckSend, metrics.ServiceCheckValue{Hostname: "host1|#x:1\n"}, nil, 1, "_sc|check|0|h:host1__x:1_\n"},
 	}
 
 	for _, test := range tests {
@@ -50,6 +82,11 @@ func TestStatsDEncoder(t *testing.T) {
 	}
 }
 
+func TestStatsDEncoderInvalidServiceCheck(t *testing.T) {
+	_, err := metrics.StatsDEncoder("check", metrics.OpServiceCheckSend, "ok", nil, 1)
+	assert.EqualError(t, err, "statsd encoder: invalid service check value ok")
+}
+
 func TestLibratoStatsDEncoder(t *testing.T) {
 	t.Parallel()
 
@@ -76,8 +113,12 @@ func TestLibratoStatsDEncoder(t *testing.T) {
 
 		{"event title", metrics.OpEventSend, "event text", nil, 1, "_e{11,10}:event title|event text\n"},
 		{"event title", metrics.OpEventSend, "event text", []metrics.Tag{{Key: "x", Value: "1"}, {Key: "y", Value: 2}, {Key: "z", Value: "value"}}, 1, "_e{11,10}:event title|event text\n"},
+		{"event title", metrics.OpEventSend, metrics.EventValue{Text: "event text", Priority: metrics.EventPriorityLow}, nil, 1, "_e{11,10}:event title|event text\n"},
 
 		{"timer", metrics.OpTimerStop, 123.321, nil, 1, "timer:123.321|ms|@1.0000\n"},
+
+		{"set", metrics.OpSetAdd, "player1", []metrics.Tag{{Key: "x", Value: "1"}}, 1, "set:player1|s|@1.0000\n"},
+		{"set|x", metrics.OpSetAdd, "player1", nil, 1, "set_x:player1|s|@1.0000\n"},
 	}
 
 	for _, test := range tests {
@@ -85,6 +126,39 @@ func TestLibratoStatsDEncoder(t *testing.T) {
 		assert.NoError(t, err)
 		assert.Equal(t, test.out, out)
 	}
+
+	_, err := metrics.LibratoStatsDEncoder("distribution", metrics.OpDistributionUpdate, 1.5, nil, 1)
+	assert.EqualError(t, err, "librato encoder: operation distribution update not supported")
+
+	_, err = metrics.LibratoStatsDEncoder("check", metrics.OpServiceCheckSend, metrics.ServiceCheckValue{}, nil, 1)
+	assert.EqualError(t, err, "librato encoder: operation service check send not supported")
+}
+
+func TestGraphiteAndInfluxEncoders(t *testing.T) {
+	t.Parallel()
+
+	out, err := metrics.GraphiteEncoder("x", metrics.OpCounterAdd, uint64(1), metrics.Tags{metrics.NewTag("code", 200)}, 1)
+	assert.NoError(t, err)
+	assert.Regexp(t, `^x\.code\.200 1 \d+\n$`, out)
+
+	out, err = metrics.GraphiteTaggedEncoder("x", metrics.OpCounterAdd, uint64(1), metrics.Tags{metrics.NewTag("code", 200)}, 1)
+	assert.NoError(t, err)
+	assert.Regexp(t, `^x;code=200 1 \d+\n$`, out)
+
+	out, err = metrics.InfluxLineEncoder("x", metrics.OpCounterAdd, uint64(1), metrics.Tags{metrics.NewTag("code", 200)}, 1)
+	assert.NoError(t, err)
+	assert.Regexp(t, `^x,code=200 value=1i \d+\n$`, out)
+
+	for _, op := range []metrics.Op{metrics.OpEventSend, metrics.OpSetAdd, metrics.OpServiceCheckSend} {
+		_, err = metrics.GraphiteEncoder("x", op, "value", nil, 1)
+		assert.EqualError(t, err, fmt.Sprintf("graphite encoder: operation %v not supported", op))
+
+		_, err = metrics.GraphiteTaggedEncoder("x", op, "value", nil, 1)
+		assert.EqualError(t, err, fmt.Sprintf("graphite encoder: operation %v not supported", op))
+
+		_, err = metrics.InfluxLineEncoder("x", op, "value", nil, 1)
+		assert.EqualError(t, err, fmt.Sprintf("influx encoder: operation %v not supported", op))
+	}
 }
 
 func TestNamespacedEncoder(t *testing.T) {
@@ -94,3 +168,92 @@ func TestNamespacedEncoder(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, "test_namespace.test:123|c|@1.0000\n", out)
 }
+
+func TestSanitizedEncoder(t *testing.T) {
+	t.Parallel()
+
+	tags := metrics.Tags{{Key: "ok", Value: 1}, {Key: "a,b", Value: "c"}, {Key: "url", Value: "http://x|y"}}
+
+	var tests = []struct {
+		mode metrics.SanitizeMode
+		name string
+		tags metrics.Tags
+		out  string
+		err  string
+	}{
+		{metrics.SanitizeReplace, "x", tags, "x:1|c|@1.0000|#ok:1,a_b:c,url:http://x_y\n", ""},
+		{metrics.SanitizeReplace, "x#y", nil, "x_y:1|c|@1.0000\n", ""},
+		{metrics.SanitizeDrop, "x", tags, "x:1|c|@1.0000|#ok:1\n", ""},
+		{metrics.SanitizeDrop, "x#y", nil, "", ""},
+		{metrics.SanitizeError, "x", tags[:1], "x:1|c|@1.0000|#ok:1\n", ""},
+		{metrics.SanitizeError, "x", tags, "", "metrics: invalid metric `x`: invalid characters in the tag \"a,b\""},
+		{metrics.SanitizeError, "x#y", nil, "", "metrics: invalid metric `x#y`: invalid characters in the name"},
+	}
+
+	for _, test := range tests {
+		out, err := metrics.SanitizedEncoder(metrics.StatsDEncoder, test.mode)(test.name, metrics.OpCounterAdd, 1, test.tags, 1)
+		if test.err != "" {
+			assert.EqualError(t, err, test.err)
+		} else {
+			assert.NoError(t, err)
+		}
+		assert.Equal(t, test.out, out)
+	}
+}
+
+func TestSanitizedEncoderErrorsAreReportedByThePublisher(t *testing.T) {
+	errs := make(chan error, 1)
+	rec := make(recorder, 1)
+	p := metrics.NewPublisher(rec, metrics.SanitizedEncoder(metrics.StatsDEncoder, metrics.SanitizeError), time.Hour, func(err error) {
+		errs <- err
+	}, metrics.WithoutAggregation())
+
+	p.Counter("x", metrics.NewTag("path", "/a|b")).Inc()
+
+	err := <-errs
+	assert.IsType(t, &metrics.InvalidMetricError{}, err)
+}
+
+func TestAppendStatsDEncoder(t *testing.T) {
+	dst := []byte("previous\n")
+	dst, err := metrics.AppendStatsDEncoder(dst, "x", metrics.OpCounterAdd, uint64(3), metrics.Tags{{Key: "a", Value: 1.5}}, 1)
+
+	assert.NoError(t, err)
+	assert.Equal(t, "previous\nx:3|c|@1.0000|#a:1.5\n", string(dst))
+
+	dst, err = metrics.AppendStatsDEncoder(dst, "x", metrics.Op(255), 1, nil, 1)
+	assert.Error(t, err)
+	assert.Equal(t, "previous\nx:3|c|@1.0000|#a:1.5\n", string(dst))
+}
+
+func TestAppendStatsDEncoderFormatsValuesLikeStatsDEncoder(t *testing.T) {
+	values := []interface{}{
+		int8(-1), int16(2), int32(-3), int64(4), uint(5), uint8(6), uint16(7), uint32(8), uint64(9),
+		float32(1.1), 1e21, 1e-7, 123456789.0, true, time.Second, struct{ A int }{1},
+	}
+
+	for _, v := range values {
+		out, err := metrics.AppendStatsDEncoder(nil, "x", metrics.OpGaugeUpdate, v, nil, 1)
+		assert.NoError(t, err)
+		assert.Equal(t, fmt.Sprintf("x:%v|g|@1.0000\n", v), string(out))
+	}
+}
+
+func BenchmarkStatsDEncoder(b *testing.B) {
+	tags := metrics.Tags{metrics.NewTag("host", "life"), metrics.NewTag("code", 200)}
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		_, _ = metrics.StatsDEncoder("requests", metrics.OpCounterAdd, uint64(1), tags, 1)
+	}
+}
+
+func BenchmarkAppendStatsDEncoder(b *testing.B) {
+	tags := metrics.Tags{metrics.NewTag("host", "life"), metrics.NewTag("code", 200)}
+	var dst []byte
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		dst, _ = metrics.AppendStatsDEncoder(dst[:0], "requests", metrics.OpCounterAdd, uint64(1), tags, 1)
+	}
+}
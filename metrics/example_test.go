@@ -5,7 +5,11 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"net/http"
+	"net/http/httptest"
+	"time"
 
+	"github.com/socialpoint-labs/bsk/httpx"
 	"github.com/socialpoint-labs/bsk/metrics"
 )
 
@@ -39,6 +43,13 @@ func ExampleEvent() {
 	event.Send()
 	event.SendWithText("event text")
 
+	// DogStatsD event attributes can be set with options
+	event.WithOptions(
+		metrics.WithEventAlertType(metrics.EventAlertError),
+		metrics.WithEventPriority(metrics.EventPriorityLow),
+		metrics.WithEventAggregationKey("incident-42"),
+	).SendWithText("something went wrong")
+
 	// Output:
 }
 
@@ -50,6 +61,16 @@ func ExampleTimer() {
 	timer.Start()
 	timer.Stop()
 
+	// durations measured elsewhere
+	timer.Record(42 * time.Millisecond)
+
+	// the duration of a function
+	timer.Time(func() {})
+
+	// a stopwatch doesn't share its state with the timer, so the timer can be shared between goroutines
+	stopwatch := timer.StartStopwatch()
+	stopwatch.Stop()
+
 	// Output:
 }
 
@@ -63,6 +84,36 @@ func ExampleHistogram() {
 	// Output:
 }
 
+func ExampleDistribution() {
+	discardAllMetrics := metrics.NewDiscardAll()
+	go discardAllMetrics.Run(context.Background())
+
+	distribution := discardAllMetrics.Distribution("test.distribution")
+	distribution.AddValue(4.2)
+	distribution.AddValue(66.6)
+	// Output:
+}
+
+func ExampleSet() {
+	discardAllMetrics := metrics.NewDiscardAll()
+	go discardAllMetrics.Run(context.Background())
+
+	set := discardAllMetrics.Set("test.unique_players")
+	set.Add("player1")
+	set.Add("player2")
+	// Output:
+}
+
+func ExampleServiceCheck() {
+	discardAllMetrics := metrics.NewDiscardAll()
+	go discardAllMetrics.Run(context.Background())
+
+	check := discardAllMetrics.ServiceCheck("database.can_connect").WithHostname("db1")
+	check.Send(metrics.ServiceCheckOK)
+	check.SendWithMessage(metrics.ServiceCheckCritical, "connection refused")
+	// Output:
+}
+
 func Example_statsDBackend() {
 	// because UDP is fire and forget this always work. If you create
 	// and UDP server and then close it it will fail as expected.
@@ -99,13 +150,12 @@ func ExampleErrorHandler() {
 
 	handler := func(err error) { errs <- err }
 
-	publisher := metrics.NewPublisher(&FailingWriter{}, metrics.StatsDEncoder, metrics.FlushEvery5s, handler)
+	publisher := metrics.NewPublisher(&FailingWriter{}, metrics.StatsDEncoder, 10*time.Millisecond, handler)
 	go publisher.Run(context.Background())
 
 	gauge := publisher.Gauge("test.counter")
 	gauge.Update(20)
 
-	publisher.Flush()
 	fmt.Println(<-errs)
 
 	// Output: error: don't care; I always fail
@@ -136,6 +186,21 @@ func Example_withGoStats() {
 	// Output:
 }
 
+func ExampleRegistry() {
+	registry := metrics.NewRegistry(nil)
+	registry.Counter("requests", metrics.NewTag("code", 200)).Inc()
+
+	// the registry can be published with expvar too, see expvar.Publish and Registry.Var
+	router := httpx.NewRouter()
+	router.Route("/debug/metrics", registry)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/debug/metrics", nil))
+	fmt.Print(w.Body.String())
+
+	// Output: {"series":[{"name":"requests","kind":"counter","tags":{"code":"200"},"value":1}]}
+}
+
 type FailingWriter struct {
 }
 
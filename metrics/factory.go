@@ -1,79 +1,480 @@
 package metrics
 
 import (
+	"fmt"
 	"net/url"
+	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/socialpoint-labs/bsk/contextx"
 )
 
+const (
+	graphiteHost = "localhost:2003"
+	influxHost   = "localhost:8089"
+	// how often the stdout publisher writes the metrics if the DSN doesn't set the flush interval
+	stdoutFlush = 100 * time.Millisecond
+)
+
+// MetricsConfig is the configuration of the metrics of an application, usually parsed from a DSN
+// with ParseMetricsDSN. The empty fields take the defaults of the backends.
+type MetricsConfig struct {
+	// Scheme is the backend of the metrics: datadog, datadog-unix, datadog-lambda, prometheus,
+	// otlp, graphite, influx, stdout or discard
+	Scheme string
+	// Namespace prefixes the names of the metrics, it is required by all the backends but stdout and discard
+	Namespace string
+	// GoStats is whether the Go VM stats are published, they never are for datadog-lambda
+	GoStats bool
+	// Host is the host of the agent for datadog, and the address of the backend for otlp, graphite and influx
+	Host string
+	// Port is the port of the agent for datadog
+	Port string
+	// Addr is the socket of the agent for datadog-unix, and the address to serve the metrics for prometheus
+	Addr string
+	// Path is the path to serve the metrics for prometheus, and the path of the collector for otlp
+	Path string
+	// TLS is whether the collector is reached using HTTPS for otlp
+	TLS bool
+	// Service is the name of the service for otlp, the namespace if it is empty
+	Service string
+	// Tagged is whether the metrics are tagged using Graphite 1.1 tags for graphite, and stdout with the graphite format
+	Tagged bool
+	// Protocol is either tcp or udp for graphite and influx
+	Protocol string
+	// Flush is how often the metrics are published, all the backends but prometheus and discard have their own default
+	Flush time.Duration
+	// Tags are added to all the metrics, including the Go VM stats
+	Tags Tags
+	// GoStatsInterval is how often the Go VM stats are published, every 15 seconds if it is zero
+	GoStatsInterval time.Duration
+	// SampleRate is the sample rate of the metrics that don't declare their own, see WithSampleRate
+	SampleRate float64
+	// MaxPacketSize is the maximum size of every write of the publisher, see WithMaxPacketSize
+	MaxPacketSize int
+	// QueueSize is the number of observations that can be waiting to be written by the publisher, see WithQueueSize
+	QueueSize int
+	// Format is the encoding of the metrics for stdout: text (the default), statsd, graphite or influx
+	Format string
+}
+
+// InvalidDSNError is returned by ParseMetricsDSN when the DSN is not a valid configuration.
+type InvalidDSNError struct {
+	DSN string
+	Err error
+}
+
+func (e *InvalidDSNError) Error() string {
+	return fmt.Sprintf("metrics: invalid DSN `%s`: %v", e.DSN, e.Err)
+}
+
+func (e *InvalidDSNError) Unwrap() error {
+	return e.Err
+}
+
+// ParseMetricsDSN parses and validates a DSN configuration, e.g. `datadog://?namespace=my_namespace`,
+// where the scheme selects the backend. It returns an *InvalidDSNError if it is not valid.
+//
+// All the backends but `stdout` and `discard` need the `namespace` query parameter, and the Go VM
+// stats are published unless `gostats=false`.
+//
+// The `datadog` scheme sends the metrics to the agent in the `host` and `port` query parameters,
+// and the `datadog-unix` scheme to the agent in the `addr` socket query parameter.
+//
+// The `prometheus` scheme serves the metrics in the `addr` (default ":9090")
+// and `path` (default "/metrics") query parameters.
+//
+// The `otlp` scheme exports the metrics to the OTLP/HTTP collector in the host of the DSN
+// (default "localhost:4318"), with the `path` (default "/v1/metrics") query parameter, using
+// HTTPS when `tls=true`. The `service` query parameter sets the service name (default the namespace).
+//
+// The `graphite` and `influx` schemes publish the metrics to the host of the DSN, by default
+// "localhost:2003" using TCP for Graphite and "localhost:8089" using UDP for InfluxDB, the
+// `protocol` query parameter sets either `tcp` or `udp`. Graphite metrics are tagged using
+// Graphite 1.1 tags when `tagged=true`, and using path segments otherwise.
+//
+// The `stdout` scheme writes the metrics to the standard output, in the `format` query parameter
+// that is either `text` (the default), `statsd`, `graphite` (tagged when `tagged=true`) or `influx`.
+//
+// All the backends accept these query parameters to tune the metrics:
+//   - `flush` is how often the metrics are published, as a duration, e.g. `flush=10s`.
+//   - `tags` are added to all the metrics, as a list of key:value pairs, e.g. `tags=env:prod,region:eu`.
+//   - `gostats_interval` is how often the Go VM stats are published, as a duration (default 15s).
+//   - `sample_rate` is the default sample rate of the metrics, between 0 and 1.
+//   - `max_packet` is the maximum size in bytes of every write of the publisher.
+//   - `queue_size` is the number of observations that can be waiting to be written by the publisher.
+//
+// The backends that don't publish the metrics themselves, like prometheus, ignore the parameters that don't apply.
+func ParseMetricsDSN(dsn string) (MetricsConfig, error) {
+	config, err := parseMetricsDSN(dsn)
+	if err != nil {
+		return MetricsConfig{}, &InvalidDSNError{DSN: dsn, Err: err}
+	}
+
+	return config, nil
+}
+
+func parseMetricsDSN(dsn string) (MetricsConfig, error) {
+	URL, err := url.Parse(dsn)
+	if err != nil {
+		return MetricsConfig{}, err
+	}
+
+	params := URL.Query()
+
+	config := MetricsConfig{
+		Scheme:    URL.Scheme,
+		Namespace: params.Get("namespace"),
+		Host:      URL.Host,
+		Port:      params.Get("port"),
+		Addr:      params.Get("addr"),
+		Path:      params.Get("path"),
+		Service:   params.Get("service"),
+		Protocol:  params.Get("protocol"),
+		Format:    params.Get("format"),
+	}
+
+	// the datadog agent is configured with query parameters
+	if config.Scheme == "datadog" {
+		config.Host = params.Get("host")
+	}
+
+	if config.GoStats, err = parseBoolParam(params, "gostats", true); err != nil {
+		return MetricsConfig{}, err
+	}
+	if config.TLS, err = parseBoolParam(params, "tls", false); err != nil {
+		return MetricsConfig{}, err
+	}
+	if config.Tagged, err = parseBoolParam(params, "tagged", false); err != nil {
+		return MetricsConfig{}, err
+	}
+	if config.Flush, err = parseDurationParam(params, "flush"); err != nil {
+		return MetricsConfig{}, err
+	}
+	if config.GoStatsInterval, err = parseDurationParam(params, "gostats_interval"); err != nil {
+		return MetricsConfig{}, err
+	}
+	if config.MaxPacketSize, err = parseSizeParam(params, "max_packet"); err != nil {
+		return MetricsConfig{}, err
+	}
+	if config.QueueSize, err = parseSizeParam(params, "queue_size"); err != nil {
+		return MetricsConfig{}, err
+	}
+	if config.SampleRate, err = parseSampleRateParam(params, "sample_rate"); err != nil {
+		return MetricsConfig{}, err
+	}
+	if config.Tags, err = parseTagsParam(params, "tags"); err != nil {
+		return MetricsConfig{}, err
+	}
+
+	return config, config.validate()
+}
+
+// parseBoolParam returns the boolean value of the query parameter, or the default value if it is not set
+func parseBoolParam(params url.Values, name string, defaultValue bool) (bool, error) {
+	if !params.Has(name) {
+		return defaultValue, nil
+	}
+
+	v, err := strconv.ParseBool(params.Get(name))
+	if err != nil {
+		return false, fmt.Errorf("invalid `%s` parameter `%s`, it must be a boolean", name, params.Get(name))
+	}
+
+	return v, nil
+}
+
+// parseDurationParam returns the positive duration of the query parameter, or zero if it is not set
+func parseDurationParam(params url.Values, name string) (time.Duration, error) {
+	if !params.Has(name) {
+		return 0, nil
+	}
+
+	d, err := time.ParseDuration(params.Get(name))
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid `%s` parameter `%s`, it must be a positive duration like 10s", name, params.Get(name))
+	}
+
+	return d, nil
+}
+
+// parseSizeParam returns the positive integer value of the query parameter, or zero if it is not set
+func parseSizeParam(params url.Values, name string) (int, error) {
+	if !params.Has(name) {
+		return 0, nil
+	}
+
+	n, err := strconv.Atoi(params.Get(name))
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid `%s` parameter `%s`, it must be a positive integer", name, params.Get(name))
+	}
+
+	return n, nil
+}
+
+// parseSampleRateParam returns the sample rate of the query parameter, or zero if it is not set
+func parseSampleRateParam(params url.Values, name string) (float64, error) {
+	if !params.Has(name) {
+		return 0, nil
+	}
+
+	rate, err := strconv.ParseFloat(params.Get(name), 64)
+	if err != nil || rate <= 0 || rate > 1 {
+		return 0, fmt.Errorf("invalid `%s` parameter `%s`, it must be a number greater than 0 and up to 1", name, params.Get(name))
+	}
+
+	return rate, nil
+}
+
+// parseTagsParam returns the tags of a query parameter like `env:prod,region:eu`, or nil if it is not set
+func parseTagsParam(params url.Values, name string) (Tags, error) {
+	if params.Get(name) == "" {
+		return nil, nil
+	}
+
+	var tags Tags
+	for _, pair := range strings.Split(params.Get(name), ",") {
+		key, value, ok := strings.Cut(pair, ":")
+		if !ok || key == "" || value == "" {
+			return nil, fmt.Errorf("invalid tag `%s` in the `%s` parameter, tags must be key:value pairs separated by commas", pair, name)
+		}
+		tags = append(tags, NewTag(key, value))
+	}
+
+	return tags, nil
+}
+
+// validate returns an error if the configuration is not valid
+func (c MetricsConfig) validate() error {
+	switch c.Scheme {
+	case "datadog", "datadog-unix", "datadog-lambda", "prometheus", "otlp", "graphite", "influx":
+		if c.Namespace == "" {
+			return fmt.Errorf("%s metrics need a namespace", c.Scheme)
+		}
+	case "stdout", "discard":
+	default:
+		return fmt.Errorf("invalid metrics publisher type `%s`", c.Scheme)
+	}
+
+	switch c.Protocol {
+	case "", "tcp", "udp":
+	default:
+		return fmt.Errorf("invalid metrics protocol `%s`, it must be tcp or udp", c.Protocol)
+	}
+
+	switch c.Format {
+	case "", "text", "statsd", "graphite", "influx":
+	default:
+		return fmt.Errorf("invalid metrics format `%s`, it must be text, statsd, graphite or influx", c.Format)
+	}
+
+	switch {
+	case c.Flush < 0:
+		return fmt.Errorf("invalid metrics flush interval %s, it must be positive", c.Flush)
+	case c.GoStatsInterval < 0:
+		return fmt.Errorf("invalid go stats interval %s, it must be positive", c.GoStatsInterval)
+	case c.SampleRate < 0 || c.SampleRate > 1:
+		return fmt.Errorf("invalid metrics sample rate %v, it must be between 0 and 1", c.SampleRate)
+	case c.MaxPacketSize < 0:
+		return fmt.Errorf("invalid metrics max packet size %d, it must be positive", c.MaxPacketSize)
+	case c.QueueSize < 0:
+		return fmt.Errorf("invalid metrics queue size %d, it must be positive", c.QueueSize)
+	}
+
+	return nil
+}
+
 // NewMetricsRunnerFromDSN creates a new metrics publisher and returns its Metrics
-// and Runner from a DSN configuration. If the configuration is not valid it panics.
+// and Runner from a DSN configuration, see ParseMetricsDSN. If the configuration is
+// not valid it panics, see NewMetricsRunner.
 func NewMetricsRunnerFromDSN(dsn string) (Metrics, contextx.Runner) {
-	// param validation
-	URL, err := url.Parse(dsn)
+	config, err := ParseMetricsDSN(dsn)
 	if err != nil {
 		panic(err)
 	}
 
-	params := URL.Query()
+	m, r, err := NewMetricsRunner(config)
+	if err != nil {
+		panic(err)
+	}
+
+	return m, r
+}
 
-	gostats := params.Get("gostats") != "false"
+// NewMetricsRunner creates a new metrics publisher and returns its Metrics and Runner
+// from a configuration, or an error if the configuration is not valid or the publisher
+// cannot be created.
+//
+// The datadog-unix publishers connect to the agent in the background, so the application
+// doesn't fail when the agent is not ready when it starts, see WithDDLazyConnection.
+func NewMetricsRunner(config MetricsConfig) (Metrics, contextx.Runner, error) {
+	if err := config.validate(); err != nil {
+		return nil, nil, fmt.Errorf("metrics: invalid config: %w", err)
+	}
+
+	gostats := config.GoStats
 
 	// publisher is both Metrics and Runner
-	var publisher *Publisher
-	namespace := params.Get("namespace")
-	switch URL.Scheme {
+	var publisher interface {
+		Metrics
+		contextx.Runner
+	}
+	switch config.Scheme {
 	case "datadog":
-		if namespace == "" {
-			panic("datadog metrics need a namespace")
-		}
-		publisher = NewDataDog(
-			WithDDHost(params.Get("host")),
-			WithDDPort(params.Get("port")),
+		p, err := DialDataDog(
+			WithDDHost(config.Host),
+			WithDDPort(config.Port),
+			WithDDFlushInterval(config.Flush),
+			WithDDPublisherOptions(config.publisherOptions()...),
 		)
-	case "datadog-unix":
-		if namespace == "" {
-			panic("datadog metrics need a namespace")
+		if err != nil {
+			return nil, nil, fmt.Errorf("metrics: %w", err)
 		}
-		publisher = NewDataDogUnix(
-			WithDDUnixAddress(params.Get("addr")),
+		publisher = p
+	case "datadog-unix":
+		p, err := DialDataDogUnix(
+			WithDDUnixAddress(config.Addr),
+			WithDDLazyConnection(),
+			WithDDFlushInterval(config.Flush),
+			WithDDPublisherOptions(config.publisherOptions()...),
 		)
-	case "datadog-lambda":
-		if namespace == "" {
-			panic("datadog metrics need a namespace")
+		if err != nil {
+			return nil, nil, fmt.Errorf("metrics: %w", err)
 		}
-		publisher = NewDataDogLambda()
+		publisher = p
+	case "datadog-lambda":
+		publisher = NewPublisher(os.Stdout, DataDogLambdaEncoder, config.flushInterval(FlushEvery3s), nil, config.publisherOptions()...)
 		gostats = false
+	case "prometheus":
+		prometheus := NewPrometheus(nil)
+		publisher = struct {
+			Metrics
+			contextx.Runner
+		}{prometheus, PrometheusRunner(prometheus, config.Addr, config.Path)}
+	case "otlp":
+		endpoint := url.URL{Scheme: "http", Host: config.Host, Path: config.Path}
+		if endpoint.Host == "" {
+			endpoint.Host = otlpHost
+		}
+		if config.TLS {
+			endpoint.Scheme = "https"
+		}
+		service := config.Service
+		if service == "" {
+			service = config.Namespace
+		}
+		publisher = NewOTLP(endpoint.String(), nil,
+			WithOTLPServiceName(service),
+			WithOTLPServiceNamespace(config.Namespace),
+			WithOTLPInterval(config.flushInterval(FlushEvery15s)),
+		)
+	case "graphite":
+		encoder := GraphiteEncoder
+		if config.Tagged {
+			encoder = GraphiteTaggedEncoder
+		}
+		w := lineProtocolWriter(config.Host, graphiteHost, config.Protocol, "tcp")
+		publisher = NewPublisher(w, encoder, config.flushInterval(FlushEvery15s), nil, config.publisherOptions()...)
+	case "influx":
+		w := lineProtocolWriter(config.Host, influxHost, config.Protocol, "udp")
+		publisher = NewPublisher(w, InfluxLineEncoder, config.flushInterval(FlushEvery15s), nil, config.publisherOptions()...)
 	case "stdout":
-		publisher = NewStdout(100*time.Millisecond, DiscardErrors)
+		publisher = NewPublisher(os.Stdout, config.stdoutEncoder(), config.flushInterval(stdoutFlush), DiscardErrors, config.publisherOptions()...)
 	case "discard":
 		publisher = NewDiscardAll()
-	default:
-		panic("invalid metrics publisher type")
 	}
 
-	var serviceTag Tag
+	var gostatsTags Tags
 	var m Metrics
 	var r contextx.Runner
 
 	// init metrics
-	if namespace != "" {
-		m = WithNamespace(publisher, namespace)
-		serviceTag = NewTag("namespace", namespace)
+	if config.Namespace != "" {
+		m = WithNamespace(publisher, config.Namespace)
+		gostatsTags = append(gostatsTags, NewTag("namespace", config.Namespace))
 	} else {
 		m = publisher
 	}
 
+	if len(config.Tags) > 0 {
+		m = NewTaggedMetrics(m, config.Tags...)
+		gostatsTags = append(gostatsTags, config.Tags...)
+	}
+
 	// init runner
 	if gostats {
 		r = contextx.MultiRunner(
 			publisher,
-			NewGoStatsRunner(publisher, FlushEvery15s, serviceTag),
+			NewGoStatsRunner(publisher, config.gostatsInterval(), gostatsTags...),
 		)
 	} else {
 		r = publisher
 	}
 
-	return m, r
+	return m, r, nil
+}
+
+// flushInterval returns the flush interval of the configuration, or the given default if it is not set
+func (c MetricsConfig) flushInterval(defaultInterval time.Duration) time.Duration {
+	if c.Flush == 0 {
+		return defaultInterval
+	}
+
+	return c.Flush
+}
+
+// gostatsInterval returns how often the Go VM stats are published
+func (c MetricsConfig) gostatsInterval() time.Duration {
+	if c.GoStatsInterval == 0 {
+		return FlushEvery15s
+	}
+
+	return c.GoStatsInterval
+}
+
+// publisherOptions returns the options of the publisher that are set in the configuration
+func (c MetricsConfig) publisherOptions() []PublisherOption {
+	var opts []PublisherOption
+	if c.SampleRate != 0 {
+		opts = append(opts, WithSampleRate(c.SampleRate))
+	}
+	if c.MaxPacketSize != 0 {
+		opts = append(opts, WithMaxPacketSize(c.MaxPacketSize))
+	}
+	if c.QueueSize != 0 {
+		opts = append(opts, WithQueueSize(c.QueueSize))
+	}
+
+	return opts
+}
+
+// stdoutEncoder returns the encoder of the format of the configuration
+func (c MetricsConfig) stdoutEncoder() Encoder {
+	switch c.Format {
+	case "statsd":
+		return StatsDEncoder
+	case "graphite":
+		if c.Tagged {
+			return GraphiteTaggedEncoder
+		}
+		return GraphiteEncoder
+	case "influx":
+		return InfluxLineEncoder
+	default:
+		return StdoutEncoder
+	}
+}
+
+// lineProtocolWriter returns a writer to the given host using the given protocol, or the defaults if they are empty
+func lineProtocolWriter(host, defaultHost, protocol, defaultProtocol string) *dialWriter {
+	if host == "" {
+		host = defaultHost
+	}
+	if protocol == "" {
+		protocol = defaultProtocol
+	}
+
+	return newDialWriter(protocol, host)
 }
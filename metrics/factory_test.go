@@ -1,7 +1,10 @@
 package metrics_test
 
 import (
+	"bufio"
 	"context"
+	"errors"
+	"net"
 	"testing"
 	"time"
 
@@ -28,6 +31,24 @@ func TestNewPublisherWithDSN(t *testing.T) {
 		{"datadog-lambda://", false},
 		{"datadog-lambda://?namespace=my_namespace", true},
 		{"datadog-lambda://?namespace=my_namespace&gostats=false", true},
+		{"prometheus://", false},
+		{"prometheus://?namespace=my_namespace&addr=127.0.0.1:0", true},
+		{"otlp://", false},
+		{"otlp://127.0.0.1:1?namespace=my_namespace&service=my_service", true},
+		{"graphite://", false},
+		{"graphite://?namespace=my_namespace", true},
+		{"graphite://127.0.0.1:2003?namespace=my_namespace&protocol=udp&tagged=true", true},
+		{"influx://", false},
+		{"influx://?namespace=my_namespace&protocol=sctp", false},
+		{"influx://127.0.0.1:8089?namespace=my_namespace", true},
+		{"datadog-unix://?namespace=my_namespace&addr=/does/not/exist.socket", true},
+		{"datadog://?namespace=my_namespace&gostats=nope", false},
+		{"datadog://?namespace=my_namespace&host=does.not.exist.invalid", false},
+		{"datadog://?namespace=my_namespace&flush=5s&tags=env:prod,region:eu&gostats_interval=1m&sample_rate=0.5&max_packet=512&queue_size=128", true},
+		{"stdout://?format=influx&flush=1s", true},
+		{"stdout://?format=xml", false},
+		{"datadog://?namespace=my_namespace&flush=soon", false},
+		{"datadog://?namespace=my_namespace&tags=env", false},
 	} {
 		if testCase.isValid {
 			publisher, runner := metrics.NewMetricsRunnerFromDSN(testCase.DSN)
@@ -46,3 +67,137 @@ func TestNewPublisherWithDSN(t *testing.T) {
 		cancel()
 	}
 }
+
+func TestGraphiteDSN(t *testing.T) {
+	a := assert.New(t)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	a.NoError(err)
+	defer listener.Close()
+
+	m, runner := metrics.NewMetricsRunnerFromDSN("graphite://" + listener.Addr().String() + "?namespace=my_namespace&tagged=true&gostats=false")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		runner.Run(ctx)
+		close(stopped)
+	}()
+
+	m.Counter("requests", metrics.NewTag("code", 200)).Inc()
+	cancel()
+	<-stopped
+
+	conn, err := listener.Accept()
+	a.NoError(err)
+	defer conn.Close()
+
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	a.NoError(err)
+	a.Regexp(`^my_namespace\.requests;code=200 1 \d+\n$`, line)
+}
+
+func TestParseMetricsDSN(t *testing.T) {
+	a := assert.New(t)
+
+	config, err := metrics.ParseMetricsDSN("datadog://?namespace=my_namespace&host=agent&port=8126")
+	a.NoError(err)
+	a.Equal(metrics.MetricsConfig{Scheme: "datadog", Namespace: "my_namespace", GoStats: true, Host: "agent", Port: "8126"}, config)
+
+	config, err = metrics.ParseMetricsDSN("graphite://carbon:2003?namespace=my_namespace&gostats=false&tagged=true&protocol=udp")
+	a.NoError(err)
+	a.Equal(metrics.MetricsConfig{Scheme: "graphite", Namespace: "my_namespace", Host: "carbon:2003", Tagged: true, Protocol: "udp"}, config)
+
+	config, err = metrics.ParseMetricsDSN("otlp://collector:4318?namespace=my_namespace&service=my_service&tls=1")
+	a.NoError(err)
+	a.Equal(metrics.MetricsConfig{Scheme: "otlp", Namespace: "my_namespace", GoStats: true, Host: "collector:4318", TLS: true, Service: "my_service"}, config)
+
+	config, err = metrics.ParseMetricsDSN("stdout://?format=graphite&tagged=true&flush=1s&tags=env:prod,region:eu" +
+		"&gostats_interval=30s&sample_rate=0.25&max_packet=512&queue_size=128")
+	a.NoError(err)
+	a.Equal(metrics.MetricsConfig{
+		Scheme:          "stdout",
+		GoStats:         true,
+		Tagged:          true,
+		Flush:           time.Second,
+		Tags:            metrics.Tags{metrics.NewTag("env", "prod"), metrics.NewTag("region", "eu")},
+		GoStatsInterval: 30 * time.Second,
+		SampleRate:      0.25,
+		MaxPacketSize:   512,
+		QueueSize:       128,
+		Format:          "graphite",
+	}, config)
+
+	for dsn, reason := range map[string]string{
+		"random://":  "invalid metrics publisher type `random`",
+		"datadog://": "datadog metrics need a namespace",
+		"otlp://?namespace=my_namespace&tls=maybe":       "invalid `tls` parameter `maybe`, it must be a boolean",
+		"influx://?namespace=my_namespace&protocol=sctp": "invalid metrics protocol `sctp`, it must be tcp or udp",
+		"stdout://?format=xml":                           "invalid metrics format `xml`, it must be text, statsd, graphite or influx",
+		"stdout://?flush=10":                             "invalid `flush` parameter `10`, it must be a positive duration like 10s",
+		"stdout://?gostats_interval=-1s":                 "invalid `gostats_interval` parameter `-1s`, it must be a positive duration like 10s",
+		"stdout://?max_packet=big":                       "invalid `max_packet` parameter `big`, it must be a positive integer",
+		"stdout://?queue_size=0":                         "invalid `queue_size` parameter `0`, it must be a positive integer",
+		"stdout://?sample_rate=2":                        "invalid `sample_rate` parameter `2`, it must be a number greater than 0 and up to 1",
+		"stdout://?tags=env:prod,region":                 "invalid tag `region` in the `tags` parameter, tags must be key:value pairs separated by commas",
+	} {
+		_, err := metrics.ParseMetricsDSN(dsn)
+
+		var dsnErr *metrics.InvalidDSNError
+		if a.True(errors.As(err, &dsnErr), dsn) {
+			a.Equal(dsn, dsnErr.DSN)
+			a.EqualError(dsnErr.Err, reason)
+		}
+	}
+
+	_, err = metrics.ParseMetricsDSN("http://%41:8080/")
+	a.Error(err)
+}
+
+func TestNewMetricsRunner(t *testing.T) {
+	a := assert.New(t)
+
+	m, r, err := metrics.NewMetricsRunner(metrics.MetricsConfig{Scheme: "discard"})
+	a.NoError(err)
+	a.NotNil(m)
+	a.NotNil(r)
+
+	_, _, err = metrics.NewMetricsRunner(metrics.MetricsConfig{Scheme: "datadog"})
+	a.EqualError(err, "metrics: invalid config: datadog metrics need a namespace")
+
+	_, _, err = metrics.NewMetricsRunner(metrics.MetricsConfig{Scheme: "discard", QueueSize: -1})
+	a.EqualError(err, "metrics: invalid config: invalid metrics queue size -1, it must be positive")
+
+	_, _, err = metrics.NewMetricsRunner(metrics.MetricsConfig{Scheme: "datadog", Namespace: "my_namespace", Host: "does.not.exist.invalid"})
+	if a.Error(err) {
+		a.Contains(err.Error(), "metrics: cannot resolve UDP addr `does.not.exist.invalid:8125`")
+	}
+}
+
+func TestNewMetricsRunnerTags(t *testing.T) {
+	a := assert.New(t)
+
+	m, _, err := metrics.NewMetricsRunner(metrics.MetricsConfig{
+		Scheme:    "discard",
+		Namespace: "my_namespace",
+		Tags:      metrics.Tags{metrics.NewTag("env", "prod")},
+	})
+	a.NoError(err)
+
+	counter := m.Counter("requests", metrics.NewTag("code", 200))
+	a.Equal("my_namespace.requests", counter.Name())
+	a.ElementsMatch(metrics.Tags{metrics.NewTag("env", "prod"), metrics.NewTag("code", 200)}, counter.Tags())
+}
+
+func TestNewMetricsRunnerFromDSNTagsAreNotShared(t *testing.T) {
+	a := assert.New(t)
+
+	m, _ := metrics.NewMetricsRunnerFromDSN("discard://?tags=a:1,b:2,c:3")
+
+	x := m.Timer("x").WithTag("route", "one")
+	y := m.Timer("y").WithTag("route", "two")
+
+	a.Contains(x.Tags(), metrics.NewTag("route", "one"))
+	a.NotContains(x.Tags(), metrics.NewTag("route", "two"))
+	a.Contains(y.Tags(), metrics.NewTag("route", "two"))
+}
@@ -2,68 +2,291 @@ package metrics
 
 import (
 	"context"
+	"math"
 	"runtime"
+	rtmetrics "runtime/metrics"
 	"time"
 
 	"github.com/socialpoint-labs/bsk/contextx"
 )
 
-// use packages var to avoid allocating every tick
-var memStats runtime.MemStats
+// GoStatsGroup is a set of related go VM stats. Groups can be combined with the | operator.
+type GoStatsGroup uint
+
+// Available go VM stats groups
+const (
+	// GoStatsMemory publishes the go.mem.* heap and stack stats
+	GoStatsMemory GoStatsGroup = 1 << iota
+	// GoStatsGC publishes the go.gc.* cycles and pause distribution stats
+	GoStatsGC
+	// GoStatsScheduler publishes the number of goroutines and the go.sched.* latency distribution stats
+	GoStatsScheduler
+	// GoStatsRuntime publishes the number of CPUs, GOMAXPROCS, cgo calls and open file descriptors
+	GoStatsRuntime
+
+	// GoStatsAll publishes all the go VM stats
+	GoStatsAll = GoStatsMemory | GoStatsGC | GoStatsScheduler | GoStatsRuntime
+)
+
+// names of the runtime/metrics samples read every tick
+const (
+	heapObjectsBytes  = "/memory/classes/heap/objects:bytes"
+	heapUnusedBytes   = "/memory/classes/heap/unused:bytes"
+	heapFreeBytes     = "/memory/classes/heap/free:bytes"
+	heapReleasedBytes = "/memory/classes/heap/released:bytes"
+	heapStacksBytes   = "/memory/classes/heap/stacks:bytes"
+	heapObjects       = "/gc/heap/objects:objects"
+	gcCycles          = "/gc/cycles/total:gc-cycles"
+	gcPauses          = "/gc/pauses:seconds"
+	schedGoroutines   = "/sched/goroutines:goroutines"
+	schedLatencies    = "/sched/latencies:seconds"
+)
 
 // A GoStatsRunner is a contextx.Runner that captures go VM stats and
 // publishes them to the Metrics dependency every tick.
 type GoStatsRunner struct {
 	metrics Metrics
 	tick    time.Duration
+	groups  GoStatsGroup
 	tags    Tags
 }
 
-// NewGoStatsRunner returns a new Runner with the provided metrics and tick.
+// NewGoStatsRunner returns a new Runner with the provided metrics and tick
+// that publishes all the go VM stats.
 func NewGoStatsRunner(metrics Metrics, tick time.Duration, t ...Tag) contextx.Runner {
+	return NewGoStatsRunnerWithGroups(metrics, tick, GoStatsAll, t...)
+}
+
+// NewGoStatsRunnerWithGroups returns a new Runner with the provided metrics and tick
+// that publishes only the given groups of go VM stats.
+func NewGoStatsRunnerWithGroups(metrics Metrics, tick time.Duration, groups GoStatsGroup, t ...Tag) contextx.Runner {
 	return &GoStatsRunner{
 		metrics: metrics,
 		tick:    tick,
+		groups:  groups,
 		tags:    append(t, Tag{Key: "vm", Value: "go"}),
 	}
 }
 
+// goMetrics holds the gauges of the enabled groups, the rest are nil.
 type goMetrics struct {
 	// memory
-	memAlloc Gauge
-	// others
-	numGoroutines Gauge
+	memAlloc     Gauge
+	heapObjects  Gauge
+	heapInUse    Gauge
+	heapIdle     Gauge
+	heapReleased Gauge
+	stackInUse   Gauge
+	// gc
+	gcCycles   Gauge
+	gcPauseP50 Gauge
+	gcPauseP99 Gauge
+	gcPauseMax Gauge
+	// scheduler
+	numGoroutines   Gauge
+	schedLatencyP50 Gauge
+	schedLatencyP99 Gauge
+	schedLatencyMax Gauge
+	// runtime
+	numCPU     Gauge
+	gomaxprocs Gauge
+	cgoCalls   Gauge
+	fds        Gauge
+}
+
+// goStats holds the state needed to collect the go VM stats between ticks
+type goStats struct {
+	samples []rtmetrics.Sample
+	index   map[string]int
+	// the distributions are published per tick, so the counts of the previous read are kept
+	gcPauses       []uint64
+	schedLatencies []uint64
 }
 
 // Run captures new values from the Go VM and publishes them to the metrics.
-// Be careful (but much less so) with this because debug.ReadGCStats calls
-// the C function runtime·lock(runtime·mheap) which, while not a stop-the-world
-// operation, isn't something you want to be doing all the time.
+// The stats are read with the runtime/metrics package, which doesn't stop
+// the world, so it is cheaper than runtime.ReadMemStats.
 func (r *GoStatsRunner) Run(ctx context.Context) {
-	goMetrics := &goMetrics{
-		// memory stats
-		memAlloc: r.metrics.Gauge("go.mem.allocated_bytes", r.tags...),
-		// others
-		numGoroutines: r.metrics.Gauge("go.goroutines", r.tags...),
-	}
+	goMetrics := r.goMetrics()
+	stats := newGoStats()
 
 	ticker := time.NewTicker(r.tick)
 	defer ticker.Stop()
 	for {
 		select {
 		case <-ticker.C:
-			collect(goMetrics)
+			collect(goMetrics, stats)
 		case <-ctx.Done():
 			return
 		}
 	}
 }
 
-func collect(metrics *goMetrics) {
+func (r *GoStatsRunner) goMetrics() *goMetrics {
+	m := &goMetrics{}
+	gauge := func(name string) Gauge {
+		return r.metrics.Gauge(name, r.tags...)
+	}
+
+	if r.groups&GoStatsMemory != 0 {
+		m.memAlloc = gauge("go.mem.allocated_bytes")
+		m.heapObjects = gauge("go.mem.heap.objects")
+		m.heapInUse = gauge("go.mem.heap.inuse_bytes")
+		m.heapIdle = gauge("go.mem.heap.idle_bytes")
+		m.heapReleased = gauge("go.mem.heap.released_bytes")
+		m.stackInUse = gauge("go.mem.stack.inuse_bytes")
+	}
+
+	if r.groups&GoStatsGC != 0 {
+		m.gcCycles = gauge("go.gc.cycles")
+		m.gcPauseP50 = gauge("go.gc.pause.p50")
+		m.gcPauseP99 = gauge("go.gc.pause.p99")
+		m.gcPauseMax = gauge("go.gc.pause.max")
+	}
+
+	if r.groups&GoStatsScheduler != 0 {
+		m.numGoroutines = gauge("go.goroutines")
+		m.schedLatencyP50 = gauge("go.sched.latency.p50")
+		m.schedLatencyP99 = gauge("go.sched.latency.p99")
+		m.schedLatencyMax = gauge("go.sched.latency.max")
+	}
+
+	if r.groups&GoStatsRuntime != 0 {
+		m.numCPU = gauge("go.cpu.count")
+		m.gomaxprocs = gauge("go.gomaxprocs")
+		m.cgoCalls = gauge("go.cgo.calls")
+		m.fds = gauge("go.fds")
+	}
+
+	return m
+}
+
+func newGoStats() *goStats {
+	names := []string{
+		heapObjectsBytes, heapUnusedBytes, heapFreeBytes, heapReleasedBytes, heapStacksBytes,
+		heapObjects, gcCycles, gcPauses, schedGoroutines, schedLatencies,
+	}
+
+	s := &goStats{
+		samples: make([]rtmetrics.Sample, len(names)),
+		index:   make(map[string]int, len(names)),
+	}
+	for i, name := range names {
+		s.samples[i].Name = name
+		s.index[name] = i
+	}
+
+	return s
+}
+
+func (s *goStats) uint64(name string) uint64 {
+	v := s.samples[s.index[name]].Value
+	if v.Kind() != rtmetrics.KindUint64 {
+		return 0
+	}
+	return v.Uint64()
+}
+
+func (s *goStats) histogram(name string) *rtmetrics.Float64Histogram {
+	v := s.samples[s.index[name]].Value
+	if v.Kind() != rtmetrics.KindFloat64Histogram {
+		return &rtmetrics.Float64Histogram{}
+	}
+	return v.Float64Histogram()
+}
+
+func collect(m *goMetrics, s *goStats) {
+	rtmetrics.Read(s.samples)
+
 	// memory metrics
-	runtime.ReadMemStats(&memStats) // This takes 50-200us.
-	metrics.memAlloc.Update(memStats.Alloc)
+	if m.memAlloc != nil {
+		m.memAlloc.Update(s.uint64(heapObjectsBytes))
+		m.heapObjects.Update(s.uint64(heapObjects))
+		m.heapInUse.Update(s.uint64(heapObjectsBytes) + s.uint64(heapUnusedBytes))
+		m.heapIdle.Update(s.uint64(heapFreeBytes) + s.uint64(heapReleasedBytes))
+		m.heapReleased.Update(s.uint64(heapReleasedBytes))
+		m.stackInUse.Update(s.uint64(heapStacksBytes))
+	}
+
+	// gc metrics
+	if m.gcCycles != nil {
+		m.gcCycles.Update(s.uint64(gcCycles))
+
+		var h histogramDelta
+		h, s.gcPauses = newHistogramDelta(s.histogram(gcPauses), s.gcPauses)
+		m.gcPauseP50.Update(h.quantile(0.5))
+		m.gcPauseP99.Update(h.quantile(0.99))
+		m.gcPauseMax.Update(h.quantile(1))
+	}
+
+	// scheduler metrics
+	if m.numGoroutines != nil {
+		m.numGoroutines.Update(s.uint64(schedGoroutines))
+
+		var h histogramDelta
+		h, s.schedLatencies = newHistogramDelta(s.histogram(schedLatencies), s.schedLatencies)
+		m.schedLatencyP50.Update(h.quantile(0.5))
+		m.schedLatencyP99.Update(h.quantile(0.99))
+		m.schedLatencyMax.Update(h.quantile(1))
+	}
+
+	// runtime metrics
+	if m.numCPU != nil {
+		m.numCPU.Update(runtime.NumCPU())
+		m.gomaxprocs.Update(runtime.GOMAXPROCS(0))
+		m.cgoCalls.Update(runtime.NumCgoCall())
+		if fds, err := countFDs(procfs + "/self/fd"); err == nil {
+			m.fds.Update(fds)
+		}
+	}
+}
+
+// histogramDelta is the distribution of the observations of a runtime/metrics
+// histogram since the previous read.
+type histogramDelta struct {
+	counts  []uint64
+	buckets []float64
+	total   uint64
+}
+
+// newHistogramDelta returns the delta between the histogram and the previous
+// counts, and the counts to use as previous in the next read.
+func newHistogramDelta(h *rtmetrics.Float64Histogram, prev []uint64) (histogramDelta, []uint64) {
+	d := histogramDelta{counts: make([]uint64, len(h.Counts)), buckets: h.Buckets}
+	for i, c := range h.Counts {
+		if i < len(prev) {
+			c -= prev[i]
+		}
+		d.counts[i] = c
+		d.total += c
+	}
+
+	return d, append(prev[:0], h.Counts...)
+}
+
+// quantile returns an approximation of the q-quantile of the observations,
+// the upper bound of the bucket where it falls, or zero if there are no observations.
+func (d histogramDelta) quantile(q float64) float64 {
+	if d.total == 0 {
+		return 0
+	}
+
+	rank := uint64(math.Ceil(q * float64(d.total)))
+	if rank == 0 {
+		rank = 1
+	}
+
+	var acc uint64
+	for i, c := range d.counts {
+		acc += c
+		if acc >= rank {
+			// use the lower bound of the bucket if the upper one is unbounded
+			if upper := d.buckets[i+1]; !math.IsInf(upper, 1) {
+				return upper
+			}
+			return d.buckets[i]
+		}
+	}
 
-	// others
-	metrics.numGoroutines.Update(runtime.NumGoroutine())
+	return 0
 }
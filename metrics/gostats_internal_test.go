@@ -1,4 +1,36 @@
 package metrics
 
+import (
+	"math"
+	"runtime/metrics"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
 // GoMetrics is a type name for metrics.goMetrics for testing.
 type GoMetrics goMetrics
+
+func TestHistogramDeltaQuantile(t *testing.T) {
+	a := assert.New(t)
+
+	h := &metrics.Float64Histogram{
+		Buckets: []float64{math.Inf(-1), 1, 2, 3, math.Inf(1)},
+		Counts:  []uint64{0, 5, 4, 1},
+	}
+
+	d, prev := newHistogramDelta(h, nil)
+	a.EqualValues(10, d.total)
+	a.Equal(2.0, d.quantile(0.5))
+	a.Equal(3.0, d.quantile(0.9))
+	a.Equal(3.0, d.quantile(1), "the lower bound is used for the unbounded bucket")
+
+	// only the observations since the previous read are taken into account
+	h.Counts = []uint64{0, 5, 4, 3}
+	d, _ = newHistogramDelta(h, prev)
+	a.EqualValues(2, d.total)
+	a.Equal(3.0, d.quantile(0.5))
+
+	d, _ = newHistogramDelta(h, []uint64{0, 5, 4, 3})
+	a.Equal(0.0, d.quantile(0.99), "no observations")
+}
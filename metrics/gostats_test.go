@@ -54,3 +54,34 @@ loop:
 		a.Contains(flushedMetric, "#test:life,vm:go")
 	}
 }
+
+func TestGoStatsWithGroups(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	a := assert.New(t)
+	rec := make(recorder, 1)
+
+	duration := time.Millisecond * 10
+	publisher := metrics.NewPublisher(rec, metrics.StatsDEncoder, duration*2, nil)
+	go publisher.Run(ctx)
+
+	runner := metrics.NewGoStatsRunnerWithGroups(publisher, duration, metrics.GoStatsGC)
+	go runner.Run(ctx)
+
+	var flushed string
+	select {
+	case flushed = <-rec:
+	case <-time.After(time.Second):
+		a.Fail("timeout reached and the publisher didn't flush out the metrics")
+		return
+	}
+
+	for _, name := range []string{"go.gc.cycles:", "go.gc.pause.p50:", "go.gc.pause.p99:", "go.gc.pause.max:"} {
+		a.Contains(flushed, name)
+	}
+	a.NotContains(flushed, "go.goroutines")
+	a.NotContains(flushed, "go.mem.")
+}
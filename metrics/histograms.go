@@ -0,0 +1,95 @@
+package metrics
+
+import (
+	"math"
+	"sync"
+)
+
+// the suffixes of the gauges that summarize an aggregated histogram or timer, in the order they are published
+var histogramSummarySuffixes = []string{".count", ".min", ".max", ".mean", ".p50", ".p90", ".p99"}
+
+// histogramAggregator collects the samples of the histograms and timers per series in
+// sketches during a flush interval, so the publisher emits a summary of every series,
+// see WithHistogramAggregation, instead of every sample.
+type histogramAggregator struct {
+	series map[string]*histogramSeries
+	keys   []string   // keeps the insertion order of the series
+	mu     sync.Mutex // protects the whole struct
+}
+
+type histogramSeries struct {
+	name   string
+	tags   Tags
+	rate   float64
+	sketch *sketch
+}
+
+func newHistogramAggregator() *histogramAggregator {
+	return &histogramAggregator{series: make(map[string]*histogramSeries)}
+}
+
+// aggregate stores the sample of a histogram or a timer and returns whether it was
+// aggregated. Observations that cannot be aggregated must be published as they come.
+//
+// The series key is taken from the rendered tags when they are cached.
+func (a *histogramAggregator) aggregate(op Op, name string, value interface{}, tags Tags, rate float64, rendered *renderedTags) bool {
+	if op != OpHistogramUpdate && op != OpTimerStop {
+		return false
+	}
+
+	v, err := valueAsFloat64(value)
+	if err != nil {
+		return false
+	}
+
+	key := rendered.seriesKey(op, name, tags, rate)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	s, ok := a.series[key]
+	if !ok {
+		s = &histogramSeries{name: name, tags: append(Tags(nil), tags...), rate: rate, sketch: newSketch()}
+		a.series[key] = s
+		a.keys = append(a.keys, key)
+	}
+	s.sketch.add(v)
+
+	return true
+}
+
+// drain returns the gauges that summarize the aggregated series, in insertion order, and
+// resets the aggregator. The count of the sampled series is scaled by their sample rate,
+// since the gauges themselves are not sampled.
+func (a *histogramAggregator) drain() []*series {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if len(a.keys) == 0 {
+		return nil
+	}
+
+	out := make([]*series, 0, len(a.keys)*len(histogramSummarySuffixes))
+	for _, key := range a.keys {
+		s := a.series[key]
+		quantiles := s.sketch.quantiles(0.5, 0.9, 0.99)
+		values := []interface{}{
+			uint64(math.Round(float64(s.sketch.count) / s.rate)),
+			s.sketch.min,
+			s.sketch.max,
+			s.sketch.mean(),
+			quantiles[0],
+			quantiles[1],
+			quantiles[2],
+		}
+
+		for i, suffix := range histogramSummarySuffixes {
+			out = append(out, &series{op: OpGaugeUpdate, name: s.name + suffix, tags: s.tags, rate: 1, value: values[i]})
+		}
+	}
+
+	a.series = make(map[string]*histogramSeries, len(a.keys))
+	a.keys = a.keys[:0]
+
+	return out
+}
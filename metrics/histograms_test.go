@@ -0,0 +1,72 @@
+package metrics_test
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/socialpoint-labs/bsk/metrics"
+)
+
+func TestPublisherWithHistogramAggregation(t *testing.T) {
+	a := assert.New(t)
+	rec := make(recorder)
+
+	publisher := metrics.NewPublisher(rec, metrics.StatsDEncoder, time.Hour, nil, metrics.WithHistogramAggregation())
+	go publisher.Run(context.Background())
+	waitRunning(t, publisher)
+
+	histogram := publisher.Histogram("size", metrics.NewTag("cached", true))
+	for v := uint64(1); v <= 100; v++ {
+		histogram.AddValue(v)
+	}
+
+	timer := publisher.Timer("latency")
+	timer.Record(10 * time.Millisecond)
+	timer.Record(10 * time.Millisecond)
+
+	// distributions are aggregated by the backend
+	publisher.Distribution("rtt").AddValue(1.5)
+
+	a.NoError(publisher.Flush(context.Background()))
+
+	lines := strings.Split(strings.TrimSuffix(<-rec, "\n"), "\n")
+	a.Len(lines, 15)
+	a.Equal("rtt:1.5|d|@1.0000", lines[0])
+
+	a.Equal("size.count:100|g|@1.0000|#cached:true", lines[1])
+	a.Equal("size.min:1|g|@1.0000|#cached:true", lines[2])
+	a.Equal("size.max:100|g|@1.0000|#cached:true", lines[3])
+	a.Equal("size.mean:50.5|g|@1.0000|#cached:true", lines[4])
+
+	// the percentiles are estimated
+	for i, percentile := range []struct {
+		name     string
+		expected float64
+	}{{"p50", 50}, {"p90", 90}, {"p99", 99}} {
+		line := lines[5+i]
+		value, err := strconv.ParseFloat(strings.TrimSuffix(strings.TrimPrefix(line, "size."+percentile.name+":"), "|g|@1.0000|#cached:true"), 64)
+		a.NoError(err, line)
+		a.InEpsilon(percentile.expected, value, 0.01, line)
+	}
+
+	a.Equal([]string{
+		"latency.count:2|g|@1.0000",
+		"latency.min:10|g|@1.0000",
+		"latency.max:10|g|@1.0000",
+		"latency.mean:10|g|@1.0000",
+		"latency.p50:10|g|@1.0000",
+		"latency.p90:10|g|@1.0000",
+		"latency.p99:10|g|@1.0000",
+	}, lines[8:])
+
+	// aggregated series are reset after every flush
+	histogram.AddValue(7)
+	a.NoError(publisher.Flush(context.Background()))
+
+	a.Contains(<-rec, "size.count:1|g|@1.0000|#cached:true\n")
+}
@@ -23,13 +23,16 @@ const (
 	OpHistogramUpdate
 	OpEventSend
 	OpTimerStop
+	OpDistributionUpdate
+	OpSetAdd
+	OpServiceCheckSend
 )
 
 func (op Op) String() string {
-	name := []string{"counter add", "gauge update", "histogram update", "event send", "timer stop"}
+	name := []string{"counter add", "gauge update", "histogram update", "event send", "timer stop", "distribution update", "set add", "service check send"}
 	i := uint8(op)
 	switch {
-	case i <= uint8(OpTimerStop):
+	case i <= uint8(OpServiceCheckSend):
 		return name[i]
 	default:
 		return strconv.Itoa(int(i))
@@ -51,8 +54,9 @@ func NewTag(key string, value interface{}) Tag {
 // Tags is a slice of tags
 type Tags []Tag
 
-// NotifyFunc is the interface for a function that allows to notify metrics changes
-type NotifyFunc func(Op, string, interface{}, Tags)
+// NotifyFunc is the interface for a function that allows to notify metrics changes.
+// The last argument is the sample rate declared for the metric.
+type NotifyFunc func(Op, string, interface{}, Tags, float64)
 
 // ErrorHandler is the interface for a function that can be used to handle errors occurring in
 // go-routines running in background and out of the control of the user
@@ -77,9 +81,22 @@ type Metrics interface {
 
 	// Provide a histogram with the given name and tags
 	Histogram(name string, tags ...Tag) Histogram
+
+	// Provide a distribution with the given name and tags
+	Distribution(name string, tags ...Tag) Distribution
+
+	// Provide a set with the given name and tags
+	Set(name string, tags ...Tag) Set
+
+	// Provide a service check with the given name and tags
+	ServiceCheck(name string, tags ...Tag) ServiceCheck
 }
 
 // Metric is the interface for the common methods that all the metrics have.
+//
+// Counters, gauges, timers, histograms and distributions can declare a sample rate with WithSampleRate,
+// the fraction in the (0, 1] interval of the observations that are actually published.
+// Rates out of this interval are considered 1. Implementations may ignore sample rates.
 type Metric interface {
 	Name() string
 	Tags() Tags
@@ -95,6 +112,7 @@ type Counter interface {
 	Add(delta uint64)
 	WithTags(tags ...Tag) Counter
 	WithTag(key string, value interface{}) Counter
+	WithSampleRate(rate float64) Counter
 }
 
 // Gauge captures instantaneous measurements of a value.
@@ -103,6 +121,7 @@ type Gauge interface {
 	Update(value interface{})
 	WithTags(tags ...Tag) Gauge
 	WithTag(key string, value interface{}) Gauge
+	WithSampleRate(rate float64) Gauge
 }
 
 // Event sends a single event
@@ -112,6 +131,82 @@ type Event interface {
 	SendWithText(text string)
 	WithTags(tags ...Tag) Event
 	WithTag(key string, value interface{}) Event
+	WithOptions(opts ...EventOption) Event
+}
+
+// EventPriority is the priority of an event
+type EventPriority string
+
+// Available event priorities
+const (
+	EventPriorityNormal EventPriority = "normal"
+	EventPriorityLow    EventPriority = "low"
+)
+
+// EventAlertType is the alert type of an event
+type EventAlertType string
+
+// Available event alert types
+const (
+	EventAlertError   EventAlertType = "error"
+	EventAlertWarning EventAlertType = "warning"
+	EventAlertInfo    EventAlertType = "info"
+	EventAlertSuccess EventAlertType = "success"
+)
+
+// EventValue is the value notified, and passed to the encoders, when an event
+// is sent. All the fields but the text are optional.
+type EventValue struct {
+	Text           string
+	Priority       EventPriority
+	AlertType      EventAlertType
+	AggregationKey string
+	SourceType     string
+	Date           time.Time
+}
+
+// String returns the text of the event, so encoders that format the value
+// with the %v verb keep writing just the text.
+func (v EventValue) String() string {
+	return v.Text
+}
+
+// An EventOption is a functional option to set the attributes of an Event
+type EventOption func(*EventValue)
+
+// WithEventPriority returns an option that sets the priority of the event
+func WithEventPriority(p EventPriority) EventOption {
+	return func(v *EventValue) {
+		v.Priority = p
+	}
+}
+
+// WithEventAlertType returns an option that sets the alert type of the event
+func WithEventAlertType(t EventAlertType) EventOption {
+	return func(v *EventValue) {
+		v.AlertType = t
+	}
+}
+
+// WithEventAggregationKey returns an option that sets the key used to group the event with others
+func WithEventAggregationKey(key string) EventOption {
+	return func(v *EventValue) {
+		v.AggregationKey = key
+	}
+}
+
+// WithEventSourceType returns an option that sets the source type of the event
+func WithEventSourceType(sourceType string) EventOption {
+	return func(v *EventValue) {
+		v.SourceType = sourceType
+	}
+}
+
+// WithEventDate returns an option that sets the date of the event
+func WithEventDate(t time.Time) EventOption {
+	return func(v *EventValue) {
+		v.Date = t
+	}
 }
 
 // Timer times a duration
@@ -119,8 +214,35 @@ type Timer interface {
 	Metric
 	Start()
 	Stop()
+	// Record publishes a duration measured elsewhere
+	Record(d time.Duration)
+	// Time publishes the duration of the execution of the function
+	Time(f func())
+	// StartStopwatch returns a started Stopwatch that doesn't share its state with the
+	// timer, so it can be used by several goroutines at the same time
+	StartStopwatch() *Stopwatch
 	WithTags(tags ...Tag) Timer
 	WithTag(key string, value interface{}) Timer
+	WithSampleRate(rate float64) Timer
+}
+
+// Stopwatch measures the duration of a single operation and records it in a Timer when stopped
+type Stopwatch struct {
+	timer   Timer
+	started time.Time
+}
+
+// NewStopwatch returns a Stopwatch started now that records its duration in the given Timer.
+// It is useful to implement Timer.StartStopwatch.
+func NewStopwatch(timer Timer) *Stopwatch {
+	return &Stopwatch{timer: timer, started: time.Now()}
+}
+
+// Stop records the duration since the stopwatch was started in its Timer, and returns it
+func (s *Stopwatch) Stop() time.Duration {
+	d := time.Since(s.started)
+	s.timer.Record(d)
+	return d
 }
 
 // Histogram hold series of unsigned 64-bit integer values that enable obtaining
@@ -130,6 +252,72 @@ type Histogram interface {
 	AddValue(value uint64)
 	WithTags(tags ...Tag) Histogram
 	WithTag(key string, value interface{}) Histogram
+	WithSampleRate(rate float64) Histogram
+}
+
+// Distribution holds series of values whose statistical distribution is
+// computed by the backend globally, across all the sources that report it,
+// instead of per source like histograms.
+type Distribution interface {
+	Metric
+	AddValue(value float64)
+	WithTags(tags ...Tag) Distribution
+	WithTag(key string, value interface{}) Distribution
+	WithSampleRate(rate float64) Distribution
+}
+
+// Set counts the number of unique values observed, e.g. unique users.
+type Set interface {
+	Metric
+	Add(value interface{})
+	WithTags(tags ...Tag) Set
+	WithTag(key string, value interface{}) Set
+}
+
+// ServiceCheck reports the status of a service, e.g. whether a daemon can
+// reach its dependencies. The hostname and timestamp are optional.
+type ServiceCheck interface {
+	Metric
+	Send(status ServiceCheckStatus)
+	SendWithMessage(status ServiceCheckStatus, message string)
+	WithHostname(hostname string) ServiceCheck
+	WithTimestamp(t time.Time) ServiceCheck
+	WithTags(tags ...Tag) ServiceCheck
+	WithTag(key string, value interface{}) ServiceCheck
+}
+
+// ServiceCheckStatus is the status reported by a service check
+type ServiceCheckStatus uint8
+
+// Available service check statuses
+const (
+	ServiceCheckOK ServiceCheckStatus = iota
+	ServiceCheckWarning
+	ServiceCheckCritical
+	ServiceCheckUnknown
+)
+
+func (s ServiceCheckStatus) String() string {
+	switch s {
+	case ServiceCheckOK:
+		return "ok"
+	case ServiceCheckWarning:
+		return "warning"
+	case ServiceCheckCritical:
+		return "critical"
+	case ServiceCheckUnknown:
+		return "unknown"
+	default:
+		return strconv.Itoa(int(s))
+	}
+}
+
+// ServiceCheckValue is the value notified, and passed to the encoders, when a service check is sent
+type ServiceCheckValue struct {
+	Status    ServiceCheckStatus
+	Hostname  string
+	Timestamp time.Time
+	Message   string
 }
 
 // WithNamespace composes Metrics so when creating types of metrics will
@@ -0,0 +1,92 @@
+// Package metricstest provides testify-style assertions on the metrics written
+// to a metrics.Recorder.
+package metricstest
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/socialpoint-labs/bsk/metrics"
+)
+
+type tHelper interface {
+	Helper()
+}
+
+// AssertCounter asserts that the counter with the given name and tags has been
+// recorded with the expected value.
+func AssertCounter(t assert.TestingT, r *metrics.Recorder, name string, expected uint64, tags ...metrics.Tag) bool {
+	if h, ok := t.(tHelper); ok {
+		h.Helper()
+	}
+
+	m := r.Find(name, tags...)
+	c, ok := m.(*metrics.RecorderCounter)
+	if !ok {
+		return notRecorded(t, "counter", m, name, tags)
+	}
+
+	return assert.Equal(t, expected, c.Value(), "counter %s", describe(name, tags))
+}
+
+// AssertGaugeValue asserts that the gauge with the given name and tags has been
+// recorded with the expected value. Values of different numeric types are
+// compared after converting them.
+func AssertGaugeValue(t assert.TestingT, r *metrics.Recorder, name string, expected interface{}, tags ...metrics.Tag) bool {
+	if h, ok := t.(tHelper); ok {
+		h.Helper()
+	}
+
+	m := r.Find(name, tags...)
+	g, ok := m.(*metrics.RecorderGauge)
+	if !ok {
+		return notRecorded(t, "gauge", m, name, tags)
+	}
+
+	return assert.EqualValues(t, expected, g.Value(), "gauge %s", describe(name, tags))
+}
+
+// AssertHistogramContains asserts that the histogram with the given name and tags
+// has recorded the given value.
+func AssertHistogramContains(t assert.TestingT, r *metrics.Recorder, name string, value uint64, tags ...metrics.Tag) bool {
+	if h, ok := t.(tHelper); ok {
+		h.Helper()
+	}
+
+	m := r.Find(name, tags...)
+	hist, ok := m.(*metrics.RecorderHistogram)
+	if !ok {
+		return notRecorded(t, "histogram", m, name, tags)
+	}
+
+	return assert.Contains(t, hist.Values(), value, "histogram %s", describe(name, tags))
+}
+
+// notRecorded fails the test because the metric found in the recorder, if any,
+// is not of the expected kind
+func notRecorded(t assert.TestingT, kind string, m metrics.Metric, name string, tags metrics.Tags) bool {
+	if h, ok := t.(tHelper); ok {
+		h.Helper()
+	}
+
+	if m == nil {
+		return assert.Fail(t, fmt.Sprintf("no %s %s has been recorded", kind, describe(name, tags)))
+	}
+
+	return assert.Fail(t, fmt.Sprintf("the metric %s is a %T, not a %s", describe(name, tags), m, kind))
+}
+
+func describe(name string, tags metrics.Tags) string {
+	if len(tags) == 0 {
+		return fmt.Sprintf("`%s`", name)
+	}
+
+	pairs := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		pairs = append(pairs, fmt.Sprintf("%s:%v", tag.Key, tag.Value))
+	}
+
+	return fmt.Sprintf("`%s` with tags %s", name, strings.Join(pairs, ","))
+}
@@ -0,0 +1,72 @@
+package metricstest_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/socialpoint-labs/bsk/metrics"
+	"github.com/socialpoint-labs/bsk/metrics/metricstest"
+)
+
+type mockT struct {
+	errors []string
+}
+
+func (t *mockT) Errorf(format string, args ...interface{}) {
+	t.errors = append(t.errors, fmt.Sprintf(format, args...))
+}
+
+func TestAssertCounter(t *testing.T) {
+	a := assert.New(t)
+
+	r := metrics.NewRecorder()
+	r.Counter("requests", metrics.NewTag("code", 200)).Add(3)
+	r.Counter("requests", metrics.NewTag("code", 500)).Inc()
+	r.Gauge("gauge").Update(1)
+
+	a.True(metricstest.AssertCounter(t, r, "requests", 3, metrics.NewTag("code", 200)))
+	a.True(metricstest.AssertCounter(t, r, "requests", 1, metrics.NewTag("code", 500)))
+
+	mt := &mockT{}
+	a.False(metricstest.AssertCounter(mt, r, "requests", 1, metrics.NewTag("code", 200)))
+	a.False(metricstest.AssertCounter(mt, r, "requests", 1, metrics.NewTag("code", 404)))
+	a.False(metricstest.AssertCounter(mt, r, "gauge", 1))
+	a.Len(mt.errors, 3)
+	a.Contains(mt.errors[1], "no counter `requests` with tags code:404 has been recorded")
+	a.Contains(mt.errors[2], "the metric `gauge` is a *metrics.RecorderGauge, not a counter")
+}
+
+func TestAssertGaugeValue(t *testing.T) {
+	a := assert.New(t)
+
+	r := metrics.NewRecorder()
+	r.Gauge("temperature", metrics.NewTag("room", "kitchen")).Update(21.5)
+	r.Gauge("connections").Update(uint64(10))
+
+	a.True(metricstest.AssertGaugeValue(t, r, "temperature", 21.5, metrics.NewTag("room", "kitchen")))
+	a.True(metricstest.AssertGaugeValue(t, r, "connections", 10))
+
+	mt := &mockT{}
+	a.False(metricstest.AssertGaugeValue(mt, r, "temperature", 21.5))
+	a.False(metricstest.AssertGaugeValue(mt, r, "connections", 11))
+	a.Len(mt.errors, 2)
+}
+
+func TestAssertHistogramContains(t *testing.T) {
+	a := assert.New(t)
+
+	r := metrics.NewRecorder()
+	h := r.Histogram("size", metrics.NewTag("type", "image"))
+	h.AddValue(100)
+	h.AddValue(200)
+
+	a.True(metricstest.AssertHistogramContains(t, r, "size", 100, metrics.NewTag("type", "image")))
+	a.True(metricstest.AssertHistogramContains(t, r, "size", 200, metrics.NewTag("type", "image")))
+
+	mt := &mockT{}
+	a.False(metricstest.AssertHistogramContains(mt, r, "size", 300, metrics.NewTag("type", "image")))
+	a.False(metricstest.AssertHistogramContains(mt, r, "size", 100))
+	a.Len(mt.errors, 2)
+}
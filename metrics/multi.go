@@ -0,0 +1,513 @@
+package metrics
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/socialpoint-labs/bsk/contextx"
+)
+
+// multiMetrics is a metrics publisher that fans out all the metrics to several publishers
+type multiMetrics []Metrics
+
+// MultiMetrics returns a new metrics publisher that forwards all the operations
+// to each one of the provided publishers, e.g. to publish to two backends while migrating.
+func MultiMetrics(ms ...Metrics) Metrics {
+	return multiMetrics(ms)
+}
+
+// MultiMetricsRunner returns a Runner that runs the provided publishers that are also
+// Runners, like a Publisher, and waits for all of them to finish once the context is done.
+// Publishers returned by MultiMetrics are unwrapped to run their own publishers.
+func MultiMetricsRunner(ms ...Metrics) contextx.Runner {
+	return contextx.RunnerFunc(func(ctx context.Context) {
+		wg := sync.WaitGroup{}
+		for _, r := range runners(ms) {
+			wg.Add(1)
+			go func(r contextx.Runner) {
+				defer wg.Done()
+				r.Run(ctx)
+			}(r)
+		}
+		wg.Wait()
+	})
+}
+
+func runners(ms []Metrics) []contextx.Runner {
+	var rs []contextx.Runner
+	for _, m := range ms {
+		switch m := m.(type) {
+		case multiMetrics:
+			rs = append(rs, runners(m)...)
+		case contextx.Runner:
+			rs = append(rs, m)
+		}
+	}
+
+	return rs
+}
+
+// Counter implements the Metrics behaviour to return a new Counter
+func (ms multiMetrics) Counter(name string, tags ...Tag) Counter {
+	c := &multiCounter{name: name, counters: make([]Counter, len(ms))}
+	for i, m := range ms {
+		c.counters[i] = m.Counter(name, tags...)
+	}
+	return c
+}
+
+// Gauge implements the Metrics behaviour to return a new Gauge
+func (ms multiMetrics) Gauge(name string, tags ...Tag) Gauge {
+	g := &multiGauge{name: name, gauges: make([]Gauge, len(ms))}
+	for i, m := range ms {
+		g.gauges[i] = m.Gauge(name, tags...)
+	}
+	return g
+}
+
+// Event implements the Metrics behaviour to return a new Event
+func (ms multiMetrics) Event(name string, tags ...Tag) Event {
+	e := &multiEvent{name: name, events: make([]Event, len(ms))}
+	for i, m := range ms {
+		e.events[i] = m.Event(name, tags...)
+	}
+	return e
+}
+
+// Timer implements the Metrics behaviour to return a new Timer
+func (ms multiMetrics) Timer(name string, tags ...Tag) Timer {
+	t := &multiTimer{name: name, timers: make([]Timer, len(ms))}
+	for i, m := range ms {
+		t.timers[i] = m.Timer(name, tags...)
+	}
+	return t
+}
+
+// Histogram implements the Metrics behaviour to return a new Histogram
+func (ms multiMetrics) Histogram(name string, tags ...Tag) Histogram {
+	h := &multiHistogram{name: name, histograms: make([]Histogram, len(ms))}
+	for i, m := range ms {
+		h.histograms[i] = m.Histogram(name, tags...)
+	}
+	return h
+}
+
+// Distribution implements the Metrics behaviour to return a new Distribution
+func (ms multiMetrics) Distribution(name string, tags ...Tag) Distribution {
+	d := &multiDistribution{name: name, distributions: make([]Distribution, len(ms))}
+	for i, m := range ms {
+		d.distributions[i] = m.Distribution(name, tags...)
+	}
+	return d
+}
+
+// Set implements the Metrics behaviour to return a new Set
+func (ms multiMetrics) Set(name string, tags ...Tag) Set {
+	s := &multiSet{name: name, sets: make([]Set, len(ms))}
+	for i, m := range ms {
+		s.sets[i] = m.Set(name, tags...)
+	}
+	return s
+}
+
+// ServiceCheck implements the Metrics behaviour to return a new ServiceCheck
+func (ms multiMetrics) ServiceCheck(name string, tags ...Tag) ServiceCheck {
+	sc := &multiServiceCheck{name: name, checks: make([]ServiceCheck, len(ms))}
+	for i, m := range ms {
+		sc.checks[i] = m.ServiceCheck(name, tags...)
+	}
+	return sc
+}
+
+// multiTags returns the tags of the first metric, all of them have the same ones
+func multiTags(first func() Tags, n int) Tags {
+	if n == 0 {
+		return nil
+	}
+	return first()
+}
+
+type multiCounter struct {
+	name     string
+	counters []Counter
+}
+
+func (c *multiCounter) Name() string {
+	return c.name
+}
+
+func (c *multiCounter) Tags() Tags {
+	return multiTags(func() Tags { return c.counters[0].Tags() }, len(c.counters))
+}
+
+func (c *multiCounter) Inc() {
+	for _, counter := range c.counters {
+		counter.Inc()
+	}
+}
+
+func (c *multiCounter) Add(delta uint64) {
+	for _, counter := range c.counters {
+		counter.Add(delta)
+	}
+}
+
+func (c *multiCounter) WithTags(tags ...Tag) Counter {
+	n := &multiCounter{name: c.name, counters: make([]Counter, len(c.counters))}
+	for i, counter := range c.counters {
+		n.counters[i] = counter.WithTags(tags...)
+	}
+	return n
+}
+
+func (c *multiCounter) WithTag(key string, value interface{}) Counter {
+	n := &multiCounter{name: c.name, counters: make([]Counter, len(c.counters))}
+	for i, counter := range c.counters {
+		n.counters[i] = counter.WithTag(key, value)
+	}
+	return n
+}
+
+func (c *multiCounter) WithSampleRate(rate float64) Counter {
+	n := &multiCounter{name: c.name, counters: make([]Counter, len(c.counters))}
+	for i, counter := range c.counters {
+		n.counters[i] = counter.WithSampleRate(rate)
+	}
+	return n
+}
+
+type multiGauge struct {
+	name   string
+	gauges []Gauge
+}
+
+func (g *multiGauge) Name() string {
+	return g.name
+}
+
+func (g *multiGauge) Tags() Tags {
+	return multiTags(func() Tags { return g.gauges[0].Tags() }, len(g.gauges))
+}
+
+func (g *multiGauge) Update(value interface{}) {
+	for _, gauge := range g.gauges {
+		gauge.Update(value)
+	}
+}
+
+func (g *multiGauge) WithTags(tags ...Tag) Gauge {
+	n := &multiGauge{name: g.name, gauges: make([]Gauge, len(g.gauges))}
+	for i, gauge := range g.gauges {
+		n.gauges[i] = gauge.WithTags(tags...)
+	}
+	return n
+}
+
+func (g *multiGauge) WithTag(key string, value interface{}) Gauge {
+	n := &multiGauge{name: g.name, gauges: make([]Gauge, len(g.gauges))}
+	for i, gauge := range g.gauges {
+		n.gauges[i] = gauge.WithTag(key, value)
+	}
+	return n
+}
+
+func (g *multiGauge) WithSampleRate(rate float64) Gauge {
+	n := &multiGauge{name: g.name, gauges: make([]Gauge, len(g.gauges))}
+	for i, gauge := range g.gauges {
+		n.gauges[i] = gauge.WithSampleRate(rate)
+	}
+	return n
+}
+
+type multiEvent struct {
+	name   string
+	events []Event
+}
+
+func (e *multiEvent) Name() string {
+	return e.name
+}
+
+func (e *multiEvent) Tags() Tags {
+	return multiTags(func() Tags { return e.events[0].Tags() }, len(e.events))
+}
+
+func (e *multiEvent) Send() {
+	for _, event := range e.events {
+		event.Send()
+	}
+}
+
+func (e *multiEvent) SendWithText(text string) {
+	for _, event := range e.events {
+		event.SendWithText(text)
+	}
+}
+
+func (e *multiEvent) WithTags(tags ...Tag) Event {
+	n := &multiEvent{name: e.name, events: make([]Event, len(e.events))}
+	for i, event := range e.events {
+		n.events[i] = event.WithTags(tags...)
+	}
+	return n
+}
+
+func (e *multiEvent) WithTag(key string, value interface{}) Event {
+	n := &multiEvent{name: e.name, events: make([]Event, len(e.events))}
+	for i, event := range e.events {
+		n.events[i] = event.WithTag(key, value)
+	}
+	return n
+}
+
+func (e *multiEvent) WithOptions(opts ...EventOption) Event {
+	n := &multiEvent{name: e.name, events: make([]Event, len(e.events))}
+	for i, event := range e.events {
+		n.events[i] = event.WithOptions(opts...)
+	}
+	return n
+}
+
+type multiTimer struct {
+	name   string
+	timers []Timer
+}
+
+func (t *multiTimer) Name() string {
+	return t.name
+}
+
+func (t *multiTimer) Tags() Tags {
+	return multiTags(func() Tags { return t.timers[0].Tags() }, len(t.timers))
+}
+
+func (t *multiTimer) Start() {
+	for _, timer := range t.timers {
+		timer.Start()
+	}
+}
+
+func (t *multiTimer) Stop() {
+	for _, timer := range t.timers {
+		timer.Stop()
+	}
+}
+
+func (t *multiTimer) Record(d time.Duration) {
+	for _, timer := range t.timers {
+		timer.Record(d)
+	}
+}
+
+func (t *multiTimer) Time(f func()) {
+	started := time.Now()
+	f()
+	t.Record(time.Since(started))
+}
+
+func (t *multiTimer) StartStopwatch() *Stopwatch {
+	return NewStopwatch(t)
+}
+
+func (t *multiTimer) WithTags(tags ...Tag) Timer {
+	n := &multiTimer{name: t.name, timers: make([]Timer, len(t.timers))}
+	for i, timer := range t.timers {
+		n.timers[i] = timer.WithTags(tags...)
+	}
+	return n
+}
+
+func (t *multiTimer) WithTag(key string, value interface{}) Timer {
+	n := &multiTimer{name: t.name, timers: make([]Timer, len(t.timers))}
+	for i, timer := range t.timers {
+		n.timers[i] = timer.WithTag(key, value)
+	}
+	return n
+}
+
+func (t *multiTimer) WithSampleRate(rate float64) Timer {
+	n := &multiTimer{name: t.name, timers: make([]Timer, len(t.timers))}
+	for i, timer := range t.timers {
+		n.timers[i] = timer.WithSampleRate(rate)
+	}
+	return n
+}
+
+type multiHistogram struct {
+	name       string
+	histograms []Histogram
+}
+
+func (h *multiHistogram) Name() string {
+	return h.name
+}
+
+func (h *multiHistogram) Tags() Tags {
+	return multiTags(func() Tags { return h.histograms[0].Tags() }, len(h.histograms))
+}
+
+func (h *multiHistogram) AddValue(value uint64) {
+	for _, histogram := range h.histograms {
+		histogram.AddValue(value)
+	}
+}
+
+func (h *multiHistogram) WithTags(tags ...Tag) Histogram {
+	n := &multiHistogram{name: h.name, histograms: make([]Histogram, len(h.histograms))}
+	for i, histogram := range h.histograms {
+		n.histograms[i] = histogram.WithTags(tags...)
+	}
+	return n
+}
+
+func (h *multiHistogram) WithTag(key string, value interface{}) Histogram {
+	n := &multiHistogram{name: h.name, histograms: make([]Histogram, len(h.histograms))}
+	for i, histogram := range h.histograms {
+		n.histograms[i] = histogram.WithTag(key, value)
+	}
+	return n
+}
+
+func (h *multiHistogram) WithSampleRate(rate float64) Histogram {
+	n := &multiHistogram{name: h.name, histograms: make([]Histogram, len(h.histograms))}
+	for i, histogram := range h.histograms {
+		n.histograms[i] = histogram.WithSampleRate(rate)
+	}
+	return n
+}
+
+type multiDistribution struct {
+	name          string
+	distributions []Distribution
+}
+
+func (d *multiDistribution) Name() string {
+	return d.name
+}
+
+func (d *multiDistribution) Tags() Tags {
+	return multiTags(func() Tags { return d.distributions[0].Tags() }, len(d.distributions))
+}
+
+func (d *multiDistribution) AddValue(value float64) {
+	for _, distribution := range d.distributions {
+		distribution.AddValue(value)
+	}
+}
+
+func (d *multiDistribution) WithTags(tags ...Tag) Distribution {
+	n := &multiDistribution{name: d.name, distributions: make([]Distribution, len(d.distributions))}
+	for i, distribution := range d.distributions {
+		n.distributions[i] = distribution.WithTags(tags...)
+	}
+	return n
+}
+
+func (d *multiDistribution) WithTag(key string, value interface{}) Distribution {
+	n := &multiDistribution{name: d.name, distributions: make([]Distribution, len(d.distributions))}
+	for i, distribution := range d.distributions {
+		n.distributions[i] = distribution.WithTag(key, value)
+	}
+	return n
+}
+
+func (d *multiDistribution) WithSampleRate(rate float64) Distribution {
+	n := &multiDistribution{name: d.name, distributions: make([]Distribution, len(d.distributions))}
+	for i, distribution := range d.distributions {
+		n.distributions[i] = distribution.WithSampleRate(rate)
+	}
+	return n
+}
+
+type multiSet struct {
+	name string
+	sets []Set
+}
+
+func (s *multiSet) Name() string {
+	return s.name
+}
+
+func (s *multiSet) Tags() Tags {
+	return multiTags(func() Tags { return s.sets[0].Tags() }, len(s.sets))
+}
+
+func (s *multiSet) Add(value interface{}) {
+	for _, set := range s.sets {
+		set.Add(value)
+	}
+}
+
+func (s *multiSet) WithTags(tags ...Tag) Set {
+	n := &multiSet{name: s.name, sets: make([]Set, len(s.sets))}
+	for i, set := range s.sets {
+		n.sets[i] = set.WithTags(tags...)
+	}
+	return n
+}
+
+func (s *multiSet) WithTag(key string, value interface{}) Set {
+	n := &multiSet{name: s.name, sets: make([]Set, len(s.sets))}
+	for i, set := range s.sets {
+		n.sets[i] = set.WithTag(key, value)
+	}
+	return n
+}
+
+type multiServiceCheck struct {
+	name   string
+	checks []ServiceCheck
+}
+
+func (sc *multiServiceCheck) Name() string {
+	return sc.name
+}
+
+func (sc *multiServiceCheck) Tags() Tags {
+	return multiTags(func() Tags { return sc.checks[0].Tags() }, len(sc.checks))
+}
+
+func (sc *multiServiceCheck) Send(status ServiceCheckStatus) {
+	for _, check := range sc.checks {
+		check.Send(status)
+	}
+}
+
+func (sc *multiServiceCheck) SendWithMessage(status ServiceCheckStatus, message string) {
+	for _, check := range sc.checks {
+		check.SendWithMessage(status, message)
+	}
+}
+
+func (sc *multiServiceCheck) WithHostname(hostname string) ServiceCheck {
+	n := &multiServiceCheck{name: sc.name, checks: make([]ServiceCheck, len(sc.checks))}
+	for i, check := range sc.checks {
+		n.checks[i] = check.WithHostname(hostname)
+	}
+	return n
+}
+
+func (sc *multiServiceCheck) WithTimestamp(t time.Time) ServiceCheck {
+	n := &multiServiceCheck{name: sc.name, checks: make([]ServiceCheck, len(sc.checks))}
+	for i, check := range sc.checks {
+		n.checks[i] = check.WithTimestamp(t)
+	}
+	return n
+}
+
+func (sc *multiServiceCheck) WithTags(tags ...Tag) ServiceCheck {
+	n := &multiServiceCheck{name: sc.name, checks: make([]ServiceCheck, len(sc.checks))}
+	for i, check := range sc.checks {
+		n.checks[i] = check.WithTags(tags...)
+	}
+	return n
+}
+
+func (sc *multiServiceCheck) WithTag(key string, value interface{}) ServiceCheck {
+	n := &multiServiceCheck{name: sc.name, checks: make([]ServiceCheck, len(sc.checks))}
+	for i, check := range sc.checks {
+		n.checks[i] = check.WithTag(key, value)
+	}
+	return n
+}
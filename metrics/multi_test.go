@@ -0,0 +1,87 @@
+package metrics_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/socialpoint-labs/bsk/metrics"
+)
+
+func TestMultiMetrics(t *testing.T) {
+	a := assert.New(t)
+
+	first := metrics.NewRecorder()
+	second := metrics.NewRecorder()
+	m := metrics.MultiMetrics(first, second)
+
+	m.Counter("counter", metrics.NewTag("foo", "bar")).WithTag("su", "pu").Add(2)
+	m.Gauge("gauge").Update(42)
+	m.Histogram("histogram").AddValue(7)
+	m.Distribution("distribution").AddValue(1.5)
+	m.Set("set").Add("user")
+	m.Event("event").SendWithText("hello")
+	m.ServiceCheck("check").SendWithMessage(metrics.ServiceCheckCritical, "down")
+
+	timer := m.Timer("timer")
+	timer.Start()
+	timer.Stop()
+	timer.Record(time.Second)
+
+	for _, r := range []*metrics.Recorder{first, second} {
+		counter := r.Get("counter").(*metrics.RecorderCounter)
+		a.Equal(uint64(2), counter.Value())
+		a.True(metrics.HasTag(counter, "foo", "bar"))
+		a.True(metrics.HasTag(counter, "su", "pu"))
+
+		a.Equal(42, r.Get("gauge").(*metrics.RecorderGauge).Value())
+		a.Equal([]uint64{7}, r.Get("histogram").(*metrics.RecorderHistogram).Values())
+		a.Equal([]float64{1.5}, r.Get("distribution").(*metrics.RecorderDistribution).Values())
+		a.Equal([]interface{}{"user"}, r.Get("set").(*metrics.RecorderSet).Values())
+		a.Equal("event|hello", r.Get("event").(*metrics.RecorderEvent).Event())
+		a.Equal(metrics.ServiceCheckCritical, r.Get("check").(*metrics.RecorderServiceCheck).Status())
+		a.Len(r.Get("timer").(*metrics.RecorderTimer).Durations(), 2)
+	}
+}
+
+func TestMultiMetricsWithTagsDoNotModifyTheOriginal(t *testing.T) {
+	a := assert.New(t)
+
+	m := metrics.MultiMetrics(metrics.NewPublisher(recorder(make(chan string)), metrics.StatsDEncoder, time.Second, nil))
+
+	counter := m.Counter("counter", metrics.NewTag("foo", "bar"))
+	tagged := counter.WithTag("su", "pu")
+
+	a.Equal("counter", tagged.Name())
+	a.Equal(metrics.Tags{metrics.NewTag("foo", "bar")}, counter.Tags())
+	a.Equal(metrics.Tags{metrics.NewTag("foo", "bar"), metrics.NewTag("su", "pu")}, tagged.Tags())
+}
+
+func TestMultiMetricsRunner(t *testing.T) {
+	a := assert.New(t)
+
+	rec := make(recorder, 1)
+	publisher := metrics.NewPublisher(rec, metrics.StatsDEncoder, time.Hour, nil)
+	m := metrics.MultiMetrics(publisher, metrics.NewRecorder())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		metrics.MultiMetricsRunner(metrics.MultiMetrics(m)).Run(ctx)
+		close(done)
+	}()
+
+	m.Counter("counter").Inc()
+	cancel()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		a.Fail("the runner didn't finish after the context was cancelled")
+	}
+
+	// the publisher flushes the pending metrics when it stops
+	a.Equal("counter:1|c|@1.0000\n", <-rec)
+}
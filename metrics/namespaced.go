@@ -34,6 +34,18 @@ func (n *namespaced) Histogram(name string, tags ...Tag) Histogram {
 	return n.adapted.Histogram(n.prefix(name), tags...)
 }
 
+func (n *namespaced) Distribution(name string, tags ...Tag) Distribution {
+	return n.adapted.Distribution(n.prefix(name), tags...)
+}
+
+func (n *namespaced) Set(name string, tags ...Tag) Set {
+	return n.adapted.Set(n.prefix(name), tags...)
+}
+
+func (n *namespaced) ServiceCheck(name string, tags ...Tag) ServiceCheck {
+	return n.adapted.ServiceCheck(n.prefix(name), tags...)
+}
+
 func (n *namespaced) prefix(name string) string {
 	return fmt.Sprintf("%s%s%s", n.namespace, namespaceSeparator, name)
 }
@@ -23,12 +23,13 @@ func TestPublisherWithNamespacedMetrics(t *testing.T) {
 	}
 	publisher := metrics.NewPublisher(io.Discard, encoder, time.Second, nil)
 	go publisher.Run(context.Background())
+	waitRunning(t, publisher)
 
 	namespacedPublisher := metrics.WithNamespace(publisher, namespace)
 	namespacedPublisher.Counter("commands_executed").Inc()
 	namespacedPublisher.Gauge("memory").Update(100)
 
-	publisher.Flush()
+	assert.NoError(publisher.Flush(context.Background()))
 }
 
 func TestPublisherWithMultipleNamespaces(t *testing.T) {
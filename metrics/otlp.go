@@ -0,0 +1,374 @@
+package metrics
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
+	"time"
+)
+
+const (
+	otlpHost          = "localhost:4318"
+	otlpPath          = "/v1/metrics"
+	otlpContentType   = "application/json"
+	otlpScopeName     = "github.com/socialpoint-labs/bsk/metrics"
+	otlpExportTimeout = 10 * time.Second
+
+	// otlpCumulative is the cumulative aggregation temporality of the OTLP sums and histograms
+	otlpCumulative = 2
+)
+
+// OTLP is a Metrics implementation that keeps the metrics in an in-process
+// registry and exports them to an OpenTelemetry collector using OTLP over HTTP,
+// with the JSON encoding.
+//
+// Counters are exported as monotonic sums, gauges as gauges, and histograms,
+// distributions and timers, in seconds, as explicit-bucket histograms. Tags are
+// exported as attributes. Sending events, adding values to sets and sending service
+// checks are reported to the error handler as errors.
+type OTLP struct {
+	*store
+	endpoint string
+	client   *http.Client
+	headers  http.Header
+	interval time.Duration
+	resource Tags
+	start    time.Time
+}
+
+// An OTLPOption is a functional option for building an OTLP exporter
+type OTLPOption func(*OTLP)
+
+// WithOTLPServiceName returns an option that sets the service.name attribute of the exported resource
+func WithOTLPServiceName(name string) OTLPOption {
+	return WithOTLPResourceAttributes(NewTag("service.name", name))
+}
+
+// WithOTLPServiceNamespace returns an option that sets the service.namespace attribute of the exported resource
+func WithOTLPServiceNamespace(namespace string) OTLPOption {
+	return WithOTLPResourceAttributes(NewTag("service.namespace", namespace))
+}
+
+// WithOTLPResourceAttributes returns an option that adds attributes to the exported resource
+func WithOTLPResourceAttributes(tags ...Tag) OTLPOption {
+	return func(o *OTLP) {
+		o.resource = append(o.resource, tags...)
+	}
+}
+
+// WithOTLPHistogramBuckets returns an option that sets the explicit bounds of the histogram buckets
+func WithOTLPHistogramBuckets(buckets ...float64) OTLPOption {
+	return func(o *OTLP) {
+		o.histogramBuckets = buckets
+	}
+}
+
+// WithOTLPTimerBuckets returns an option that sets the explicit bounds, in seconds, of the timer buckets
+func WithOTLPTimerBuckets(buckets ...float64) OTLPOption {
+	return func(o *OTLP) {
+		o.timerBuckets = buckets
+	}
+}
+
+// WithOTLPInterval returns an option that sets how often Run exports the metrics
+func WithOTLPInterval(interval time.Duration) OTLPOption {
+	return func(o *OTLP) {
+		o.interval = interval
+	}
+}
+
+// WithOTLPHTTPClient returns an option that sets the HTTP client used to export the metrics
+func WithOTLPHTTPClient(client *http.Client) OTLPOption {
+	return func(o *OTLP) {
+		o.client = client
+	}
+}
+
+// WithOTLPHeader returns an option that adds a header to the export requests, e.g. for authentication
+func WithOTLPHeader(key, value string) OTLPOption {
+	return func(o *OTLP) {
+		o.headers.Add(key, value)
+	}
+}
+
+// NewOTLP returns an empty OTLP exporter that exports to the given URL of an OTLP/HTTP
+// collector, e.g. http://localhost:4318/v1/metrics. The `/v1/metrics` path is used
+// when the URL has none.
+func NewOTLP(endpoint string, eh ErrorHandler, opts ...OTLPOption) *OTLP {
+	o := &OTLP{
+		store: newStore("otlp", eh, map[Op]string{
+			OpCounterAdd:         "sum",
+			OpGaugeUpdate:        "gauge",
+			OpHistogramUpdate:    "histogram",
+			OpTimerStop:          "histogram",
+			OpDistributionUpdate: "histogram",
+		}),
+		endpoint: otlpEndpoint(endpoint),
+		client:   &http.Client{Timeout: otlpExportTimeout},
+		headers:  make(http.Header),
+		interval: FlushEvery15s,
+		start:    time.Now(),
+	}
+	o.seconds = true
+	o.histogramBuckets = defaultHistogramBuckets
+	o.timerBuckets = defaultTimerBuckets
+
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	o.histogramBuckets = sortedBuckets(o.histogramBuckets)
+	o.timerBuckets = sortedBuckets(o.timerBuckets)
+
+	return o
+}
+
+// Run makes the exporter a contextx.Runner that exports the metrics periodically,
+// and one last time when the context is done.
+func (o *OTLP) Run(ctx context.Context) {
+	ticker := time.NewTicker(o.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := o.Export(ctx); err != nil {
+				o.eh(err)
+			}
+
+		case <-ctx.Done():
+			ctx, cancel := context.WithTimeout(context.Background(), otlpExportTimeout)
+			if err := o.Export(ctx); err != nil {
+				o.eh(err)
+			}
+			cancel()
+			return
+		}
+	}
+}
+
+// Export sends the current value of all the metrics to the collector.
+func (o *OTLP) Export(ctx context.Context) error {
+	body, err := json.Marshal(o.request(time.Now()))
+	if err != nil {
+		return fmt.Errorf("otlp: could not encode the metrics: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, o.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("otlp: could not create the export request: %w", err)
+	}
+	for key, values := range o.headers {
+		req.Header[key] = values
+	}
+	req.Header.Set("Content-Type", otlpContentType)
+
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("otlp: could not export the metrics: %w", err)
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("otlp: could not export the metrics: unexpected status %s", resp.Status)
+	}
+
+	return nil
+}
+
+// request returns the export request with the current value of all the metrics
+func (o *OTLP) request(now time.Time) otlpRequest {
+	start := otlpInt64(o.start.UnixNano())
+	timestamp := otlpInt64(now.UnixNano())
+
+	metrics := []otlpMetricData{}
+	o.each(func(m *storeMetric) {
+		data := otlpMetricData{Name: m.name}
+		if m.op == OpTimerStop {
+			data.Unit = "s"
+		}
+
+		switch m.kind {
+		case "sum":
+			data.Sum = &otlpSum{AggregationTemporality: otlpCumulative, IsMonotonic: true}
+			for _, key := range m.keys {
+				s := m.series[key]
+				count := otlpInt64(s.value)
+				data.Sum.DataPoints = append(data.Sum.DataPoints, otlpNumberDataPoint{
+					Attributes: otlpAttributes(s.tags), StartTimeUnixNano: start, TimeUnixNano: timestamp, AsInt: &count,
+				})
+			}
+		case "gauge":
+			data.Gauge = &otlpGauge{}
+			for _, key := range m.keys {
+				s := m.series[key]
+				value := s.value
+				data.Gauge.DataPoints = append(data.Gauge.DataPoints, otlpNumberDataPoint{
+					Attributes: otlpAttributes(s.tags), TimeUnixNano: timestamp, AsDouble: &value,
+				})
+			}
+		case "histogram":
+			data.Histogram = &otlpHistogram{AggregationTemporality: otlpCumulative}
+			for _, key := range m.keys {
+				s := m.series[key]
+				buckets := make([]otlpInt64, len(s.buckets))
+				for i, count := range s.buckets {
+					buckets[i] = otlpInt64(count)
+				}
+				data.Histogram.DataPoints = append(data.Histogram.DataPoints, otlpHistogramDataPoint{
+					Attributes:        otlpAttributes(s.tags),
+					StartTimeUnixNano: start,
+					TimeUnixNano:      timestamp,
+					Count:             otlpInt64(s.count),
+					Sum:               s.value,
+					BucketCounts:      buckets,
+					ExplicitBounds:    m.buckets,
+					Min:               s.min,
+					Max:               s.max,
+				})
+			}
+		}
+
+		metrics = append(metrics, data)
+	})
+
+	return otlpRequest{ResourceMetrics: []otlpResourceMetrics{{
+		Resource:     otlpResource{Attributes: otlpAttributes(o.resource)},
+		ScopeMetrics: []otlpScopeMetrics{{Scope: otlpScope{Name: otlpScopeName}, Metrics: metrics}},
+	}}}
+}
+
+// otlpEndpoint adds the default path to the endpoint if it has none
+func otlpEndpoint(endpoint string) string {
+	u, err := url.Parse(endpoint)
+	if err != nil || (u.Path != "" && u.Path != "/") {
+		return endpoint
+	}
+
+	u.Path = otlpPath
+	return u.String()
+}
+
+func otlpAttributes(tags Tags) []otlpKeyValue {
+	attributes := make([]otlpKeyValue, len(tags))
+	for i, t := range tags {
+		attributes[i] = otlpKeyValue{Key: t.Key, Value: otlpValue(t.Value)}
+	}
+
+	return attributes
+}
+
+// otlpValue returns the attribute value of a tag value, that is a string unless it is a boolean or a number
+func otlpValue(value interface{}) otlpAnyValue {
+	v := reflect.ValueOf(value)
+	switch v.Kind() {
+	case reflect.Bool:
+		b := v.Bool()
+		return otlpAnyValue{BoolValue: &b}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i := otlpInt64(v.Int())
+		return otlpAnyValue{IntValue: &i}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		i := otlpInt64(v.Uint())
+		return otlpAnyValue{IntValue: &i}
+	case reflect.Float32, reflect.Float64:
+		f := v.Float()
+		return otlpAnyValue{DoubleValue: &f}
+	}
+
+	s := fmt.Sprint(value)
+	return otlpAnyValue{StringValue: &s}
+}
+
+// The types below follow the JSON encoding of the OTLP ExportMetricsServiceRequest message.
+
+type otlpRequest struct {
+	ResourceMetrics []otlpResourceMetrics `json:"resourceMetrics"`
+}
+
+type otlpResourceMetrics struct {
+	Resource     otlpResource       `json:"resource"`
+	ScopeMetrics []otlpScopeMetrics `json:"scopeMetrics"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeMetrics struct {
+	Scope   otlpScope        `json:"scope"`
+	Metrics []otlpMetricData `json:"metrics"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpMetricData struct {
+	Name      string         `json:"name"`
+	Unit      string         `json:"unit,omitempty"`
+	Sum       *otlpSum       `json:"sum,omitempty"`
+	Gauge     *otlpGauge     `json:"gauge,omitempty"`
+	Histogram *otlpHistogram `json:"histogram,omitempty"`
+}
+
+type otlpSum struct {
+	DataPoints             []otlpNumberDataPoint `json:"dataPoints"`
+	AggregationTemporality int                   `json:"aggregationTemporality"`
+	IsMonotonic            bool                  `json:"isMonotonic"`
+}
+
+type otlpGauge struct {
+	DataPoints []otlpNumberDataPoint `json:"dataPoints"`
+}
+
+type otlpHistogram struct {
+	DataPoints             []otlpHistogramDataPoint `json:"dataPoints"`
+	AggregationTemporality int                      `json:"aggregationTemporality"`
+}
+
+type otlpNumberDataPoint struct {
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	StartTimeUnixNano otlpInt64      `json:"startTimeUnixNano,omitempty"`
+	TimeUnixNano      otlpInt64      `json:"timeUnixNano"`
+	AsInt             *otlpInt64     `json:"asInt,omitempty"`
+	AsDouble          *float64       `json:"asDouble,omitempty"`
+}
+
+type otlpHistogramDataPoint struct {
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	StartTimeUnixNano otlpInt64      `json:"startTimeUnixNano"`
+	TimeUnixNano      otlpInt64      `json:"timeUnixNano"`
+	Count             otlpInt64      `json:"count"`
+	Sum               float64        `json:"sum"`
+	BucketCounts      []otlpInt64    `json:"bucketCounts"`
+	ExplicitBounds    []float64      `json:"explicitBounds"`
+	Min               float64        `json:"min"`
+	Max               float64        `json:"max"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpAnyValue struct {
+	StringValue *string    `json:"stringValue,omitempty"`
+	BoolValue   *bool      `json:"boolValue,omitempty"`
+	IntValue    *otlpInt64 `json:"intValue,omitempty"`
+	DoubleValue *float64   `json:"doubleValue,omitempty"`
+}
+
+// otlpInt64 is a 64 bits integer, encoded as a JSON string as the OTLP JSON encoding requires
+type otlpInt64 int64
+
+func (i otlpInt64) MarshalJSON() ([]byte, error) {
+	return strconv.AppendQuote(nil, strconv.FormatInt(int64(i), 10)), nil
+}
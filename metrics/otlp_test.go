@@ -0,0 +1,194 @@
+package metrics_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/socialpoint-labs/bsk/metrics"
+)
+
+func TestOTLPImplementsMetrics(t *testing.T) {
+	check := func(m metrics.Metrics) {}
+	check(metrics.NewOTLP("http://localhost:4318", nil))
+}
+
+func TestOTLPExport(t *testing.T) {
+	a := assert.New(t)
+
+	requests := make(chan *http.Request, 1)
+	bodies := make(chan map[string]interface{}, 1)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		a.NoError(json.NewDecoder(r.Body).Decode(&body))
+		requests <- r
+		bodies <- body
+	}))
+	defer collector.Close()
+
+	otlp := metrics.NewOTLP(collector.URL, nil,
+		metrics.WithOTLPServiceName("my_service"),
+		metrics.WithOTLPServiceNamespace("my_namespace"),
+		metrics.WithOTLPHistogramBuckets(100, 10),
+		metrics.WithOTLPHeader("Authorization", "Bearer token"),
+	)
+
+	otlp.Counter("requests", metrics.NewTag("code", 200)).Add(2)
+	otlp.Counter("requests", metrics.NewTag("code", 200)).Inc()
+	otlp.Counter("requests", metrics.NewTag("code", 500)).Inc()
+	otlp.Gauge("memory", metrics.NewTag("host", "life")).Update(1.5)
+	histogram := otlp.Histogram("size", metrics.NewTag("cached", true))
+	histogram.AddValue(5)
+	histogram.AddValue(50)
+	histogram.AddValue(500)
+	otlp.Timer("latency").Record(250 * time.Millisecond)
+
+	a.NoError(otlp.Export(context.Background()))
+
+	r := <-requests
+	a.Equal(http.MethodPost, r.Method)
+	a.Equal("/v1/metrics", r.URL.Path)
+	a.Equal("application/json", r.Header.Get("Content-Type"))
+	a.Equal("Bearer token", r.Header.Get("Authorization"))
+
+	resourceMetrics := (<-bodies)["resourceMetrics"].([]interface{})[0].(map[string]interface{})
+
+	expectedResource := `{"attributes":[
+		{"key":"service.name","value":{"stringValue":"my_service"}},
+		{"key":"service.namespace","value":{"stringValue":"my_namespace"}}
+	]}`
+	a.JSONEq(expectedResource, toJSON(t, resourceMetrics["resource"]))
+
+	scopeMetrics := resourceMetrics["scopeMetrics"].([]interface{})[0].(map[string]interface{})
+	a.Equal("github.com/socialpoint-labs/bsk/metrics", scopeMetrics["scope"].(map[string]interface{})["name"])
+
+	exported := scopeMetrics["metrics"].([]interface{})
+	a.Len(exported, 4)
+
+	// the timestamps are not deterministic
+	for _, m := range exported {
+		for _, kind := range []string{"sum", "gauge", "histogram"} {
+			if data, ok := m.(map[string]interface{})[kind].(map[string]interface{}); ok {
+				for _, dp := range data["dataPoints"].([]interface{}) {
+					a.NotEmpty(dp.(map[string]interface{})["timeUnixNano"])
+					delete(dp.(map[string]interface{}), "timeUnixNano")
+					delete(dp.(map[string]interface{}), "startTimeUnixNano")
+				}
+			}
+		}
+	}
+
+	a.JSONEq(`{"name":"requests","sum":{"aggregationTemporality":2,"isMonotonic":true,"dataPoints":[
+		{"attributes":[{"key":"code","value":{"intValue":"200"}}],"asInt":"3"},
+		{"attributes":[{"key":"code","value":{"intValue":"500"}}],"asInt":"1"}
+	]}}`, toJSON(t, exported[0]))
+
+	a.JSONEq(`{"name":"memory","gauge":{"dataPoints":[
+		{"attributes":[{"key":"host","value":{"stringValue":"life"}}],"asDouble":1.5}
+	]}}`, toJSON(t, exported[1]))
+
+	a.JSONEq(`{"name":"size","histogram":{"aggregationTemporality":2,"dataPoints":[
+		{"attributes":[{"key":"cached","value":{"boolValue":true}}],
+		"count":"3","sum":555,"min":5,"max":500,"bucketCounts":["1","1","1"],"explicitBounds":[10,100]}
+	]}}`, toJSON(t, exported[2]))
+
+	a.JSONEq(`{"name":"latency","unit":"s","histogram":{"aggregationTemporality":2,"dataPoints":[
+		{"count":"1","sum":0.25,"min":0.25,"max":0.25,
+		"bucketCounts":["0","0","0","0","0","1","0","0","0","0","0","0"],
+		"explicitBounds":[0.005,0.01,0.025,0.05,0.1,0.25,0.5,1,2.5,5,10]}
+	]}}`, toJSON(t, exported[3]))
+}
+
+func TestOTLPExportNormalizesTags(t *testing.T) {
+	a := assert.New(t)
+
+	bodies := make(chan map[string]interface{}, 1)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		a.NoError(json.NewDecoder(r.Body).Decode(&body))
+		bodies <- body
+	}))
+	defer collector.Close()
+
+	otlp := metrics.NewOTLP(collector.URL, nil)
+
+	// the same tags in a different order are the same data point
+	otlp.Counter("requests", metrics.NewTag("path", "/"), metrics.NewTag("code", 200)).Inc()
+	otlp.Counter("requests", metrics.NewTag("code", 200), metrics.NewTag("path", "/")).Inc()
+
+	// a repeated key keeps the last value
+	otlp.Counter("requests", metrics.NewTag("code", 200)).WithTag("code", 500).Inc()
+
+	a.NoError(otlp.Export(context.Background()))
+
+	resourceMetrics := (<-bodies)["resourceMetrics"].([]interface{})[0].(map[string]interface{})
+	scopeMetrics := resourceMetrics["scopeMetrics"].([]interface{})[0].(map[string]interface{})
+	data := scopeMetrics["metrics"].([]interface{})[0].(map[string]interface{})["sum"].(map[string]interface{})
+	for _, dp := range data["dataPoints"].([]interface{}) {
+		delete(dp.(map[string]interface{}), "timeUnixNano")
+		delete(dp.(map[string]interface{}), "startTimeUnixNano")
+	}
+
+	a.JSONEq(`[
+		{"attributes":[{"key":"code","value":{"intValue":"200"}},{"key":"path","value":{"stringValue":"/"}}],"asInt":"2"},
+		{"attributes":[{"key":"code","value":{"intValue":"500"}}],"asInt":"1"}
+	]`, toJSON(t, data["dataPoints"]))
+}
+
+func TestOTLPExportErrors(t *testing.T) {
+	a := assert.New(t)
+
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer collector.Close()
+
+	errs := make(chan error, 1)
+	otlp := metrics.NewOTLP(collector.URL+"/custom/path", func(err error) { errs <- err })
+
+	a.EqualError(otlp.Export(context.Background()), "otlp: could not export the metrics: unexpected status 400 Bad Request")
+
+	otlp.Counter("counter", metrics.NewTag("a", 1)).Inc()
+	otlp.Gauge("counter").Update(1)
+	a.EqualError(<-errs, "otlp: metric `counter` already registered as sum")
+
+	otlp.Event("event").Send()
+	a.EqualError(<-errs, "otlp: operation event send not supported")
+}
+
+func TestOTLPRunExportsWhenDone(t *testing.T) {
+	a := assert.New(t)
+
+	exported := make(chan struct{}, 10)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		exported <- struct{}{}
+	}))
+	defer collector.Close()
+
+	otlp := metrics.NewOTLP(collector.URL, nil, metrics.WithOTLPInterval(time.Hour))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		otlp.Run(ctx)
+		close(stopped)
+	}()
+
+	cancel()
+	<-stopped
+	a.Len(exported, 1)
+}
+
+func toJSON(t *testing.T, v interface{}) string {
+	t.Helper()
+
+	b, err := json.Marshal(v)
+	assert.NoError(t, err)
+
+	return string(b)
+}
@@ -0,0 +1,253 @@
+package metrics
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/socialpoint-labs/bsk/contextx"
+)
+
+const (
+	procfs = "/proc"
+	// USER_HZ, the unit of the CPU times in procfs, is 100 in all the supported Linux architectures
+	clockTicks = 100
+)
+
+// A ProcessStatsRunner is a contextx.Runner that captures the stats of the
+// current process from procfs, so it only works in Linux, and publishes them
+// to the Metrics dependency every tick.
+type ProcessStatsRunner struct {
+	metrics Metrics
+	tick    time.Duration
+	procfs  string
+	tags    Tags
+}
+
+// NewProcessStatsRunner returns a new Runner with the provided metrics and tick.
+func NewProcessStatsRunner(metrics Metrics, tick time.Duration, t ...Tag) contextx.Runner {
+	return NewProcessStatsRunnerWithProcfs(metrics, tick, procfs, t...)
+}
+
+// NewProcessStatsRunnerWithProcfs returns a new Runner with the provided metrics and tick
+// that reads the stats from the procfs mounted in the given root, useful for testing.
+func NewProcessStatsRunnerWithProcfs(metrics Metrics, tick time.Duration, root string, t ...Tag) contextx.Runner {
+	return &ProcessStatsRunner{
+		metrics: metrics,
+		tick:    tick,
+		procfs:  root,
+		tags:    t,
+	}
+}
+
+type processMetrics struct {
+	// memory
+	rss     Gauge
+	virtual Gauge
+	// cpu
+	cpuUser   Gauge
+	cpuSystem Gauge
+	// file descriptors
+	fds      Gauge
+	fdsLimit Gauge
+	// others
+	threads                 Gauge
+	voluntaryCtxSwitches    Gauge
+	nonVoluntaryCtxSwitches Gauge
+}
+
+// Run captures new values from procfs and publishes them to the metrics.
+// Stats that cannot be read, e.g. when not running in Linux, are not published.
+func (r *ProcessStatsRunner) Run(ctx context.Context) {
+	gauge := func(name string) Gauge {
+		return r.metrics.Gauge(name, r.tags...)
+	}
+
+	processMetrics := &processMetrics{
+		// memory
+		rss:     gauge("process.mem.rss_bytes"),
+		virtual: gauge("process.mem.virtual_bytes"),
+		// cpu
+		cpuUser:   gauge("process.cpu.user_seconds"),
+		cpuSystem: gauge("process.cpu.system_seconds"),
+		// file descriptors
+		fds:      gauge("process.fds.open"),
+		fdsLimit: gauge("process.fds.limit"),
+		// others
+		threads:                 gauge("process.threads"),
+		voluntaryCtxSwitches:    gauge("process.ctx_switches.voluntary"),
+		nonVoluntaryCtxSwitches: gauge("process.ctx_switches.involuntary"),
+	}
+
+	self := filepath.Join(r.procfs, "self")
+
+	ticker := time.NewTicker(r.tick)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			collectProcess(processMetrics, self)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func collectProcess(m *processMetrics, self string) {
+	if status, err := readProcStatus(filepath.Join(self, "status")); err == nil {
+		updateIfPresent(m.rss, status, "VmRSS")
+		updateIfPresent(m.virtual, status, "VmSize")
+		updateIfPresent(m.threads, status, "Threads")
+		updateIfPresent(m.voluntaryCtxSwitches, status, "voluntary_ctxt_switches")
+		updateIfPresent(m.nonVoluntaryCtxSwitches, status, "nonvoluntary_ctxt_switches")
+	}
+
+	if user, system, err := readProcCPUTimes(filepath.Join(self, "stat")); err == nil {
+		m.cpuUser.Update(user)
+		m.cpuSystem.Update(system)
+	}
+
+	if fds, err := countFDs(filepath.Join(self, "fd")); err == nil {
+		m.fds.Update(fds)
+	}
+
+	if limit, err := readProcMaxOpenFiles(filepath.Join(self, "limits")); err == nil {
+		m.fdsLimit.Update(limit)
+	}
+}
+
+func updateIfPresent(g Gauge, values map[string]uint64, key string) {
+	if v, ok := values[key]; ok {
+		g.Update(v)
+	}
+}
+
+// readProcStatus parses the numeric values of a /proc/<pid>/status file,
+// converting the values in kB to bytes.
+func readProcStatus(path string) (map[string]uint64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	values := make(map[string]uint64)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), ":")
+		if !ok {
+			continue
+		}
+
+		fields := strings.Fields(value)
+		if len(fields) == 0 {
+			continue
+		}
+
+		v, err := strconv.ParseUint(fields[0], 10, 64)
+		if err != nil {
+			continue
+		}
+		if len(fields) > 1 && fields[1] == "kB" {
+			v *= 1024
+		}
+
+		values[key] = v
+	}
+
+	return values, scanner.Err()
+}
+
+// readProcCPUTimes returns the user and system CPU times, in seconds, of a /proc/<pid>/stat file
+func readProcCPUTimes(path string) (float64, float64, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	// the command name, the second field, is between parenthesis and can contain spaces
+	i := strings.LastIndexByte(string(b), ')')
+	if i < 0 {
+		return 0, 0, fmt.Errorf("invalid stat file %s", path)
+	}
+
+	// fields after the command name start with the third one, the state
+	fields := strings.Fields(string(b[i+1:]))
+	if len(fields) < 13 {
+		return 0, 0, fmt.Errorf("invalid stat file %s", path)
+	}
+
+	// utime and stime are the 14th and 15th fields
+	user, err := strconv.ParseUint(fields[11], 10, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	system, err := strconv.ParseUint(fields[12], 10, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return float64(user) / clockTicks, float64(system) / clockTicks, nil
+}
+
+// readProcMaxOpenFiles returns the soft limit of open files of a /proc/<pid>/limits file
+func readProcMaxOpenFiles(path string) (uint64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	const prefix = "Max open files"
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, prefix) {
+			continue
+		}
+
+		fields := strings.Fields(line[len(prefix):])
+		if len(fields) == 0 {
+			break
+		}
+
+		return strconv.ParseUint(fields[0], 10, 64)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+
+	return 0, fmt.Errorf("open files limit not found in %s", path)
+}
+
+// countFDs returns the number of open file descriptors listed in a /proc/<pid>/fd
+// directory, not counting the one used to read it.
+func countFDs(dir string) (int, error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	names, err := f.Readdirnames(-1)
+	if err != nil {
+		return 0, err
+	}
+
+	self := strconv.Itoa(int(f.Fd()))
+	n := 0
+	for _, name := range names {
+		if name != self {
+			n++
+		}
+	}
+
+	return n, nil
+}
@@ -0,0 +1,101 @@
+package metrics_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/socialpoint-labs/bsk/metrics"
+)
+
+const (
+	fakeStat = "1234 (my (weird) cmd) S 1 1234 1234 0 -1 4194560 1000 0 0 0 250 150 0 0 20 0 12 0 100 104857600 2048 18446744073709551615\n"
+
+	fakeStatus = `Name:	cmd
+State:	S (sleeping)
+Pid:	1234
+VmSize:	  102400 kB
+VmRSS:	    8192 kB
+Threads:	12
+voluntary_ctxt_switches:	150
+nonvoluntary_ctxt_switches:	25
+`
+
+	fakeLimits = `Limit                     Soft Limit           Hard Limit           Units
+Max cpu time              unlimited            unlimited            seconds
+Max open files            1024                 524288               files
+`
+)
+
+func fakeProcfs(t *testing.T) string {
+	root := t.TempDir()
+	self := filepath.Join(root, "self")
+	fd := filepath.Join(self, "fd")
+
+	a := assert.New(t)
+	a.NoError(os.MkdirAll(fd, 0o755))
+	a.NoError(os.WriteFile(filepath.Join(self, "stat"), []byte(fakeStat), 0o644))
+	a.NoError(os.WriteFile(filepath.Join(self, "status"), []byte(fakeStatus), 0o644))
+	a.NoError(os.WriteFile(filepath.Join(self, "limits"), []byte(fakeLimits), 0o644))
+	for _, name := range []string{"0", "1", "2"} {
+		a.NoError(os.WriteFile(filepath.Join(fd, name), nil, 0o644))
+	}
+
+	return root
+}
+
+func TestProcessStats(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	a := assert.New(t)
+	rec := metrics.NewRecorder()
+
+	runner := metrics.NewProcessStatsRunnerWithProcfs(rec, time.Millisecond*10, fakeProcfs(t), metrics.Tag{Key: "test", Value: "life"})
+	go runner.Run(ctx)
+
+	expected := map[string]interface{}{
+		"process.mem.rss_bytes":            uint64(8192 * 1024),
+		"process.mem.virtual_bytes":        uint64(102400 * 1024),
+		"process.cpu.user_seconds":         2.5,
+		"process.cpu.system_seconds":       1.5,
+		"process.fds.open":                 3,
+		"process.fds.limit":                uint64(1024),
+		"process.threads":                  uint64(12),
+		"process.ctx_switches.voluntary":   uint64(150),
+		"process.ctx_switches.involuntary": uint64(25),
+	}
+
+	for name, value := range expected {
+		a.Eventually(func() bool {
+			g, ok := rec.Get(name).(*metrics.RecorderGauge)
+			return ok && g.Value() == value
+		}, time.Second, time.Millisecond*10, name)
+
+		a.Contains(rec.Get(name).(*metrics.RecorderGauge).Tags(), metrics.Tag{Key: "test", Value: "life"})
+	}
+}
+
+func TestProcessStatsWithoutProcfs(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	rec := metrics.NewRecorder()
+
+	runner := metrics.NewProcessStatsRunnerWithProcfs(rec, time.Millisecond*10, t.TempDir())
+	go runner.Run(ctx)
+
+	time.Sleep(time.Millisecond * 50)
+
+	g, ok := rec.Get("process.mem.rss_bytes").(*metrics.RecorderGauge)
+	assert.True(t, ok)
+	assert.Nil(t, g.Value())
+}
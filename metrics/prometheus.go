@@ -0,0 +1,214 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/socialpoint-labs/bsk/contextx"
+)
+
+const (
+	prometheusAddr        = ":9090"
+	prometheusPath        = "/metrics"
+	prometheusContentType = "text/plain; version=0.0.4; charset=utf-8"
+)
+
+var (
+	prometheusLabelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+	// defaultHistogramBuckets are the default buckets for histograms
+	defaultHistogramBuckets = []float64{1, 5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000}
+	// defaultTimerBuckets are the default buckets for timers, in seconds
+	defaultTimerBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+)
+
+// Prometheus is a Metrics implementation that keeps the metrics in an in-process
+// registry and exposes them in the Prometheus text exposition format.
+//
+// Tags are exposed as labels, timers are exposed as histograms in seconds,
+// distributions are exposed as histograms. Sending events, adding values to sets
+// and sending service checks are reported to the error handler as errors.
+type Prometheus struct {
+	*store
+}
+
+// A PrometheusOption is a functional option for building a Prometheus registry
+type PrometheusOption func(*Prometheus)
+
+// WithPrometheusHistogramBuckets returns an option that sets the upper bounds of the histogram buckets
+func WithPrometheusHistogramBuckets(buckets ...float64) PrometheusOption {
+	return func(p *Prometheus) {
+		p.histogramBuckets = buckets
+	}
+}
+
+// WithPrometheusTimerBuckets returns an option that sets the upper bounds, in seconds, of the timer buckets
+func WithPrometheusTimerBuckets(buckets ...float64) PrometheusOption {
+	return func(p *Prometheus) {
+		p.timerBuckets = buckets
+	}
+}
+
+// NewPrometheus returns an empty Prometheus registry.
+func NewPrometheus(eh ErrorHandler, opts ...PrometheusOption) *Prometheus {
+	p := &Prometheus{store: newStore("prometheus", eh, map[Op]string{
+		OpCounterAdd:         "counter",
+		OpGaugeUpdate:        "gauge",
+		OpHistogramUpdate:    "histogram",
+		OpTimerStop:          "histogram",
+		OpDistributionUpdate: "histogram",
+	})}
+	p.seconds = true
+	p.histogramBuckets = defaultHistogramBuckets
+	p.timerBuckets = defaultTimerBuckets
+	p.metricName = prometheusName
+	p.tagKey = prometheusLabelName
+
+	for _, o := range opts {
+		o(p)
+	}
+
+	p.histogramBuckets = sortedBuckets(p.histogramBuckets)
+	p.timerBuckets = sortedBuckets(p.timerBuckets)
+
+	return p
+}
+
+// ServeHTTP implements http.Handler, writing all the metrics in the Prometheus
+// text exposition format.
+func (p *Prometheus) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", prometheusContentType)
+	if _, err := p.WriteTo(w); err != nil {
+		p.eh(err)
+	}
+}
+
+// WriteTo writes all the metrics in the Prometheus text exposition format.
+func (p *Prometheus) WriteTo(w io.Writer) (int64, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	names := append([]string(nil), p.names...)
+	sort.Strings(names)
+
+	var b strings.Builder
+	for _, name := range names {
+		writePrometheusFamily(&b, p.metrics[name])
+	}
+
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+// PrometheusRunner returns a contextx.Runner that serves the metrics of the
+// registry in the given address and path until the context is done.
+func PrometheusRunner(p *Prometheus, addr, path string) contextx.Runner {
+	if addr == "" {
+		addr = prometheusAddr
+	}
+	if path == "" {
+		path = prometheusPath
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(path, p)
+
+	return contextx.RunnerFunc(func(ctx context.Context) {
+		server := &http.Server{Addr: addr, Handler: mux, ReadHeaderTimeout: 5 * time.Second}
+
+		go func() {
+			<-ctx.Done()
+			_ = server.Close()
+		}()
+
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			p.eh(err)
+		}
+	})
+}
+
+// writePrometheusFamily writes the series of a metric, the buckets of the histograms are cumulative
+func writePrometheusFamily(b *strings.Builder, f *storeMetric) {
+	fmt.Fprintf(b, "# TYPE %s %s\n", f.name, f.kind)
+
+	labels := make(map[string]*storeSeries, len(f.series))
+	sorted := make([]string, 0, len(f.series))
+	for _, s := range f.series {
+		l := prometheusLabels(s.tags)
+		labels[l] = s
+		sorted = append(sorted, l)
+	}
+	sort.Strings(sorted)
+
+	for _, l := range sorted {
+		s := labels[l]
+		if f.kind != "histogram" {
+			fmt.Fprintf(b, "%s%s %s\n", f.name, braces(l), formatFloat(s.value))
+			continue
+		}
+
+		var cumulative uint64
+		for i, upper := range f.buckets {
+			cumulative += s.buckets[i]
+			fmt.Fprintf(b, "%s_bucket%s %d\n", f.name, braces(joinLabels(l, `le="`+formatFloat(upper)+`"`)), cumulative)
+		}
+		fmt.Fprintf(b, "%s_bucket%s %d\n", f.name, braces(joinLabels(l, `le="+Inf"`)), s.count)
+		fmt.Fprintf(b, "%s_sum%s %s\n", f.name, braces(l), formatFloat(s.value))
+		fmt.Fprintf(b, "%s_count%s %d\n", f.name, braces(l), s.count)
+	}
+}
+
+// prometheusName replaces the characters not allowed in Prometheus metric names with underscores
+func prometheusName(name string) string {
+	if name != "" && name[0] >= '0' && name[0] <= '9' {
+		name = "_" + name
+	}
+
+	return strings.Map(func(r rune) rune {
+		if r == '_' || r == ':' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' {
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+// prometheusLabelName replaces the characters not allowed in Prometheus label names with underscores
+func prometheusLabelName(key string) string {
+	return strings.ReplaceAll(prometheusName(key), ":", "_")
+}
+
+// prometheusLabels returns the labels of the tags of a series, that are already sorted by key
+// and unique, so the same tags in any order are the same series
+func prometheusLabels(tags Tags) string {
+	labels := make([]string, len(tags))
+	for i, t := range tags {
+		labels[i] = fmt.Sprintf(`%s="%s"`, t.Key, prometheusLabelValueEscaper.Replace(fmt.Sprintf("%v", t.Value)))
+	}
+
+	return strings.Join(labels, ",")
+}
+
+func joinLabels(labels, label string) string {
+	if labels == "" {
+		return label
+	}
+	return labels + "," + label
+}
+
+func braces(labels string) string {
+	if labels == "" {
+		return ""
+	}
+	return "{" + labels + "}"
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
@@ -0,0 +1,166 @@
+package metrics_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/socialpoint-labs/bsk/metrics"
+	"github.com/socialpoint-labs/bsk/netutil"
+)
+
+func TestPrometheusImplementsMetrics(t *testing.T) {
+	check := func(m metrics.Metrics) {}
+	check(metrics.NewPrometheus(nil))
+}
+
+func TestPrometheusExposition(t *testing.T) {
+	a := assert.New(t)
+
+	p := metrics.NewPrometheus(nil, metrics.WithPrometheusHistogramBuckets(10, 100))
+
+	counter := p.Counter("http.requests", metrics.NewTag("code", 200))
+	counter.Inc()
+	counter.Add(2)
+	counter.WithTag("path", `/a"b`).Inc()
+
+	p.Gauge("memory").Update(100)
+	p.Gauge("memory").Update(1.5)
+
+	histogram := p.Histogram("payload.size")
+	histogram.AddValue(5)
+	histogram.AddValue(50)
+	histogram.AddValue(500)
+
+	p.Distribution("latency").AddValue(7.5)
+
+	expected := `# TYPE http_requests counter
+http_requests{code="200"} 3
+http_requests{code="200",path="/a\"b"} 1
+# TYPE latency histogram
+latency_bucket{le="10"} 1
+latency_bucket{le="100"} 1
+latency_bucket{le="+Inf"} 1
+latency_sum 7.5
+latency_count 1
+# TYPE memory gauge
+memory 1.5
+# TYPE payload_size histogram
+payload_size_bucket{le="10"} 1
+payload_size_bucket{le="100"} 2
+payload_size_bucket{le="+Inf"} 3
+payload_size_sum 555
+payload_size_count 3
+`
+
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	a.Equal(http.StatusOK, rec.Code)
+	a.Equal("text/plain; version=0.0.4; charset=utf-8", rec.Header().Get("Content-Type"))
+	a.Equal(expected, rec.Body.String())
+}
+
+func TestPrometheusBucketsAreNotModified(t *testing.T) {
+	buckets := []float64{100, 10}
+	timerBuckets := []float64{1, 0.1}
+
+	metrics.NewPrometheus(nil, metrics.WithPrometheusHistogramBuckets(buckets...), metrics.WithPrometheusTimerBuckets(timerBuckets...))
+
+	assert.Equal(t, []float64{100, 10}, buckets)
+	assert.Equal(t, []float64{1, 0.1}, timerBuckets)
+}
+
+func TestPrometheusLabels(t *testing.T) {
+	a := assert.New(t)
+
+	p := metrics.NewPrometheus(nil)
+
+	// the same tags in a different order are the same series
+	p.Counter("requests", metrics.NewTag("path", "/"), metrics.NewTag("code", 200)).Inc()
+	p.Counter("requests", metrics.NewTag("code", 200), metrics.NewTag("path", "/")).Inc()
+
+	// a repeated key keeps the last value
+	p.Counter("requests", metrics.NewTag("code", 200)).WithTag("code", 500).Inc()
+
+	expected := `# TYPE requests counter
+requests{code="200",path="/"} 2
+requests{code="500"} 1
+`
+
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	a.Equal(expected, rec.Body.String())
+}
+
+func TestPrometheusTimer(t *testing.T) {
+	a := assert.New(t)
+
+	p := metrics.NewPrometheus(nil, metrics.WithPrometheusTimerBuckets(60))
+
+	timer := p.Timer("request_duration", metrics.NewTag("method", "get"))
+	timer.Start()
+	timer.Stop()
+
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	a.Contains(rec.Body.String(), "# TYPE request_duration histogram\n")
+	a.Contains(rec.Body.String(), `request_duration_bucket{method="get",le="60"} 1`)
+	a.Contains(rec.Body.String(), `request_duration_count{method="get"} 1`)
+}
+
+func TestPrometheusErrors(t *testing.T) {
+	a := assert.New(t)
+
+	var errs []error
+	p := metrics.NewPrometheus(func(err error) { errs = append(errs, err) })
+
+	p.Event("deploy").Send()
+	p.Gauge("memory").Update("invalid value")
+	p.Counter("requests").Inc()
+	p.Gauge("requests").Update(1)
+	p.Set("players").Add("alice")
+	p.ServiceCheck("database").Send(metrics.ServiceCheckOK)
+
+	a.Len(errs, 5)
+	a.EqualError(errs[0], "prometheus: operation event send not supported")
+	a.EqualError(errs[1], "could not publish metric `memory`: value `invalid value` cannot be casted to float64")
+	a.EqualError(errs[2], "prometheus: metric `requests` already registered as counter")
+	a.EqualError(errs[3], "prometheus: operation set add not supported")
+	a.EqualError(errs[4], "prometheus: operation service check send not supported")
+}
+
+func TestPrometheusRunner(t *testing.T) {
+	a := assert.New(t)
+
+	p := metrics.NewPrometheus(nil)
+	p.Counter("requests").Inc()
+
+	addr := netutil.FreeTCPAddr().String()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go metrics.PrometheusRunner(p, addr, "/custom").Run(ctx)
+
+	var resp *http.Response
+	var err error
+	for i := 0; i < 50; i++ {
+		resp, err = http.Get("http://" + addr + "/custom")
+		if err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	a.NoError(err)
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	a.NoError(err)
+	a.Equal("# TYPE requests counter\nrequests 1\n", string(body))
+}
@@ -3,50 +3,266 @@ package metrics
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"math/rand"
 	"net"
 	"os"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 const (
-	bufferSize         = 1024
+	// the largest payload that fits in a single UDP datagram with the usual MTU of 1500 bytes
+	maxPacketSize      = 1432
+	queueSize          = 4096
 	datadogHost        = "127.0.0.1"
 	datadogHostPort    = "8125"
 	datadogUnixAddress = "/var/run/datadog/dsd.socket"
+	// datagrams over unix domain sockets are not bound by the network MTU
+	datadogUnixMaxPacketSize = 8192
 	// this is datadog's agent default flush time, in case we lower it in the agent's conf change it here also
 	datadogFlush = FlushEvery15s
+	// how often a lazy connection to the datadog agent is retried
+	datadogRedialInterval = time.Second
+	// buffers larger than this are not reused, so a single huge observation doesn't pin its memory
+	maxPooledBufferSize = 64 * 1024
+	// how long Run keeps publishing after its context is cancelled, at most
+	shutdownGracePeriod = time.Second
+	// how often Run checks for new observations while draining
+	drainIdleInterval = 50 * time.Millisecond
 )
 
+// ErrPublisherNotRunning is returned by Publisher.Flush when the Run method of the publisher is not running.
+var ErrPublisherNotRunning = errors.New("metrics publisher: not running")
+
+// bufferPool holds the buffers of the encoded observations waiting in the queue of the publishers
+var bufferPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, 0, 256)
+		return &b
+	},
+}
+
 // Publisher is a Metrics implementation that watches metrics changes and publish encoded
 // metrics to and io.Writer. This allows to forward metrics to an UDP server using
 // the StatsD protocol
 type Publisher struct {
 	writer        io.Writer
 	encoder       Encoder
+	appendEncoder AppendEncoder
 	errorHandler  ErrorHandler
 	flushInterval time.Duration
-
-	queue      chan string
+	gracePeriod   time.Duration
+	sampleRate    float64
+	maxPacketSize int
+
+	// aggregator is nil when aggregation is disabled
+	aggregator *aggregator
+	// histograms is nil unless the histograms are aggregated, see WithHistogramAggregation
+	histograms *histogramAggregator
+
+	queue      chan *[]byte
+	overflow   OverflowPolicy
+	dropped    uint64 // number of metrics dropped since the last report, updated atomically
 	forceFlush chan struct{}
+
+	mu   sync.Mutex    // protects done
+	done chan struct{} // closed when Run returns, nil if it never ran
+	// owned is connected when Run starts and closed when it returns, it is nil unless the
+	// publisher owns its writer
+	owned ownedWriter
+
+	stats publisherStats
+	// selfMetrics are the tags of the self metrics, nil when they are disabled
+	selfMetrics Tags
+}
+
+// ownedWriter is the connection of a writer owned by a publisher, that is dialed when the
+// publisher runs instead of when it is created
+type ownedWriter interface {
+	io.Closer
+	connect()
 }
 
-// NewPublisher creates a new metrics publisher
-func NewPublisher(w io.Writer, e Encoder, flushInterval time.Duration, errorHandler ErrorHandler) *Publisher {
+// An OverflowPolicy decides what a Publisher does with a new observation when its queue is full
+type OverflowPolicy uint
+
+// Available overflow policies
+const (
+	// OverflowDropNewest discards the new observation
+	OverflowDropNewest OverflowPolicy = iota
+	// OverflowDropOldest discards the oldest observation in the queue to make room for the new one
+	OverflowDropOldest
+	// OverflowBlock blocks the caller until there is room in the queue
+	OverflowBlock
+)
+
+// DroppedMetricsError is reported to the ErrorHandler of a Publisher when
+// observations have been discarded because its queue was full.
+type DroppedMetricsError struct {
+	Count uint64
+}
+
+func (e *DroppedMetricsError) Error() string {
+	return fmt.Sprintf("metrics publisher: %d metrics dropped because the queue is full", e.Count)
+}
+
+// A PublisherOption is a functional option for building a Publisher
+type PublisherOption func(*publisherOptions)
+
+type publisherOptions struct {
+	disableAggregation  bool
+	aggregateHistograms bool
+	sampleRate          float64
+	queueSize           int
+	overflow            OverflowPolicy
+	maxPacketSize       int
+	appendEncoder       AppendEncoder
+	selfMetrics         Tags
+	gracePeriod         time.Duration
+}
+
+// WithoutAggregation returns an option that disables the client-side aggregation
+// of counters and gauges, so every observation is published as a separate line.
+func WithoutAggregation() PublisherOption {
+	return func(o *publisherOptions) {
+		o.disableAggregation = true
+	}
+}
+
+// WithHistogramAggregation returns an option that aggregates the samples of the histograms and
+// timers in memory per name and tags, and publishes a summary of every series on every flush
+// instead of every sample, for the backends that don't aggregate distributions themselves.
+//
+// The summary of a series are the gauges of its count, min, max, mean, p50, p90 and p99
+// in the flush interval, named after the metric with the .count, .min, .max, .mean, .p50,
+// .p90 and .p99 suffixes. The percentiles are estimated with a relative error of 1%.
+func WithHistogramAggregation() PublisherOption {
+	return func(o *publisherOptions) {
+		o.aggregateHistograms = true
+	}
+}
+
+// WithSampleRate returns an option that sets the sample rate of the metrics that
+// don't declare their own with WithSampleRate.
+func WithSampleRate(rate float64) PublisherOption {
+	return func(o *publisherOptions) {
+		o.sampleRate = rate
+	}
+}
+
+// WithQueueSize returns an option that sets the number of encoded observations
+// that can be waiting to be written by the publisher. Sizes that are not positive
+// are ignored, the queue keeps its default size.
+func WithQueueSize(size int) PublisherOption {
+	return func(o *publisherOptions) {
+		o.queueSize = size
+	}
+}
+
+// WithOverflowPolicy returns an option that sets what to do with new observations when the queue is full.
+func WithOverflowPolicy(policy OverflowPolicy) PublisherOption {
+	return func(o *publisherOptions) {
+		o.overflow = policy
+	}
+}
+
+// WithMaxPacketSize returns an option that sets the maximum size, in bytes, of every
+// write of the publisher. Encoded observations are never split across writes, so an
+// observation larger than the maximum size is written on its own.
+func WithMaxPacketSize(size int) PublisherOption {
+	return func(o *publisherOptions) {
+		o.maxPacketSize = size
+	}
+}
+
+// WithAppendEncoder returns an option that sets an AppendEncoder that is used instead of the
+// Encoder of the publisher, so observations are encoded into reusable buffers.
+func WithAppendEncoder(e AppendEncoder) PublisherOption {
+	return func(o *publisherOptions) {
+		o.appendEncoder = e
+	}
+}
+
+// WithShutdownGracePeriod returns an option that sets how long Run keeps publishing,
+// at most, after its context is cancelled.
+func WithShutdownGracePeriod(d time.Duration) PublisherOption {
+	return func(o *publisherOptions) {
+		o.gracePeriod = d
+	}
+}
+
+// WithSelfMetrics returns an option that makes the publisher report its own stats, see Stats,
+// as metrics under the bsk.metrics namespace with the given tags on every flush.
+func WithSelfMetrics(tags ...Tag) PublisherOption {
+	return func(o *publisherOptions) {
+		o.selfMetrics = append(Tags{}, tags...)
+	}
+}
+
+// NewPublisher creates a new metrics publisher.
+//
+// By default counters (summed) and gauges (last value) are aggregated in memory
+// per name and tags, and published once per flush. Use WithoutAggregation to
+// publish every observation as it happens, and WithHistogramAggregation to summarize
+// histograms and timers too.
+//
+// Observations are queued until they are written by Run. When the queue is full
+// new observations are dropped, so an outage of the metrics pipeline never stalls
+// the callers, and the number of dropped observations is reported to the error
+// handler as a DroppedMetricsError. See WithQueueSize and WithOverflowPolicy.
+//
+// When the context of Run is cancelled, the publisher keeps publishing the
+// observations made during the shutdown of the application until there are no
+// new ones or the grace period is over, see WithShutdownGracePeriod.
+//
+// Observations are encoded into pooled buffers, and the series of every metric,
+// including the ones returned by WithTag, WithTags and WithSampleRate, is rendered
+// only once, so using an AppendEncoder, see WithAppendEncoder, counters and gauges
+// are published without allocating.
+func NewPublisher(w io.Writer, e Encoder, flushInterval time.Duration, errorHandler ErrorHandler, opts ...PublisherOption) *Publisher {
+	options := &publisherOptions{queueSize: queueSize, maxPacketSize: maxPacketSize, gracePeriod: shutdownGracePeriod}
+	for _, o := range opts {
+		o(options)
+	}
+
+	// an unbuffered queue would make dropping the oldest observation spin forever
+	if options.queueSize <= 0 {
+		options.queueSize = queueSize
+	}
+
 	if errorHandler == nil {
 		errorHandler = DiscardErrors
 	}
 
-	return &Publisher{
-		queue:      make(chan string),
+	p := &Publisher{
+		queue:      make(chan *[]byte, options.queueSize),
+		overflow:   options.overflow,
 		forceFlush: make(chan struct{}),
 
 		writer:        w,
 		encoder:       e,
+		appendEncoder: options.appendEncoder,
 		flushInterval: flushInterval,
+		gracePeriod:   options.gracePeriod,
 		errorHandler:  errorHandler,
+		sampleRate:    sampleRate(options.sampleRate),
+		maxPacketSize: options.maxPacketSize,
+		selfMetrics:   options.selfMetrics,
+	}
+
+	if !options.disableAggregation {
+		p.aggregator = newAggregator()
+	}
+
+	if options.aggregateHistograms {
+		p.histograms = newHistogramAggregator()
 	}
+
+	return p
 }
 
 // NewDiscardAll returns a concrete publisher instance that discards all
@@ -65,10 +281,12 @@ func NewStdout(flushEvery time.Duration, errorHandler ErrorHandler) *Publisher {
 type DatadogOption func(*datadogOptions)
 
 type datadogOptions struct {
-	host          string
-	port          string
-	unixAddress   string
-	flushInterval time.Duration
+	host             string
+	port             string
+	unixAddress      string
+	lazyConnection   bool
+	flushInterval    time.Duration
+	publisherOptions []PublisherOption
 }
 
 // WithDDHost returns an option that sets a datadog host
@@ -92,6 +310,18 @@ func WithDDUnixAddress(a string) DatadogOption {
 	}
 }
 
+// WithDDLazyConnection returns an option that makes a Unix Domain Sockets publisher connect to the
+// agent in the background, retrying until the socket is available and again after a failed write,
+// so the application doesn't depend on the agent being ready when it starts. Metrics written while
+// the publisher is not connected are dropped, and ErrNotConnected is reported to the error handler.
+// It starts dialing when its Run starts, and the connection is closed, and the publisher stops
+// dialing, when its Run returns, so the publisher cannot be run again.
+func WithDDLazyConnection() DatadogOption {
+	return func(o *datadogOptions) {
+		o.lazyConnection = true
+	}
+}
+
 // WithDDFlushInterval returns an option that sets the datadog flush interval
 func WithDDFlushInterval(i time.Duration) DatadogOption {
 	return func(o *datadogOptions) {
@@ -99,8 +329,26 @@ func WithDDFlushInterval(i time.Duration) DatadogOption {
 	}
 }
 
+// WithDDPublisherOptions returns an option that sets the options of the underlying publisher
+func WithDDPublisherOptions(opts ...PublisherOption) DatadogOption {
+	return func(o *datadogOptions) {
+		o.publisherOptions = append(o.publisherOptions, opts...)
+	}
+}
+
 // NewDataDog returns a publisher that sends the metrics to the datadog agent.
+// It panics if the address of the agent cannot be resolved, see DialDataDog.
 func NewDataDog(opts ...DatadogOption) *Publisher {
+	p, err := DialDataDog(opts...)
+	if err != nil {
+		panic(err.Error())
+	}
+	return p
+}
+
+// DialDataDog returns a publisher that sends the metrics to the datadog agent, or an
+// error if the address of the agent cannot be resolved.
+func DialDataDog(opts ...DatadogOption) (*Publisher, error) {
 	options := &datadogOptions{}
 	for _, o := range opts {
 		o(options)
@@ -118,23 +366,37 @@ func NewDataDog(opts ...DatadogOption) *Publisher {
 		options.flushInterval = datadogFlush
 	}
 
-	url := fmt.Sprintf("%s:%s", options.host, options.port)
+	url := net.JoinHostPort(options.host, options.port)
 
 	addr, err := net.ResolveUDPAddr("udp", url)
 	if err != nil {
-		panic(fmt.Sprintf("cannot resolve UDP addr `%s`: `%s`", url, err))
+		return nil, fmt.Errorf("cannot resolve UDP addr `%s`: `%w`", url, err)
 	}
 
 	client, err := net.DialUDP("udp", nil, addr)
 	if err != nil {
-		panic(fmt.Sprintf("cannot create UDP client: `%s`", err.Error()))
+		return nil, fmt.Errorf("cannot create UDP client: `%w`", err)
 	}
 
-	return NewPublisher(client, StatsDEncoder, options.flushInterval, nil)
+	publisherOptions := append([]PublisherOption{WithAppendEncoder(AppendStatsDEncoder)}, options.publisherOptions...)
+
+	return NewPublisher(client, StatsDEncoder, options.flushInterval, nil, publisherOptions...), nil
 }
 
-// NewDataDogUnix returns a publisher that sends the metrics to the datadog agent via Unix Domain Sockets
+// NewDataDogUnix returns a publisher that sends the metrics to the datadog agent via Unix Domain Sockets.
+// It panics if it cannot connect to the agent, see DialDataDogUnix and WithDDLazyConnection.
 func NewDataDogUnix(opts ...DatadogOption) *Publisher {
+	p, err := DialDataDogUnix(opts...)
+	if err != nil {
+		panic(err.Error())
+	}
+	return p
+}
+
+// DialDataDogUnix returns a publisher that sends the metrics to the datadog agent via Unix Domain
+// Sockets, or an error if it cannot connect to the agent. With the WithDDLazyConnection option it
+// connects in the background when it runs instead, and it never fails.
+func DialDataDogUnix(opts ...DatadogOption) (*Publisher, error) {
 	options := &datadogOptions{}
 	for _, o := range opts {
 		o(options)
@@ -148,12 +410,31 @@ func NewDataDogUnix(opts ...DatadogOption) *Publisher {
 		options.flushInterval = datadogFlush
 	}
 
-	conn, err := net.Dial("unixgram", options.unixAddress)
-	if err != nil {
-		panic(fmt.Sprintf("cannot create Unix client: `%s`", err.Error()))
+	var w io.Writer
+	var rw *reconnectingWriter
+	if options.lazyConnection {
+		rw = newReconnectingWriter("unixgram", options.unixAddress, datadogRedialInterval)
+		w = rw
+	} else {
+		conn, err := net.Dial("unixgram", options.unixAddress)
+		if err != nil {
+			return nil, fmt.Errorf("cannot create Unix client: `%w`", err)
+		}
+		w = conn
 	}
 
-	return NewPublisher(conn, StatsDEncoder, options.flushInterval, nil)
+	publisherOptions := append([]PublisherOption{
+		WithMaxPacketSize(datadogUnixMaxPacketSize),
+		WithAppendEncoder(AppendStatsDEncoder),
+	}, options.publisherOptions...)
+
+	p := NewPublisher(w, StatsDEncoder, options.flushInterval, nil, publisherOptions...)
+	if rw != nil {
+		// dial when the publisher runs and stop dialing when it stops
+		p.owned = rw
+	}
+
+	return p, nil
 }
 
 // NewDataDogLambda returns a publisher that satisfies DataDog metrics writing for AWS Lambda.
@@ -165,86 +446,381 @@ func NewDataDogLambda() *Publisher {
 
 // Counter returns a new counter with the provided name and tags
 func (p *Publisher) Counter(name string, tags ...Tag) Counter {
-	return &publisherCounter{publisherMetric{name: name, tags: tags, nf: p.notify}}
+	return &publisherCounter{publisherMetric{name: name, tags: tags, nf: p.notify, publisher: p, rendered: &renderedTags{}}}
 }
 
 // Gauge returns a new Gauge with the provided name and tags
 func (p *Publisher) Gauge(name string, tags ...Tag) Gauge {
-	return &publisherGauge{publisherMetric{name: name, tags: tags, nf: p.notify}}
+	return &publisherGauge{publisherMetric{name: name, tags: tags, nf: p.notify, publisher: p, rendered: &renderedTags{}}}
 }
 
 // Event returns a new Event with the provided title and tags
 func (p *Publisher) Event(title string, tags ...Tag) Event {
-	return &publisherEvent{publisherMetric{name: title, tags: tags, nf: p.notify}}
+	return &publisherEvent{publisherMetric: publisherMetric{name: title, tags: tags, nf: p.notify, publisher: p, rendered: &renderedTags{}}}
 }
 
 // Timer returns a new Timer with the provided name and tags
 func (p *Publisher) Timer(name string, tags ...Tag) Timer {
-	return &timerEvent{publisherMetric: publisherMetric{name: name, tags: tags, nf: p.notify}}
+	return &timerEvent{publisherMetric: publisherMetric{name: name, tags: tags, nf: p.notify, publisher: p, rendered: &renderedTags{}}}
 }
 
 // Histogram returns a new Histogram with the provided name and tags
 func (p *Publisher) Histogram(name string, tags ...Tag) Histogram {
-	return &publisherHistogram{publisherMetric{name: name, tags: tags, nf: p.notify}}
+	return &publisherHistogram{publisherMetric{name: name, tags: tags, nf: p.notify, publisher: p, rendered: &renderedTags{}}}
+}
+
+// Distribution returns a new Distribution with the provided name and tags
+func (p *Publisher) Distribution(name string, tags ...Tag) Distribution {
+	return &publisherDistribution{publisherMetric{name: name, tags: tags, nf: p.notify, publisher: p, rendered: &renderedTags{}}}
+}
+
+// Set returns a new Set with the provided name and tags
+func (p *Publisher) Set(name string, tags ...Tag) Set {
+	return &publisherSet{publisherMetric{name: name, tags: tags, nf: p.notify, publisher: p, rendered: &renderedTags{}}}
+}
+
+// ServiceCheck returns a new ServiceCheck with the provided name and tags
+func (p *Publisher) ServiceCheck(name string, tags ...Tag) ServiceCheck {
+	return &publisherServiceCheck{publisherMetric: publisherMetric{name: name, tags: tags, nf: p.notify, publisher: p, rendered: &renderedTags{}}}
+}
+
+// Flush forces the flush of the publisher. It returns ErrPublisherNotRunning when
+// Run is not running, or the error of the context if it is done before Run can flush.
+func (p *Publisher) Flush(ctx context.Context) error {
+	done := p.running()
+	if done == nil {
+		return ErrPublisherNotRunning
+	}
+
+	select {
+	case p.forceFlush <- struct{}{}:
+		return nil
+	case <-done:
+		return ErrPublisherNotRunning
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// running returns the channel closed when Run returns, or nil when Run is not running
+func (p *Publisher) running() chan struct{} {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.done == nil {
+		return nil
+	}
+
+	select {
+	case <-p.done:
+		return nil
+	default:
+		return p.done
+	}
 }
 
-// Flush forces the flush of the publisher
-func (p *Publisher) Flush() {
-	p.forceFlush <- struct{}{}
+// stopped returns a channel that is closed once Run has returned, it is nil when
+// Run never ran, so a publisher that is not started yet waits for Run
+func (p *Publisher) stopped() chan struct{} {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.done
+}
+
+func (p *Publisher) notify(op Op, name string, value interface{}, tags Tags, rate float64) {
+	p.observe(op, name, value, tags, rate, nil)
 }
 
-func (p *Publisher) notify(op Op, name string, value interface{}, tags Tags) {
-	code, err := p.encoder(name, op, value, tags, 1)
+// observe publishes the observation, the rendered tags are nil when they are not cached
+func (p *Publisher) observe(op Op, name string, value interface{}, tags Tags, rate float64, rendered *renderedTags) {
+	if rate == 0 {
+		rate = p.sampleRate
+	}
+	rate = sampleRate(rate)
+	if rate < 1 && rand.Float64() >= rate {
+		return
+	}
+	atomic.AddUint64(&p.stats.observed, 1)
+
+	if p.aggregator != nil && p.aggregator.aggregate(op, name, value, tags, rate, rendered) {
+		return
+	}
+
+	if p.histograms != nil && p.histograms.aggregate(op, name, value, tags, rate, rendered) {
+		return
+	}
+
+	b := bufferPool.Get().(*[]byte)
+	var err error
+	*b, err = p.encode((*b)[:0], name, op, value, tags, rate)
 	if err != nil {
 		p.errorHandler(err)
+		putBuffer(b)
+		return
+	}
+
+	p.enqueue(b)
+}
+
+// encode appends the encoded observation to dst, using the AppendEncoder if there is one
+func (p *Publisher) encode(dst []byte, name string, op Op, value interface{}, tags Tags, rate float64) ([]byte, error) {
+	if p.appendEncoder != nil {
+		return p.appendEncoder(dst, name, op, value, tags, rate)
 	}
 
-	p.queue <- code
+	code, err := p.encoder(name, op, value, tags, rate)
+	return append(dst, code...), err
+}
+
+func putBuffer(b *[]byte) {
+	if cap(*b) <= maxPooledBufferSize {
+		bufferPool.Put(b)
+	}
+}
+
+func (p *Publisher) enqueue(b *[]byte) {
+	switch p.overflow {
+	case OverflowBlock:
+		select {
+		case p.queue <- b:
+		default:
+			// wait for Run, unless it has returned and nobody is going to empty the queue
+			select {
+			case p.queue <- b:
+			case <-p.stopped():
+				putBuffer(b)
+				p.drop()
+				return
+			}
+		}
+		atomic.AddUint64(&p.stats.enqueued, 1)
+		return
+	case OverflowDropOldest:
+		for {
+			select {
+			case p.queue <- b:
+				atomic.AddUint64(&p.stats.enqueued, 1)
+				return
+			default:
+			}
+
+			select {
+			case old := <-p.queue:
+				putBuffer(old)
+				p.drop()
+			default:
+			}
+		}
+	default:
+		select {
+		case p.queue <- b:
+			atomic.AddUint64(&p.stats.enqueued, 1)
+		default:
+			putBuffer(b)
+			p.drop()
+		}
+	}
+}
+
+func (p *Publisher) drop() {
+	atomic.AddUint64(&p.dropped, 1)
+	atomic.AddUint64(&p.stats.dropped, 1)
+}
+
+// Dropped returns the number of observations dropped because the queue was full
+// that have not been reported to the error handler yet.
+func (p *Publisher) Dropped() uint64 {
+	return atomic.LoadUint64(&p.dropped)
 }
 
 // Run makes the publisher a contextx.Runner
 func (p *Publisher) Run(ctx context.Context) {
+	done := make(chan struct{})
+	p.mu.Lock()
+	p.done = done
+	p.mu.Unlock()
+	defer close(done)
+
+	p.stats.start(time.Now())
+	defer p.stats.stop()
+
+	if p.owned != nil {
+		p.owned.connect()
+		defer p.closeWriter()
+	}
+
 	ticker := time.NewTicker(p.flushInterval)
 	defer ticker.Stop()
 
 	buf := &bytes.Buffer{}
-	defer p.flush(buf)
 
 	for {
 		select {
-		case cmd := <-p.queue:
-			// we don't care if errors, this is fire and forget
-			_, _ = buf.WriteString(cmd)
-
-			if buf.Len() >= bufferSize {
-				p.flush(buf)
-			}
+		case b := <-p.queue:
+			p.write(buf, *b)
+			putBuffer(b)
 
 		case <-ticker.C:
-			p.flush(buf)
+			p.flushAll(buf)
 
 		case <-p.forceFlush:
-			p.flush(buf)
+			p.flushAll(buf)
 
 		case <-ctx.Done():
+			p.drain(buf)
+			return
+		}
+	}
+}
+
+// drain keeps publishing after the cancellation of Run until no observations
+// have been made for a while or the grace period is over, so the observations
+// made by the application while shutting down are not lost.
+func (p *Publisher) drain(buf *bytes.Buffer) {
+	defer p.flushAll(buf)
+
+	deadline := time.NewTimer(p.gracePeriod)
+	defer deadline.Stop()
+
+	idle := time.NewTicker(drainIdleInterval)
+	defer idle.Stop()
+
+	observed := atomic.LoadUint64(&p.stats.observed)
+	for {
+		select {
+		case b := <-p.queue:
+			p.write(buf, *b)
+			putBuffer(b)
+
+		case <-p.forceFlush:
+			p.flushAll(buf)
+
+		case <-idle.C:
+			last := observed
+			observed = atomic.LoadUint64(&p.stats.observed)
+			if observed == last && len(p.queue) == 0 {
+				return
+			}
+
+		case <-deadline.C:
+			return
+		}
+	}
+}
+
+// closeWriter closes the writer owned by the publisher, once everything has been written
+func (p *Publisher) closeWriter() {
+	if err := p.owned.Close(); err != nil {
+		p.errorHandler(err)
+	}
+}
+
+// flushAll writes everything pending, queued or aggregated, and reports the dropped observations
+func (p *Publisher) flushAll(buf *bytes.Buffer) {
+	p.writeQueued(buf)
+	p.writeAggregated(buf)
+	p.writeSelfMetrics(buf)
+	p.flush(buf)
+	p.stats.flushed(time.Now())
+
+	if dropped := atomic.SwapUint64(&p.dropped, 0); dropped > 0 {
+		p.errorHandler(&DroppedMetricsError{Count: dropped})
+	}
+}
+
+// writeQueued writes the observations already in the queue, without waiting for new ones
+func (p *Publisher) writeQueued(buf *bytes.Buffer) {
+	for n := len(p.queue); n > 0; n-- {
+		select {
+		case b := <-p.queue:
+			p.write(buf, *b)
+			putBuffer(b)
+		default:
 			return
 		}
 	}
 }
 
+// write packs the encoded observation in the buffer, flushing it before when the
+// observation doesn't fit, so observations are never split across packets.
+func (p *Publisher) write(buf *bytes.Buffer, line []byte) {
+	if buf.Len() > 0 && buf.Len()+len(line) > p.maxPacketSize {
+		p.flush(buf)
+	}
+
+	// we don't care if errors, this is fire and forget
+	_, _ = buf.Write(line)
+
+	if buf.Len() >= p.maxPacketSize {
+		p.flush(buf)
+	}
+}
+
+// writeAggregated encodes the aggregated series, if any, into the buffer
+func (p *Publisher) writeAggregated(buf *bytes.Buffer) {
+	var aggregated []*series
+	if p.aggregator != nil {
+		aggregated = p.aggregator.drain()
+	}
+	if p.histograms != nil {
+		aggregated = append(aggregated, p.histograms.drain()...)
+	}
+
+	if len(aggregated) == 0 {
+		return
+	}
+
+	b := bufferPool.Get().(*[]byte)
+	defer putBuffer(b)
+
+	for _, s := range aggregated {
+		var err error
+		*b, err = p.encode((*b)[:0], s.name, s.op, s.value, s.tags, s.rate)
+		if err != nil {
+			p.errorHandler(err)
+			continue
+		}
+		p.write(buf, *b)
+	}
+}
+
 func (p *Publisher) flush(w io.WriterTo) {
-	_, err := w.WriteTo(p.writer)
+	n, err := w.WriteTo(p.writer)
+	p.stats.written(n, err)
 	if err != nil {
 		p.errorHandler(err)
 	}
 }
 
+// sampleRate returns the given rate, or 1 if it is out of the (0, 1] interval
+func sampleRate(rate float64) float64 {
+	if rate <= 0 || rate > 1 {
+		return 1
+	}
+	return rate
+}
+
 // publisherMetric is the parent struct with the common fields
 // fields and methods for the rest of metrics.
 type publisherMetric struct {
 	name string
-	tags Tags
+	tags Tags // clipped before appending, the derived metrics never share their backing array
+	rate float64
 	nf   NotifyFunc
+
+	// publisher is only set for the metrics of a Publisher, whose series is cached in
+	// rendered, a new one is assigned when the tags or the sample rate change
+	publisher *Publisher
+	rendered  *renderedTags
+}
+
+func (m publisherMetric) notify(op Op, value interface{}) {
+	if m.publisher != nil {
+		m.publisher.observe(op, m.name, value, m.tags, m.rate, m.rendered)
+		return
+	}
+	m.nf(op, m.name, value, m.tags, m.rate)
 }
 
 func (m publisherMetric) Name() string {
@@ -260,7 +836,7 @@ type publisherCounter struct {
 }
 
 func (c publisherCounter) Add(delta uint64) {
-	c.nf(OpCounterAdd, c.name, delta, c.tags)
+	c.notify(OpCounterAdd, delta)
 }
 
 func (c publisherCounter) Inc() {
@@ -268,14 +844,20 @@ func (c publisherCounter) Inc() {
 }
 
 func (c publisherCounter) WithTags(tags ...Tag) Counter {
-	for _, tag := range tags {
-		c.tags = append(c.tags, tag)
-	}
+	c.tags = append(c.tags[:len(c.tags):len(c.tags)], tags...)
+	c.rendered = &renderedTags{}
 	return c
 }
 
 func (c publisherCounter) WithTag(key string, value interface{}) Counter {
-	c.tags = append(c.tags, NewTag(key, value))
+	c.tags = append(c.tags[:len(c.tags):len(c.tags)], NewTag(key, value))
+	c.rendered = &renderedTags{}
+	return c
+}
+
+func (c publisherCounter) WithSampleRate(rate float64) Counter {
+	c.rate = rate
+	c.rendered = &renderedTags{}
 	return c
 }
 
@@ -284,42 +866,57 @@ type publisherGauge struct {
 }
 
 func (g publisherGauge) Update(value interface{}) {
-	g.nf(OpGaugeUpdate, g.name, value, g.tags)
+	g.notify(OpGaugeUpdate, value)
 }
 
 func (g publisherGauge) WithTags(tags ...Tag) Gauge {
-	for _, tag := range tags {
-		g.tags = append(g.tags, tag)
-	}
+	g.tags = append(g.tags[:len(g.tags):len(g.tags)], tags...)
+	g.rendered = &renderedTags{}
 	return g
 }
 
 func (g publisherGauge) WithTag(key string, value interface{}) Gauge {
-	g.tags = append(g.tags, NewTag(key, value))
+	g.tags = append(g.tags[:len(g.tags):len(g.tags)], NewTag(key, value))
+	g.rendered = &renderedTags{}
+	return g
+}
+
+func (g publisherGauge) WithSampleRate(rate float64) Gauge {
+	g.rate = rate
+	g.rendered = &renderedTags{}
 	return g
 }
 
 type publisherEvent struct {
 	publisherMetric
+	value EventValue
 }
 
 func (e publisherEvent) Send() {
-	e.nf(OpEventSend, e.name, "", e.tags)
+	e.SendWithText("")
 }
 
 func (e publisherEvent) SendWithText(text string) {
-	e.nf(OpEventSend, e.name, text, e.tags)
+	e.value.Text = text
+	e.notify(OpEventSend, e.value)
 }
 
-func (e publisherEvent) WithTags(tags ...Tag) Event {
-	for _, tag := range tags {
-		e.tags = append(e.tags, tag)
+func (e publisherEvent) WithOptions(opts ...EventOption) Event {
+	for _, o := range opts {
+		o(&e.value)
 	}
 	return e
 }
 
+func (e publisherEvent) WithTags(tags ...Tag) Event {
+	e.tags = append(e.tags[:len(e.tags):len(e.tags)], tags...)
+	e.rendered = &renderedTags{}
+	return e
+}
+
 func (e publisherEvent) WithTag(key string, value interface{}) Event {
-	e.tags = append(e.tags, NewTag(key, value))
+	e.tags = append(e.tags[:len(e.tags):len(e.tags)], NewTag(key, value))
+	e.rendered = &renderedTags{}
 	return e
 }
 
@@ -334,21 +931,41 @@ func (e *timerEvent) Start() {
 
 func (e *timerEvent) Stop() {
 	if !e.startedTime.IsZero() {
-		durationInMs := float64(time.Since(e.startedTime).Nanoseconds()) * 1e-6
-		e.nf(OpTimerStop, e.name, durationInMs, e.tags)
+		e.Record(time.Since(e.startedTime))
 		e.startedTime = time.Time{}
 	}
 }
 
+func (e *timerEvent) Record(d time.Duration) {
+	durationInMs := float64(d.Nanoseconds()) * 1e-6
+	e.notify(OpTimerStop, durationInMs)
+}
+
+func (e *timerEvent) Time(f func()) {
+	started := time.Now()
+	f()
+	e.Record(time.Since(started))
+}
+
+func (e *timerEvent) StartStopwatch() *Stopwatch {
+	return NewStopwatch(e)
+}
+
 func (e *timerEvent) WithTags(tags ...Tag) Timer {
-	for _, tag := range tags {
-		e.tags = append(e.tags, tag)
-	}
+	e.tags = append(e.tags[:len(e.tags):len(e.tags)], tags...)
+	e.rendered = &renderedTags{}
 	return e
 }
 
 func (e *timerEvent) WithTag(key string, value interface{}) Timer {
-	e.tags = append(e.tags, NewTag(key, value))
+	e.tags = append(e.tags[:len(e.tags):len(e.tags)], NewTag(key, value))
+	e.rendered = &renderedTags{}
+	return e
+}
+
+func (e *timerEvent) WithSampleRate(rate float64) Timer {
+	e.rate = rate
+	e.rendered = &renderedTags{}
 	return e
 }
 
@@ -357,17 +974,106 @@ type publisherHistogram struct {
 }
 
 func (h *publisherHistogram) AddValue(value uint64) {
-	h.nf(OpHistogramUpdate, h.name, value, h.tags)
+	h.notify(OpHistogramUpdate, value)
 }
 
 func (h *publisherHistogram) WithTags(tags ...Tag) Histogram {
-	for _, tag := range tags {
-		h.tags = append(h.tags, tag)
-	}
+	h.tags = append(h.tags[:len(h.tags):len(h.tags)], tags...)
+	h.rendered = &renderedTags{}
 	return h
 }
 
 func (h *publisherHistogram) WithTag(key string, value interface{}) Histogram {
-	h.tags = append(h.tags, NewTag(key, value))
+	h.tags = append(h.tags[:len(h.tags):len(h.tags)], NewTag(key, value))
+	h.rendered = &renderedTags{}
+	return h
+}
+
+func (h *publisherHistogram) WithSampleRate(rate float64) Histogram {
+	h.rate = rate
+	h.rendered = &renderedTags{}
 	return h
 }
+
+type publisherDistribution struct {
+	publisherMetric
+}
+
+func (d *publisherDistribution) AddValue(value float64) {
+	d.notify(OpDistributionUpdate, value)
+}
+
+func (d *publisherDistribution) WithTags(tags ...Tag) Distribution {
+	d.tags = append(d.tags[:len(d.tags):len(d.tags)], tags...)
+	d.rendered = &renderedTags{}
+	return d
+}
+
+func (d *publisherDistribution) WithTag(key string, value interface{}) Distribution {
+	d.tags = append(d.tags[:len(d.tags):len(d.tags)], NewTag(key, value))
+	d.rendered = &renderedTags{}
+	return d
+}
+
+func (d *publisherDistribution) WithSampleRate(rate float64) Distribution {
+	d.rate = rate
+	d.rendered = &renderedTags{}
+	return d
+}
+
+type publisherSet struct {
+	publisherMetric
+}
+
+func (s *publisherSet) Add(value interface{}) {
+	s.notify(OpSetAdd, value)
+}
+
+func (s *publisherSet) WithTags(tags ...Tag) Set {
+	s.tags = append(s.tags[:len(s.tags):len(s.tags)], tags...)
+	s.rendered = &renderedTags{}
+	return s
+}
+
+func (s *publisherSet) WithTag(key string, value interface{}) Set {
+	s.tags = append(s.tags[:len(s.tags):len(s.tags)], NewTag(key, value))
+	s.rendered = &renderedTags{}
+	return s
+}
+
+type publisherServiceCheck struct {
+	publisherMetric
+	hostname  string
+	timestamp time.Time
+}
+
+func (c publisherServiceCheck) Send(status ServiceCheckStatus) {
+	c.SendWithMessage(status, "")
+}
+
+func (c publisherServiceCheck) SendWithMessage(status ServiceCheckStatus, message string) {
+	value := ServiceCheckValue{Status: status, Hostname: c.hostname, Timestamp: c.timestamp, Message: message}
+	c.notify(OpServiceCheckSend, value)
+}
+
+func (c publisherServiceCheck) WithHostname(hostname string) ServiceCheck {
+	c.hostname = hostname
+	return c
+}
+
+func (c publisherServiceCheck) WithTimestamp(t time.Time) ServiceCheck {
+	c.timestamp = t
+	return c
+}
+
+func (c publisherServiceCheck) WithTags(tags ...Tag) ServiceCheck {
+	c.tags = append(c.tags[:len(c.tags):len(c.tags)], tags...)
+	c.rendered = &renderedTags{}
+	return c
+}
+
+func (c publisherServiceCheck) WithTag(key string, value interface{}) ServiceCheck {
+	c.tags = append(c.tags[:len(c.tags):len(c.tags)], NewTag(key, value))
+	c.rendered = &renderedTags{}
+	return c
+}
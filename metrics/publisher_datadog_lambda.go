@@ -9,7 +9,7 @@ import (
 //
 // All metrics reported will be submitted as distribution metrics (https://docs.datadoghq.com/metrics/distributions/).
 //
-// Submitting events is not supported.
+// Submitting events, sets and service checks is not supported.
 //
 // Callers will typically pass `ddlambda.Metric` in the `f` argument of the constructor. The func type is introduced to avoid adding a dependency with the DataDog library.
 //
@@ -43,7 +43,7 @@ func (p *dataDogLambdaPublisher) Gauge(name string, tags ...Tag) Gauge {
 // Event returns a new Event with the provided title and tags
 // Sending events is not supported, a no-op implementation is provided for compatibility
 func (p *dataDogLambdaPublisher) Event(title string, tags ...Tag) Event {
-	return &publisherEvent{publisherMetric{name: title, tags: tags, nf: p.notify}}
+	return &publisherEvent{publisherMetric: publisherMetric{name: title, tags: tags, nf: p.notify}}
 }
 
 // Timer returns a new Timer with the provided name and tags
@@ -56,12 +56,40 @@ func (p *dataDogLambdaPublisher) Histogram(name string, tags ...Tag) Histogram {
 	return &publisherHistogram{publisherMetric{name: name, tags: tags, nf: p.notify}}
 }
 
-func (p *dataDogLambdaPublisher) notify(op Op, name string, value interface{}, tags Tags) {
+// Distribution returns a new Distribution with the provided name and tags
+func (p *dataDogLambdaPublisher) Distribution(name string, tags ...Tag) Distribution {
+	return &publisherDistribution{publisherMetric{name: name, tags: tags, nf: p.notify}}
+}
+
+// Set returns a new Set with the provided name and tags
+// Sets are not supported, a no-op implementation is provided for compatibility
+func (p *dataDogLambdaPublisher) Set(name string, tags ...Tag) Set {
+	return &publisherSet{publisherMetric{name: name, tags: tags, nf: p.notify}}
+}
+
+// ServiceCheck returns a new ServiceCheck with the provided name and tags
+// Service checks are not supported, a no-op implementation is provided for compatibility
+func (p *dataDogLambdaPublisher) ServiceCheck(name string, tags ...Tag) ServiceCheck {
+	return &publisherServiceCheck{publisherMetric: publisherMetric{name: name, tags: tags, nf: p.notify}}
+}
+
+// notify ignores the sample rate, the DataDog Lambda library does not support it
+func (p *dataDogLambdaPublisher) notify(op Op, name string, value interface{}, tags Tags, _ float64) {
 	if op == OpEventSend {
 		p.eh(errors.New("sending event is not supported in the DataDog Lambda Publisher"))
 		return
 	}
 
+	if op == OpSetAdd {
+		p.eh(errors.New("sets are not supported in the DataDog Lambda Publisher"))
+		return
+	}
+
+	if op == OpServiceCheckSend {
+		p.eh(errors.New("service checks are not supported in the DataDog Lambda Publisher"))
+		return
+	}
+
 	v, err := valueAsFloat64(value)
 	if err != nil {
 		p.eh(fmt.Errorf("could not publish metric `%s`: %w", name, err))
@@ -71,3 +71,25 @@ func TestDataDogLambdaPublisher_Timer(t *testing.T) {
 	a.Contains(out, "request_duration: 0.0")
 	a.Contains(out, "[host:life project:bsk tfoo:tbar]")
 }
+
+func TestDataDogLambdaPublisher_Unsupported(t *testing.T) {
+	t.Parallel()
+	a := assert.New(t)
+
+	var errs []string
+	f := func(metric string, value float64, tags ...string) {
+		t.Fatal("no metric expected")
+	}
+	eh := func(e error) {
+		errs = append(errs, e.Error())
+	}
+
+	publisher := metrics.DataDogLambdaPublisher(f, eh)
+	publisher.Set("players").Add("alice")
+	publisher.ServiceCheck("database").Send(metrics.ServiceCheckOK)
+
+	a.Equal([]string{
+		"sets are not supported in the DataDog Lambda Publisher",
+		"service checks are not supported in the DataDog Lambda Publisher",
+	}, errs)
+}
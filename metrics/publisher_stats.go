@@ -0,0 +1,212 @@
+package metrics
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// self metrics of the publishers, see WithSelfMetrics
+const (
+	selfMetricEnqueued     = "bsk.metrics.enqueued"
+	selfMetricDropped      = "bsk.metrics.dropped"
+	selfMetricFlushes      = "bsk.metrics.flushes"
+	selfMetricBytesFlushed = "bsk.metrics.bytes_flushed"
+	selfMetricWriteErrors  = "bsk.metrics.write_errors"
+	selfMetricQueueLength  = "bsk.metrics.queue_length"
+)
+
+// PublisherStats are the stats of a Publisher since it was created, so the
+// health of the metrics pipeline can be monitored.
+type PublisherStats struct {
+	// Running is whether the Run method of the publisher is running
+	Running bool
+	// Enqueued is the number of encoded observations that have been queued to be written
+	Enqueued uint64
+	// Dropped is the number of observations dropped because the queue was full
+	Dropped uint64
+	// QueueLength is the number of encoded observations currently waiting in the queue
+	QueueLength int
+	// Flushes is the number of times the publisher has flushed its queued and aggregated observations
+	Flushes uint64
+	// BytesFlushed is the number of bytes successfully written to the writer
+	BytesFlushed uint64
+	// WriteErrors is the number of writes that failed
+	WriteErrors uint64
+	// LastFlush is the time of the last flush, zero if the publisher never flushed
+	LastFlush time.Time
+	// LastWriteError is the error of the last write, empty if it succeeded
+	LastWriteError string
+}
+
+// publisherStats holds the stats of a publisher, updated atomically
+type publisherStats struct {
+	observed     uint64 // including the aggregated ones
+	enqueued     uint64
+	dropped      uint64
+	flushes      uint64
+	bytesFlushed uint64
+	writeErrors  uint64
+	running      int32
+	started      int64 // unix nanoseconds
+	lastFlush    int64 // unix nanoseconds
+	lastError    atomic.Value
+
+	// reported are the stats reported as self metrics, only used by Run
+	reported PublisherStats
+}
+
+func (s *publisherStats) start(now time.Time) {
+	atomic.StoreInt64(&s.started, now.UnixNano())
+	atomic.StoreInt32(&s.running, 1)
+}
+
+func (s *publisherStats) stop() {
+	atomic.StoreInt32(&s.running, 0)
+}
+
+func (s *publisherStats) flushed(now time.Time) {
+	atomic.AddUint64(&s.flushes, 1)
+	atomic.StoreInt64(&s.lastFlush, now.UnixNano())
+}
+
+func (s *publisherStats) written(n int64, err error) {
+	atomic.AddUint64(&s.bytesFlushed, uint64(n))
+	if err != nil {
+		atomic.AddUint64(&s.writeErrors, 1)
+		s.lastError.Store(err.Error())
+		return
+	}
+	if n > 0 {
+		s.lastError.Store("")
+	}
+}
+
+// Stats returns the current stats of the publisher.
+func (p *Publisher) Stats() PublisherStats {
+	stats := PublisherStats{
+		Running:      atomic.LoadInt32(&p.stats.running) == 1,
+		Enqueued:     atomic.LoadUint64(&p.stats.enqueued),
+		Dropped:      atomic.LoadUint64(&p.stats.dropped),
+		QueueLength:  len(p.queue),
+		Flushes:      atomic.LoadUint64(&p.stats.flushes),
+		BytesFlushed: atomic.LoadUint64(&p.stats.bytesFlushed),
+		WriteErrors:  atomic.LoadUint64(&p.stats.writeErrors),
+	}
+
+	if lastFlush := atomic.LoadInt64(&p.stats.lastFlush); lastFlush != 0 {
+		stats.LastFlush = time.Unix(0, lastFlush)
+	}
+	if lastError, ok := p.stats.lastError.Load().(string); ok {
+		stats.LastWriteError = lastError
+	}
+
+	return stats
+}
+
+// Healthy returns whether the publisher is running, has flushed in the last two
+// flush intervals and its last write succeeded.
+func (p *Publisher) Healthy() bool {
+	return p.healthy(p.Stats(), time.Now())
+}
+
+func (p *Publisher) healthy(stats PublisherStats, now time.Time) bool {
+	if !stats.Running || stats.LastWriteError != "" {
+		return false
+	}
+
+	last := time.Unix(0, atomic.LoadInt64(&p.stats.started))
+	if stats.LastFlush.After(last) {
+		last = stats.LastFlush
+	}
+
+	return now.Sub(last) <= 2*p.flushInterval
+}
+
+// writeSelfMetrics encodes the stats that changed since the last flush into the buffer
+// when self metrics are enabled. They are not queued, so they never compete with the
+// observations of the application for room in the queue.
+func (p *Publisher) writeSelfMetrics(buf *bytes.Buffer) {
+	if p.selfMetrics == nil {
+		return
+	}
+
+	stats := p.Stats()
+	reported := p.stats.reported
+	p.stats.reported = stats
+
+	b := bufferPool.Get().(*[]byte)
+	defer putBuffer(b)
+
+	for _, m := range []struct {
+		name  string
+		op    Op
+		value interface{}
+	}{
+		{selfMetricEnqueued, OpCounterAdd, stats.Enqueued - reported.Enqueued},
+		{selfMetricDropped, OpCounterAdd, stats.Dropped - reported.Dropped},
+		{selfMetricFlushes, OpCounterAdd, stats.Flushes - reported.Flushes},
+		{selfMetricBytesFlushed, OpCounterAdd, stats.BytesFlushed - reported.BytesFlushed},
+		{selfMetricWriteErrors, OpCounterAdd, stats.WriteErrors - reported.WriteErrors},
+		{selfMetricQueueLength, OpGaugeUpdate, stats.QueueLength},
+	} {
+		var err error
+		*b, err = p.encode((*b)[:0], m.name, m.op, m.value, p.selfMetrics, 1)
+		if err != nil {
+			p.errorHandler(err)
+			continue
+		}
+		p.write(buf, *b)
+	}
+}
+
+// publisherStatsResponse is the body of the responses of the StatsHandler
+type publisherStatsResponse struct {
+	Healthy        bool       `json:"healthy"`
+	Running        bool       `json:"running"`
+	Enqueued       uint64     `json:"enqueued"`
+	Dropped        uint64     `json:"dropped"`
+	QueueLength    int        `json:"queue_length"`
+	Flushes        uint64     `json:"flushes"`
+	BytesFlushed   uint64     `json:"bytes_flushed"`
+	WriteErrors    uint64     `json:"write_errors"`
+	LastFlush      *time.Time `json:"last_flush,omitempty"`
+	LastWriteError string     `json:"last_write_error,omitempty"`
+}
+
+// StatsHandler returns an http.Handler that responds with the stats of the publisher in
+// JSON, with a 503 Service Unavailable status when the publisher is not healthy, see Healthy.
+// It can be mounted in any router, so the metrics pipeline can be probed and alerted on.
+func (p *Publisher) StatsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		stats := p.Stats()
+
+		resp := publisherStatsResponse{
+			Healthy:        p.healthy(stats, time.Now()),
+			Running:        stats.Running,
+			Enqueued:       stats.Enqueued,
+			Dropped:        stats.Dropped,
+			QueueLength:    stats.QueueLength,
+			Flushes:        stats.Flushes,
+			BytesFlushed:   stats.BytesFlushed,
+			WriteErrors:    stats.WriteErrors,
+			LastWriteError: stats.LastWriteError,
+		}
+		if !stats.LastFlush.IsZero() {
+			resp.LastFlush = &stats.LastFlush
+		}
+
+		status := http.StatusOK
+		if !resp.Healthy {
+			status = http.StatusServiceUnavailable
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			p.errorHandler(err)
+		}
+	})
+}
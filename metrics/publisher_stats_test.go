@@ -0,0 +1,142 @@
+package metrics_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/socialpoint-labs/bsk/metrics"
+)
+
+func TestPublisherStats(t *testing.T) {
+	a := assert.New(t)
+	rec := make(recorder)
+
+	publisher := metrics.NewPublisher(rec, metrics.StatsDEncoder, time.Hour, nil, metrics.WithoutAggregation())
+	a.False(publisher.Stats().Running)
+	a.False(publisher.Healthy())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go publisher.Run(ctx)
+	waitRunning(t, publisher)
+
+	publisher.Counter("counter").Inc()
+	publisher.Gauge("gauge").Update(1)
+	a.EqualValues(2, publisher.Stats().Enqueued)
+
+	a.NoError(publisher.Flush(context.Background()))
+	a.Equal("counter:1|c|@1.0000\ngauge:1|g|@1.0000\n", <-rec)
+
+	a.Eventually(func() bool { return publisher.Stats().Flushes == 1 }, time.Second, time.Millisecond)
+
+	stats := publisher.Stats()
+	a.True(stats.Running)
+	a.EqualValues(2, stats.Enqueued)
+	a.Zero(stats.Dropped)
+	a.Zero(stats.QueueLength)
+	a.EqualValues(len("counter:1|c|@1.0000\ngauge:1|g|@1.0000\n"), stats.BytesFlushed)
+	a.Zero(stats.WriteErrors)
+	a.WithinDuration(time.Now(), stats.LastFlush, time.Second)
+	a.Empty(stats.LastWriteError)
+	a.True(publisher.Healthy())
+
+	cancel()
+	a.Eventually(func() bool { return !publisher.Stats().Running }, time.Second, time.Millisecond)
+	a.False(publisher.Healthy())
+}
+
+func TestPublisherStatsWriteErrors(t *testing.T) {
+	a := assert.New(t)
+
+	publisher := metrics.NewPublisher(failingWriter{}, metrics.StatsDEncoder, time.Hour, nil)
+	go publisher.Run(context.Background())
+	waitRunning(t, publisher)
+
+	publisher.Counter("counter").Inc()
+	a.NoError(publisher.Flush(context.Background()))
+
+	a.Eventually(func() bool { return publisher.Stats().Flushes == 1 }, time.Second, time.Millisecond)
+
+	stats := publisher.Stats()
+	a.EqualValues(1, stats.WriteErrors)
+	a.Zero(stats.BytesFlushed)
+	a.Equal("broken pipe", stats.LastWriteError)
+	a.False(publisher.Healthy())
+}
+
+func TestPublisherWithSelfMetrics(t *testing.T) {
+	a := assert.New(t)
+	rec := make(recorder)
+
+	publisher := metrics.NewPublisher(rec, metrics.StatsDEncoder, time.Hour, nil,
+		metrics.WithoutAggregation(),
+		metrics.WithSelfMetrics(metrics.NewTag("app", "bsk")),
+	)
+	go publisher.Run(context.Background())
+	waitRunning(t, publisher)
+
+	publisher.Counter("counter").Inc()
+	a.NoError(publisher.Flush(context.Background()))
+
+	a.Equal("counter:1|c|@1.0000\n"+
+		"bsk.metrics.enqueued:1|c|@1.0000|#app:bsk\n"+
+		"bsk.metrics.dropped:0|c|@1.0000|#app:bsk\n"+
+		"bsk.metrics.flushes:0|c|@1.0000|#app:bsk\n"+
+		"bsk.metrics.bytes_flushed:0|c|@1.0000|#app:bsk\n"+
+		"bsk.metrics.write_errors:0|c|@1.0000|#app:bsk\n"+
+		"bsk.metrics.queue_length:0|g|@1.0000|#app:bsk\n", <-rec)
+
+	// the self metrics report the changes since the previous flush
+	a.NoError(publisher.Flush(context.Background()))
+	flushed := <-rec
+	a.Contains(flushed, "bsk.metrics.enqueued:0|c|@1.0000|#app:bsk\n")
+	a.Contains(flushed, "bsk.metrics.flushes:1|c|@1.0000|#app:bsk\n")
+	a.NotContains(flushed, "bsk.metrics.bytes_flushed:0|")
+}
+
+func TestPublisherStatsHandler(t *testing.T) {
+	a := assert.New(t)
+	rec := make(recorder)
+
+	publisher := metrics.NewPublisher(rec, metrics.StatsDEncoder, time.Hour, nil)
+	handler := publisher.StatsHandler()
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	a.Equal(http.StatusServiceUnavailable, w.Code)
+	a.Equal("application/json", w.Header().Get("Content-Type"))
+	a.JSONEq(`{"healthy":false,"running":false,"enqueued":0,"dropped":0,"queue_length":0,"flushes":0,"bytes_flushed":0,"write_errors":0}`, w.Body.String())
+
+	go publisher.Run(context.Background())
+	waitRunning(t, publisher)
+	publisher.Counter("counter").Inc()
+	a.NoError(publisher.Flush(context.Background()))
+	<-rec
+	a.Eventually(func() bool { return publisher.Stats().Flushes == 1 }, time.Second, time.Millisecond)
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	a.Equal(http.StatusOK, w.Code)
+
+	var body map[string]interface{}
+	a.NoError(json.NewDecoder(strings.NewReader(w.Body.String())).Decode(&body))
+	a.Equal(true, body["healthy"])
+	a.Equal(true, body["running"])
+	a.EqualValues(1, body["flushes"])
+	a.Contains(body, "last_flush")
+	a.NotContains(body, "last_write_error")
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) {
+	return 0, errors.New("broken pipe")
+}
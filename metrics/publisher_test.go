@@ -3,7 +3,11 @@ package metrics_test
 import (
 	"bufio"
 	"context"
+	"fmt"
+	"io"
 	"net"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
@@ -24,6 +28,7 @@ func TestPublisherForwardMetrics(t *testing.T) {
 
 	publisher := metrics.NewPublisher(rec, metrics.StatsDEncoder, metrics.FlushEvery3s, nil)
 	go publisher.Run(context.Background())
+	waitRunning(t, publisher)
 
 	counter := publisher.Counter("commands_executed", metrics.Tag{Key: "host", Value: "life"}, metrics.Tag{Key: "project", Value: "bsk"})
 	counter.Add(1)
@@ -32,13 +37,466 @@ func TestPublisherForwardMetrics(t *testing.T) {
 	gauge := publisher.Gauge("memory", metrics.Tag{Key: "host", Value: "life"}, metrics.Tag{Key: "project", Value: "bsk"})
 	gauge.WithTags(metrics.NewTag("gfoo", "gbar")).Update(100)
 
-	publisher.Flush()
+	a.NoError(publisher.Flush(context.Background()))
 
 	expected := "commands_executed:1|c|@1.0000|#host:life,project:bsk\ncommands_executed:1|c|@1.0000|#host:life,project:bsk,cfoo:cbar\nmemory:100|g|@1.0000|#host:life,project:bsk,gfoo:gbar\n"
 
 	a.Equal(expected, <-rec)
 }
 
+func TestPublisherWithAppendEncoder(t *testing.T) {
+	a := assert.New(t)
+	rec := make(recorder)
+
+	publisher := metrics.NewPublisher(rec, nil, metrics.FlushEvery3s, nil, metrics.WithAppendEncoder(metrics.AppendStatsDEncoder))
+	go publisher.Run(context.Background())
+	waitRunning(t, publisher)
+
+	counter := publisher.Counter("commands_executed", metrics.Tag{Key: "host", Value: "life"})
+	counter.Add(1)
+	counter.Inc()
+	counter.WithTag("foo", "bar").Inc()
+	publisher.Histogram("latency").AddValue(42)
+
+	a.NoError(publisher.Flush(context.Background()))
+
+	a.Equal("latency:42|h|@1.0000\ncommands_executed:2|c|@1.0000|#host:life\ncommands_executed:1|c|@1.0000|#host:life,foo:bar\n", <-rec)
+}
+
+func TestPublisherDerivedMetricsDoNotShareTags(t *testing.T) {
+	a := assert.New(t)
+	rec := make(recorder)
+
+	publisher := metrics.NewPublisher(rec, metrics.StatsDEncoder, time.Hour, nil, metrics.WithoutAggregation())
+	go publisher.Run(context.Background())
+	waitRunning(t, publisher)
+
+	// the base has room for one more tag, that the siblings must not share
+	base := publisher.Counter("c").WithTag("a", 1).WithTag("b", 2).WithTag("c", 3)
+	ok := base.WithTag("code", 200)
+	ko := base.WithTag("code", 500)
+	ok.Inc()
+	ko.Inc()
+
+	a.NoError(publisher.Flush(context.Background()))
+	a.Equal("c:1|c|@1.0000|#a:1,b:2,c:3,code:200\nc:1|c|@1.0000|#a:1,b:2,c:3,code:500\n", <-rec)
+}
+
+func TestPublisherCounterIncDoesNotAllocate(t *testing.T) {
+	publisher := metrics.NewPublisher(io.Discard, metrics.StatsDEncoder, time.Hour, nil)
+	counter := publisher.Counter("requests", metrics.NewTag("host", "life"), metrics.NewTag("code", 200))
+
+	allocs := testing.AllocsPerRun(1000, func() {
+		counter.Inc()
+	})
+
+	assert.Zero(t, allocs)
+}
+
+func TestPublisherDerivedCounterIncDoesNotAllocate(t *testing.T) {
+	publisher := metrics.NewPublisher(io.Discard, metrics.StatsDEncoder, time.Hour, nil)
+	counter := publisher.Counter("requests", metrics.NewTag("host", "life")).WithTag("code", 200).WithSampleRate(1)
+
+	allocs := testing.AllocsPerRun(1000, func() {
+		counter.Inc()
+	})
+
+	assert.Zero(t, allocs)
+}
+
+func TestPublisherAggregatesCountersAndGauges(t *testing.T) {
+	a := assert.New(t)
+	rec := make(recorder)
+
+	publisher := metrics.NewPublisher(rec, metrics.StatsDEncoder, time.Hour, nil)
+	go publisher.Run(context.Background())
+	waitRunning(t, publisher)
+
+	counter := publisher.Counter("commands_executed", metrics.NewTag("project", "bsk"))
+	counter.Add(2)
+	counter.Inc()
+	counter.WithTag("code", 500).Inc()
+	counter.Inc()
+
+	gauge := publisher.Gauge("memory")
+	gauge.Update(100)
+	gauge.Update(200)
+
+	a.NoError(publisher.Flush(context.Background()))
+
+	expected := "commands_executed:4|c|@1.0000|#project:bsk\ncommands_executed:1|c|@1.0000|#project:bsk,code:500\nmemory:200|g|@1.0000\n"
+	a.Equal(expected, <-rec)
+
+	// aggregated series are reset after every flush
+	counter.Inc()
+	a.NoError(publisher.Flush(context.Background()))
+
+	a.Equal("commands_executed:1|c|@1.0000|#project:bsk\n", <-rec)
+}
+
+func TestPublisherDistributionAndSet(t *testing.T) {
+	a := assert.New(t)
+	rec := make(recorder)
+
+	publisher := metrics.NewPublisher(rec, metrics.StatsDEncoder, time.Hour, nil)
+	go publisher.Run(context.Background())
+	waitRunning(t, publisher)
+
+	distribution := publisher.Distribution("latency", metrics.NewTag("shard", 1))
+	distribution.AddValue(1.5)
+	distribution.AddValue(2)
+
+	// sets are aggregated by value
+	players := publisher.Set("players", metrics.NewTag("shard", 1))
+	players.Add("alice")
+	players.Add("bob")
+	players.Add("alice")
+
+	a.NoError(publisher.Flush(context.Background()))
+
+	expected := "latency:1.5|d|@1.0000|#shard:1\nlatency:2|d|@1.0000|#shard:1\nplayers:alice|s|@1.0000|#shard:1\nplayers:bob|s|@1.0000|#shard:1\n"
+	a.Equal(expected, <-rec)
+}
+
+func TestPublisherServiceCheck(t *testing.T) {
+	a := assert.New(t)
+	rec := make(recorder)
+
+	publisher := metrics.NewPublisher(rec, metrics.StatsDEncoder, time.Hour, nil)
+	go publisher.Run(context.Background())
+	waitRunning(t, publisher)
+
+	check := publisher.ServiceCheck("database.can_connect", metrics.NewTag("db", "main")).WithHostname("host1")
+	check.Send(metrics.ServiceCheckOK)
+	check.WithTimestamp(time.Unix(1500000000, 0)).SendWithMessage(metrics.ServiceCheckCritical, "timeout")
+
+	a.NoError(publisher.Flush(context.Background()))
+
+	expected := "_sc|database.can_connect|0|h:host1|#db:main\n_sc|database.can_connect|2|d:1500000000|h:host1|#db:main|m:timeout\n"
+	a.Equal(expected, <-rec)
+}
+
+func TestPublisherEventWithOptions(t *testing.T) {
+	a := assert.New(t)
+	rec := make(recorder)
+
+	publisher := metrics.NewPublisher(rec, metrics.StatsDEncoder, time.Hour, nil)
+	go publisher.Run(context.Background())
+	waitRunning(t, publisher)
+
+	event := publisher.Event("deploy", metrics.NewTag("service", "bsk"))
+	event.Send()
+	event.WithOptions(
+		metrics.WithEventAlertType(metrics.EventAlertSuccess),
+		metrics.WithEventPriority(metrics.EventPriorityNormal),
+	).SendWithText("done")
+
+	a.NoError(publisher.Flush(context.Background()))
+
+	a.Equal("_e{6,0}:deploy||#service:bsk\n_e{6,4}:deploy|done|p:normal|t:success|#service:bsk\n", <-rec)
+}
+
+func TestPublisherWithoutAggregation(t *testing.T) {
+	a := assert.New(t)
+	rec := make(recorder)
+
+	publisher := metrics.NewPublisher(rec, metrics.StatsDEncoder, time.Hour, nil, metrics.WithoutAggregation())
+	go publisher.Run(context.Background())
+	waitRunning(t, publisher)
+
+	counter := publisher.Counter("commands_executed")
+	counter.Inc()
+	counter.Inc()
+
+	gauge := publisher.Gauge("memory")
+	gauge.Update(100)
+	gauge.Update(200)
+
+	a.NoError(publisher.Flush(context.Background()))
+
+	a.Equal("commands_executed:1|c|@1.0000\ncommands_executed:1|c|@1.0000\nmemory:100|g|@1.0000\nmemory:200|g|@1.0000\n", <-rec)
+}
+
+func TestPublisherSampleRate(t *testing.T) {
+	a := assert.New(t)
+	rec := make(recorder, 1000)
+
+	publisher := metrics.NewPublisher(rec, metrics.StatsDEncoder, time.Hour, nil, metrics.WithoutAggregation())
+	go publisher.Run(context.Background())
+	waitRunning(t, publisher)
+
+	histogram := publisher.Histogram("latency").WithSampleRate(0.5)
+	for i := 0; i < 1000; i++ {
+		histogram.AddValue(1)
+	}
+	// the second flush is not handled until the first one is written
+	a.NoError(publisher.Flush(context.Background()))
+	a.NoError(publisher.Flush(context.Background()))
+
+	var out string
+	for len(rec) > 0 {
+		out += <-rec
+	}
+
+	lines := strings.Split(strings.TrimSuffix(out, "\n"), "\n")
+	a.InDelta(500, len(lines), 150)
+	for _, line := range lines {
+		a.Equal("latency:1|h|@0.5000", line)
+	}
+}
+
+func TestPublisherSampleRateWithAggregation(t *testing.T) {
+	a := assert.New(t)
+	rec := make(recorder)
+
+	publisher := metrics.NewPublisher(rec, metrics.StatsDEncoder, time.Hour, nil, metrics.WithSampleRate(0.25))
+	go publisher.Run(context.Background())
+	waitRunning(t, publisher)
+
+	counter := publisher.Counter("requests")
+	for i := 0; i < 1000; i++ {
+		counter.Inc()
+	}
+	publisher.Counter("unsampled").WithSampleRate(1e-9).Inc()
+	publisher.Gauge("sampled").WithSampleRate(1).Update(1)
+	a.NoError(publisher.Flush(context.Background()))
+
+	var value int
+	var gauge string
+	_, err := fmt.Sscanf(<-rec, "requests:%d|c|@0.2500\nsampled:%s", &value, &gauge)
+	a.NoError(err)
+	a.InDelta(250, value, 100)
+	a.Equal("1|g|@1.0000", gauge)
+}
+
+func TestPublisherQueueOverflow(t *testing.T) {
+	for _, tc := range []struct {
+		policy   metrics.OverflowPolicy
+		expected string
+	}{
+		{metrics.OverflowDropNewest, "g:0|g|@1.0000\ng:1|g|@1.0000\n"},
+		{metrics.OverflowDropOldest, "g:8|g|@1.0000\ng:9|g|@1.0000\n"},
+	} {
+		a := assert.New(t)
+		rec := make(recorder)
+		errs := make(chan error, 1)
+
+		publisher := metrics.NewPublisher(rec, metrics.StatsDEncoder, time.Hour, func(err error) { errs <- err },
+			metrics.WithoutAggregation(),
+			metrics.WithQueueSize(2),
+			metrics.WithOverflowPolicy(tc.policy),
+		)
+
+		// the publisher is not running, but updating the gauge doesn't block
+		gauge := publisher.Gauge("g")
+		for i := 0; i < 10; i++ {
+			gauge.Update(i)
+		}
+		a.EqualValues(8, publisher.Dropped())
+
+		ctx, cancel := context.WithCancel(context.Background())
+		go publisher.Run(ctx)
+		waitRunning(t, publisher)
+		a.NoError(publisher.Flush(context.Background()))
+
+		a.Equal(tc.expected, <-rec)
+		a.Equal(&metrics.DroppedMetricsError{Count: 8}, <-errs)
+		a.EqualValues(0, publisher.Dropped())
+		cancel()
+	}
+}
+
+func TestPublisherQueueSizeNotPositive(t *testing.T) {
+	for _, size := range []int{0, -1} {
+		a := assert.New(t)
+
+		var publisher *metrics.Publisher
+		a.NotPanics(func() {
+			publisher = metrics.NewPublisher(io.Discard, metrics.StatsDEncoder, time.Hour, nil,
+				metrics.WithoutAggregation(),
+				metrics.WithQueueSize(size),
+				metrics.WithOverflowPolicy(metrics.OverflowDropOldest),
+			)
+		})
+
+		// the publisher is not running, the observations wait in a queue of the default size
+		gauge := publisher.Gauge("g")
+		for i := 0; i < 10; i++ {
+			gauge.Update(i)
+		}
+		a.EqualValues(0, publisher.Dropped())
+	}
+}
+
+func TestPublisherFlushWhenNotRunning(t *testing.T) {
+	a := assert.New(t)
+
+	publisher := metrics.NewPublisher(io.Discard, metrics.StatsDEncoder, time.Hour, nil)
+	a.Equal(metrics.ErrPublisherNotRunning, publisher.Flush(context.Background()))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		publisher.Run(ctx)
+		close(stopped)
+	}()
+	waitRunning(t, publisher)
+	a.NoError(publisher.Flush(context.Background()))
+
+	cancel()
+	<-stopped
+	a.Equal(metrics.ErrPublisherNotRunning, publisher.Flush(context.Background()))
+}
+
+func TestPublisherDrainsOnShutdown(t *testing.T) {
+	for _, opts := range [][]metrics.PublisherOption{
+		nil,
+		{metrics.WithoutAggregation()},
+	} {
+		a := assert.New(t)
+		rec := make(recorder, 10)
+
+		publisher := metrics.NewPublisher(rec, metrics.StatsDEncoder, time.Hour, nil, opts...)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		stopped := make(chan struct{})
+		go func() {
+			publisher.Run(ctx)
+			close(stopped)
+		}()
+		waitRunning(t, publisher)
+
+		// the application keeps publishing while it shuts down
+		publisher.Counter("requests").Inc()
+		cancel()
+		time.Sleep(10 * time.Millisecond)
+		publisher.Counter("shutdown").Inc()
+
+		<-stopped
+		a.Equal("requests:1|c|@1.0000\nshutdown:1|c|@1.0000\n", <-rec)
+		a.Empty(rec)
+	}
+}
+
+func TestPublisherShutdownGracePeriod(t *testing.T) {
+	a := assert.New(t)
+
+	publisher := metrics.NewPublisher(io.Discard, metrics.StatsDEncoder, time.Hour, nil,
+		metrics.WithShutdownGracePeriod(100*time.Millisecond),
+		metrics.WithOverflowPolicy(metrics.OverflowBlock),
+		metrics.WithoutAggregation(),
+		metrics.WithQueueSize(1),
+	)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		publisher.Run(ctx)
+		close(stopped)
+	}()
+	waitRunning(t, publisher)
+
+	// observations never stop, but Run returns once the grace period is over
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				publisher.Counter("requests").Inc()
+			}
+		}
+	}()
+
+	started := time.Now()
+	cancel()
+	<-stopped
+	a.Less(time.Since(started), time.Second)
+
+	// the blocking policy doesn't block once Run has returned
+	publisher.Counter("requests").Inc()
+	publisher.Counter("requests").Inc()
+}
+
+func TestPublisherPacksWholeLinesInPackets(t *testing.T) {
+	a := assert.New(t)
+	rec := make(recorder, 10)
+
+	publisher := metrics.NewPublisher(rec, metrics.StatsDEncoder, time.Hour, nil,
+		metrics.WithoutAggregation(),
+		metrics.WithMaxPacketSize(50),
+	)
+	go publisher.Run(context.Background())
+	waitRunning(t, publisher)
+
+	// every line is 14 bytes long
+	gauge := publisher.Gauge("g")
+	for i := 0; i < 5; i++ {
+		gauge.Update(i)
+	}
+	publisher.Gauge("a_very_long_gauge_name_that_does_not_fit_in_a_packet").Update(0)
+	gauge.Update(5)
+
+	a.NoError(publisher.Flush(context.Background()))
+	a.NoError(publisher.Flush(context.Background()))
+
+	a.Equal("g:0|g|@1.0000\ng:1|g|@1.0000\ng:2|g|@1.0000\n", <-rec)
+	a.Equal("g:3|g|@1.0000\ng:4|g|@1.0000\n", <-rec)
+	a.Equal("a_very_long_gauge_name_that_does_not_fit_in_a_packet:0|g|@1.0000\n", <-rec)
+	a.Equal("g:5|g|@1.0000\n", <-rec)
+	a.Empty(rec)
+}
+
+func TestDataDogUnixPacketSize(t *testing.T) {
+	a := assert.New(t)
+
+	addr := filepath.Join(t.TempDir(), "dsd.socket")
+	server, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: addr, Net: "unixgram"})
+	a.NoError(err)
+	defer server.Close()
+
+	publisher := metrics.NewDataDogUnix(
+		metrics.WithDDUnixAddress(addr),
+		metrics.WithDDPublisherOptions(metrics.WithoutAggregation()),
+	)
+	go publisher.Run(context.Background())
+	waitRunning(t, publisher)
+
+	counter := publisher.Counter("a_counter_with_a_long_name")
+	for i := 0; i < 100; i++ {
+		counter.Inc()
+	}
+	a.NoError(publisher.Flush(context.Background()))
+
+	packet := make([]byte, 65536)
+	n, err := server.Read(packet)
+	a.NoError(err)
+	a.Greater(n, 1432)
+	a.LessOrEqual(n, 8192)
+	a.True(strings.HasSuffix(string(packet[:n]), "\n"))
+}
+
+func TestDialDataDogUnix(t *testing.T) {
+	a := assert.New(t)
+
+	addr := filepath.Join(t.TempDir(), "dsd.socket")
+
+	_, err := metrics.DialDataDogUnix(metrics.WithDDUnixAddress(addr))
+	a.Error(err)
+	a.Panics(func() { metrics.NewDataDogUnix(metrics.WithDDUnixAddress(addr)) })
+
+	publisher, err := metrics.DialDataDogUnix(metrics.WithDDUnixAddress(addr), metrics.WithDDLazyConnection())
+	a.NoError(err)
+	a.NotNil(publisher)
+
+	// stops dialing in the background
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	publisher.Run(ctx)
+}
+
 func TestPublisherFlushBufferWhenMaxSizeIsExceeded(t *testing.T) {
 	rec := make(recorder, 1024)
 	a := assert.New(t)
@@ -125,6 +583,34 @@ func TestTimerEvent(t *testing.T) {
 	a.Contains(line, "|ms|@1.0000\n")
 }
 
+func TestTimerRecordTimeAndStopwatch(t *testing.T) {
+	a := assert.New(t)
+	rec := make(recorder, 1)
+
+	publisher := metrics.NewPublisher(rec, metrics.StatsDEncoder, time.Hour, nil)
+	go publisher.Run(context.Background())
+	waitRunning(t, publisher)
+
+	timer := publisher.Timer("test")
+	timer.Record(1500 * time.Microsecond)
+	timer.Time(func() {})
+
+	watches := []*metrics.Stopwatch{timer.StartStopwatch(), timer.StartStopwatch()}
+	for _, w := range watches {
+		a.True(w.Stop() >= 0)
+	}
+
+	a.NoError(publisher.Flush(context.Background()))
+
+	lines := strings.Split(strings.TrimSuffix(<-rec, "\n"), "\n")
+	a.Len(lines, 4)
+	a.Equal("test:1.5|ms|@1.0000", lines[0])
+	for _, line := range lines[1:] {
+		a.True(strings.HasPrefix(line, "test:"))
+		a.True(strings.HasSuffix(line, "|ms|@1.0000"))
+	}
+}
+
 func TestPublisherHistogram(t *testing.T) {
 	a := assert.New(t)
 
@@ -161,3 +647,70 @@ func (r recorder) Write(b []byte) (n int, err error) {
 	r <- string(b)
 	return len(b), nil
 }
+
+func benchmarkPublisherCounterInc(b *testing.B, opts ...metrics.PublisherOption) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	publisher := metrics.NewPublisher(io.Discard, metrics.StatsDEncoder, time.Second, nil, opts...)
+	go publisher.Run(ctx)
+
+	counter := publisher.Counter("requests", metrics.NewTag("host", "life"), metrics.NewTag("code", 200))
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		counter.Inc()
+	}
+}
+
+func BenchmarkPublisherCounterInc(b *testing.B) {
+	benchmarkPublisherCounterInc(b)
+}
+
+func BenchmarkPublisherCounterIncWithoutAggregation(b *testing.B) {
+	benchmarkPublisherCounterInc(b, metrics.WithoutAggregation())
+}
+
+func BenchmarkPublisherCounterIncWithoutAggregationWithAppendEncoder(b *testing.B) {
+	benchmarkPublisherCounterInc(b, metrics.WithoutAggregation(), metrics.WithAppendEncoder(metrics.AppendStatsDEncoder))
+}
+
+func BenchmarkPublisherCounterWithTagInc(b *testing.B) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	publisher := metrics.NewPublisher(io.Discard, metrics.StatsDEncoder, time.Second, nil)
+	go publisher.Run(ctx)
+
+	counter := publisher.Counter("requests", metrics.NewTag("host", "life"))
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		counter.WithTag("code", 200).Inc()
+	}
+}
+
+func BenchmarkCardinalityLimitedCounterInc(b *testing.B) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	publisher := metrics.NewPublisher(io.Discard, metrics.StatsDEncoder, time.Second, nil)
+	go publisher.Run(ctx)
+
+	m := metrics.NewCardinalityLimitedMetrics(publisher, 100, nil)
+	counter := m.Counter("requests", metrics.NewTag("host", "life")).WithTag("code", 200)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		counter.Inc()
+	}
+}
+
+// waitRunning waits until the Run method of the publisher is running, so it can be flushed
+func waitRunning(t *testing.T, publisher *metrics.Publisher) {
+	t.Helper()
+	assert.Eventually(t, func() bool { return publisher.Stats().Running }, time.Second, time.Millisecond)
+}
@@ -1,29 +1,39 @@
 package metrics
 
 import (
+	"fmt"
+	"reflect"
 	"sync"
 	"time"
 )
 
 // Recorder is a Metrics implementation that will hold the values written by
 // its metrics types for testing purposes only.
+//
+// Metrics are registered by type, name and tags, so asking twice for a metric
+// with the same name and tags returns the same instance, and metrics with
+// different tags are recorded separately. The tags of a metric are matched
+// regardless of their order. WithTag and WithTags don't change the tags of a
+// metric, they return the registered metric with the tags added, so metrics
+// tagged after being created, e.g. with the status code of a response, are
+// recorded separately too.
 type Recorder struct {
-	registry map[string]Metric
+	registry []Metric     // in registration order
 	mu       sync.RWMutex // protects the registry
 }
 
 // NewRecorder returns an empty Recorder.
 func NewRecorder() *Recorder {
-	return &Recorder{
-		registry: make(map[string]Metric),
-	}
+	return &Recorder{}
 }
 
 // A RecorderMetric is the type that will implement
 // the Counter, Gauge and Event metric types.
 type RecorderMetric struct {
-	name string
-	tags Tags
+	name     string
+	tags     Tags
+	rate     float64
+	recorder *Recorder
 }
 
 // Name implements part of the Metric interface.
@@ -36,6 +46,25 @@ func (rm RecorderMetric) Tags() Tags {
 	return rm.tags
 }
 
+// withTags returns the tags of the metric with the given ones added
+func (rm RecorderMetric) withTags(tags Tags) Tags {
+	return append(append(Tags(nil), rm.tags...), tags...)
+}
+
+// registry returns the recorder of the metric, or an empty one for the metrics that were not created by a recorder
+func (rm RecorderMetric) registry() *Recorder {
+	if rm.recorder == nil {
+		return NewRecorder()
+	}
+	return rm.recorder
+}
+
+// SampleRate returns the sample rate declared for the metric, if any.
+// The recorder doesn't sample, all the observations are recorded.
+func (rm RecorderMetric) SampleRate() float64 {
+	return rm.rate
+}
+
 // A RecorderCounter is a RecorderMetric that implements Counter.
 type RecorderCounter struct {
 	RecorderMetric
@@ -62,19 +91,32 @@ func (c *RecorderCounter) Add(delta uint64) {
 	c.value += delta
 }
 
-// WithTags adds the passed tags to the Tags recorder map.
+// WithTags returns the registered Counter with the same name and the passed tags added, keeping the sample rate.
 func (c *RecorderCounter) WithTags(tags ...Tag) Counter {
 	c.mu.Lock()
-	defer c.mu.Unlock()
-	c.tags = append(c.tags, tags...)
-	return c
+	rate := c.rate
+	c.mu.Unlock()
+
+	derived := c.registry().Counter(c.name, c.withTags(tags)...).(*RecorderCounter)
+	if derived != c {
+		derived.mu.Lock()
+		derived.rate = rate
+		derived.mu.Unlock()
+	}
+
+	return derived
 }
 
-// WithTag creates a new tag with the parameters and adds it to the Tags recorder map.
+// WithTag returns the registered Counter with the same name and the tag created with the parameters added.
 func (c *RecorderCounter) WithTag(key string, value interface{}) Counter {
+	return c.WithTags(NewTag(key, value))
+}
+
+// WithSampleRate stores the sample rate in the recorder.
+func (c *RecorderCounter) WithSampleRate(rate float64) Counter {
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	c.tags = append(c.tags, NewTag(key, value))
+	c.rate = rate
 	return c
 }
 
@@ -99,20 +141,32 @@ func (g *RecorderGauge) Update(value interface{}) {
 	g.value = value
 }
 
-// WithTags adds the passed tags to the Tags recorder map.
+// WithTags returns the registered Gauge with the same name and the passed tags added, keeping the sample rate.
 func (g *RecorderGauge) WithTags(tags ...Tag) Gauge {
 	g.mu.Lock()
-	defer g.mu.Unlock()
-	g.tags = append(g.tags, tags...)
+	rate := g.rate
+	g.mu.Unlock()
+
+	derived := g.registry().Gauge(g.name, g.withTags(tags)...).(*RecorderGauge)
+	if derived != g {
+		derived.mu.Lock()
+		derived.rate = rate
+		derived.mu.Unlock()
+	}
 
-	return g
+	return derived
 }
 
-// WithTag creates a new tag with the parameters and adds it to the Tags recorder map.
+// WithTag returns the registered Gauge with the same name and the tag created with the parameters added.
 func (g *RecorderGauge) WithTag(key string, value interface{}) Gauge {
+	return g.WithTags(NewTag(key, value))
+}
+
+// WithSampleRate stores the sample rate in the recorder.
+func (g *RecorderGauge) WithSampleRate(rate float64) Gauge {
 	g.mu.Lock()
 	defer g.mu.Unlock()
-	g.tags = append(g.tags, NewTag(key, value))
+	g.rate = rate
 
 	return g
 }
@@ -121,9 +175,45 @@ func (g *RecorderGauge) WithTag(key string, value interface{}) Gauge {
 type RecorderEvent struct {
 	RecorderMetric
 	event string
+	value EventValue
 	mu    sync.Mutex // protects the whole struct
 }
 
+// Priority returns the priority of the event in a thread-safe manner
+func (e *RecorderEvent) Priority() EventPriority {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.value.Priority
+}
+
+// AlertType returns the alert type of the event in a thread-safe manner
+func (e *RecorderEvent) AlertType() EventAlertType {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.value.AlertType
+}
+
+// AggregationKey returns the aggregation key of the event in a thread-safe manner
+func (e *RecorderEvent) AggregationKey() string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.value.AggregationKey
+}
+
+// SourceType returns the source type of the event in a thread-safe manner
+func (e *RecorderEvent) SourceType() string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.value.SourceType
+}
+
+// Date returns the date of the event in a thread-safe manner
+func (e *RecorderEvent) Date() time.Time {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.value.Date
+}
+
 // Event returns the event name in a thread-safe manner
 func (e *RecorderEvent) Event() string {
 	e.mu.Lock()
@@ -146,19 +236,34 @@ func (e *RecorderEvent) SendWithText(text string) {
 	e.event = e.name + "|" + text
 }
 
-// WithTags adds the passed tags to the Tags recorder map.
+// WithTags returns the registered Event with the same name and the passed tags added, keeping the options.
 func (e *RecorderEvent) WithTags(tags ...Tag) Event {
 	e.mu.Lock()
-	defer e.mu.Unlock()
-	e.tags = append(e.tags, tags...)
-	return e
+	value := e.value
+	e.mu.Unlock()
+
+	derived := e.registry().Event(e.name, e.withTags(tags)...).(*RecorderEvent)
+	if derived != e {
+		derived.mu.Lock()
+		derived.value = value
+		derived.mu.Unlock()
+	}
+
+	return derived
 }
 
-// WithTag creates a new tag with the parameters and adds it to the Tags recorder map.
+// WithTag returns the registered Event with the same name and the tag created with the parameters added.
 func (e *RecorderEvent) WithTag(key string, value interface{}) Event {
+	return e.WithTags(NewTag(key, value))
+}
+
+// WithOptions stores the event attributes in the Recorder.
+func (e *RecorderEvent) WithOptions(opts ...EventOption) Event {
 	e.mu.Lock()
 	defer e.mu.Unlock()
-	e.tags = append(e.tags, NewTag(key, value))
+	for _, o := range opts {
+		o(&e.value)
+	}
 	return e
 }
 
@@ -167,6 +272,7 @@ type RecorderTimer struct {
 	RecorderMetric
 	startedTime time.Time
 	stoppedTime time.Time
+	durations   []time.Duration
 	mu          sync.Mutex // protects the whole struct
 }
 
@@ -192,6 +298,14 @@ func (t *RecorderTimer) Duration() time.Duration {
 	return t.stoppedTime.Sub(t.startedTime)
 }
 
+// Durations returns all the recorded durations, by Stop, Record, Time or a Stopwatch, in a thread-safe manner
+func (t *RecorderTimer) Durations() []time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return append([]time.Duration(nil), t.durations...)
+}
+
 // Start the timer.
 func (t *RecorderTimer) Start() {
 	t.mu.Lock()
@@ -206,25 +320,60 @@ func (t *RecorderTimer) Stop() {
 	defer t.mu.Unlock()
 
 	t.stoppedTime = time.Now()
+	if !t.startedTime.IsZero() {
+		t.durations = append(t.durations, t.stoppedTime.Sub(t.startedTime))
+	}
 }
 
-// WithTags adds the passed tags to the Tags recorder map.
-func (t *RecorderTimer) WithTags(tags ...Tag) Timer {
+// Record records the duration.
+func (t *RecorderTimer) Record(d time.Duration) {
 	t.mu.Lock()
 	defer t.mu.Unlock()
 
-	for _, tag := range tags {
-		t.tags = append(t.tags, tag)
+	t.durations = append(t.durations, d)
+}
+
+// Time records the duration of the execution of the function.
+func (t *RecorderTimer) Time(f func()) {
+	started := time.Now()
+	f()
+	t.Record(time.Since(started))
+}
+
+// StartStopwatch returns a started Stopwatch that records its duration in the timer.
+func (t *RecorderTimer) StartStopwatch() *Stopwatch {
+	return NewStopwatch(t)
+}
+
+// WithTags returns the registered Timer with the same name and the passed tags added, keeping the sample rate and the start time.
+func (t *RecorderTimer) WithTags(tags ...Tag) Timer {
+	t.mu.Lock()
+	rate := t.rate
+	startedTime := t.startedTime
+	t.mu.Unlock()
+
+	derived := t.registry().Timer(t.name, t.withTags(tags)...).(*RecorderTimer)
+	if derived != t {
+		derived.mu.Lock()
+		derived.rate = rate
+		derived.startedTime = startedTime
+		derived.mu.Unlock()
 	}
-	return t
+
+	return derived
 }
 
-// WithTag creates a new tag with the parameters and adds it to the Tags recorder map.
+// WithTag returns the registered Timer with the same name and the tag created with the parameters added.
 func (t *RecorderTimer) WithTag(key string, value interface{}) Timer {
+	return t.WithTags(NewTag(key, value))
+}
+
+// WithSampleRate stores the sample rate in the recorder.
+func (t *RecorderTimer) WithSampleRate(rate float64) Timer {
 	t.mu.Lock()
 	defer t.mu.Unlock()
 
-	t.tags = append(t.tags, NewTag(key, value))
+	t.rate = rate
 	return t
 }
 
@@ -250,73 +399,344 @@ func (h *RecorderHistogram) AddValue(value uint64) {
 	h.values = append(h.values, value)
 }
 
-// WithTags adds the passed tags to the Tags recorder map.
+// WithTags returns the registered Histogram with the same name and the passed tags added, keeping the sample rate.
 func (h *RecorderHistogram) WithTags(tags ...Tag) Histogram {
 	h.mu.Lock()
-	defer h.mu.Unlock()
-	h.tags = append(h.tags, tags...)
-	return h
+	rate := h.rate
+	h.mu.Unlock()
+
+	derived := h.registry().Histogram(h.name, h.withTags(tags)...).(*RecorderHistogram)
+	if derived != h {
+		derived.mu.Lock()
+		derived.rate = rate
+		derived.mu.Unlock()
+	}
+
+	return derived
 }
 
-// WithTag creates a new tag with the parameters and adds it to the Tags recorder map.
+// WithTag returns the registered Histogram with the same name and the tag created with the parameters added.
 func (h *RecorderHistogram) WithTag(key string, value interface{}) Histogram {
+	return h.WithTags(NewTag(key, value))
+}
+
+// WithSampleRate stores the sample rate in the recorder.
+func (h *RecorderHistogram) WithSampleRate(rate float64) Histogram {
 	h.mu.Lock()
 	defer h.mu.Unlock()
-	h.tags = append(h.tags, NewTag(key, value))
+	h.rate = rate
 	return h
 }
 
-// Counter implements the Metrics behaviour to return a new Counter.
-func (r *Recorder) Counter(name string, tags ...Tag) Counter {
-	m := r.Get(name)
-	if m == nil {
-		m = &RecorderCounter{RecorderMetric: RecorderMetric{name, tags}}
-		r.register(name, m)
+// RecorderDistribution is a RecorderMetric that implements Distribution
+type RecorderDistribution struct {
+	RecorderMetric
+	values []float64
+	mu     sync.Mutex // protects the whole struct
+}
+
+// Values returns the distribution values in a thread-safe manner
+func (d *RecorderDistribution) Values() []float64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.values
+}
+
+// AddValue add the given value to the distribution
+func (d *RecorderDistribution) AddValue(value float64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.values = append(d.values, value)
+}
+
+// WithTags returns the registered Distribution with the same name and the passed tags added, keeping the sample rate.
+func (d *RecorderDistribution) WithTags(tags ...Tag) Distribution {
+	d.mu.Lock()
+	rate := d.rate
+	d.mu.Unlock()
+
+	derived := d.registry().Distribution(d.name, d.withTags(tags)...).(*RecorderDistribution)
+	if derived != d {
+		derived.mu.Lock()
+		derived.rate = rate
+		derived.mu.Unlock()
 	}
 
-	return m.(Counter)
+	return derived
+}
+
+// WithTag returns the registered Distribution with the same name and the tag created with the parameters added.
+func (d *RecorderDistribution) WithTag(key string, value interface{}) Distribution {
+	return d.WithTags(NewTag(key, value))
+}
+
+// WithSampleRate stores the sample rate in the recorder.
+func (d *RecorderDistribution) WithSampleRate(rate float64) Distribution {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.rate = rate
+	return d
+}
+
+// RecorderSet is a RecorderMetric that implements Set
+type RecorderSet struct {
+	RecorderMetric
+	values []interface{}
+	unique map[string]struct{} // the values formatted with %v, values can be of uncomparable types
+	mu     sync.Mutex          // protects the whole struct
+}
+
+// Values returns the unique values of the set, in the order they were first added, in a thread-safe manner
+func (s *RecorderSet) Values() []interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.values
+}
+
+// Add adds the given value to the set, if it is not already there
+func (s *RecorderSet) Add(value interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := fmt.Sprintf("%v", value)
+	if _, ok := s.unique[key]; ok {
+		return
+	}
+	if s.unique == nil {
+		s.unique = make(map[string]struct{})
+	}
+	s.unique[key] = struct{}{}
+	s.values = append(s.values, value)
+}
+
+// WithTags returns the registered Set with the same name and the passed tags added.
+func (s *RecorderSet) WithTags(tags ...Tag) Set {
+	return s.registry().Set(s.name, s.withTags(tags)...)
+}
+
+// WithTag returns the registered Set with the same name and the tag created with the parameters added.
+func (s *RecorderSet) WithTag(key string, value interface{}) Set {
+	return s.WithTags(NewTag(key, value))
+}
+
+// RecorderServiceCheck is a RecorderMetric that implements ServiceCheck
+type RecorderServiceCheck struct {
+	RecorderMetric
+	status    ServiceCheckStatus
+	message   string
+	hostname  string
+	timestamp time.Time
+	mu        sync.Mutex // protects the whole struct
+}
+
+// Status returns the last status sent in a thread-safe manner
+func (c *RecorderServiceCheck) Status() ServiceCheckStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.status
+}
+
+// Message returns the last message sent in a thread-safe manner
+func (c *RecorderServiceCheck) Message() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.message
+}
+
+// Hostname returns the hostname of the service check in a thread-safe manner
+func (c *RecorderServiceCheck) Hostname() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.hostname
+}
+
+// Timestamp returns the timestamp of the service check in a thread-safe manner
+func (c *RecorderServiceCheck) Timestamp() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.timestamp
+}
+
+// Send implements the ServiceCheck behaviour and stores the status in the Recorder.
+func (c *RecorderServiceCheck) Send(status ServiceCheckStatus) {
+	c.SendWithMessage(status, "")
+}
+
+// SendWithMessage implements the ServiceCheck behaviour and stores the status and message in the Recorder.
+func (c *RecorderServiceCheck) SendWithMessage(status ServiceCheckStatus, message string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.status = status
+	c.message = message
+}
+
+// WithHostname stores the hostname in the Recorder.
+func (c *RecorderServiceCheck) WithHostname(hostname string) ServiceCheck {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.hostname = hostname
+	return c
+}
+
+// WithTimestamp stores the timestamp in the Recorder.
+func (c *RecorderServiceCheck) WithTimestamp(t time.Time) ServiceCheck {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.timestamp = t
+	return c
+}
+
+// WithTags returns the registered ServiceCheck with the same name and the passed tags added, keeping the hostname and timestamp.
+func (c *RecorderServiceCheck) WithTags(tags ...Tag) ServiceCheck {
+	c.mu.Lock()
+	hostname := c.hostname
+	timestamp := c.timestamp
+	c.mu.Unlock()
+
+	derived := c.registry().ServiceCheck(c.name, c.withTags(tags)...).(*RecorderServiceCheck)
+	if derived != c {
+		derived.mu.Lock()
+		derived.hostname = hostname
+		derived.timestamp = timestamp
+		derived.mu.Unlock()
+	}
+
+	return derived
+}
+
+// WithTag returns the registered ServiceCheck with the same name and the tag created with the parameters added.
+func (c *RecorderServiceCheck) WithTag(key string, value interface{}) ServiceCheck {
+	return c.WithTags(NewTag(key, value))
+}
+
+// Counter implements the Metrics behaviour to return a new Counter.
+func (r *Recorder) Counter(name string, tags ...Tag) Counter {
+	return r.register(&RecorderCounter{RecorderMetric: RecorderMetric{name: name, tags: tags, recorder: r}}).(Counter)
 }
 
 // Gauge implements the Metrics behaviour to return a new Gauge.
 func (r *Recorder) Gauge(name string, tags ...Tag) Gauge {
-	m := &RecorderGauge{RecorderMetric: RecorderMetric{name, tags}}
-	r.register(name, m)
-	return m
+	return r.register(&RecorderGauge{RecorderMetric: RecorderMetric{name: name, tags: tags, recorder: r}}).(Gauge)
 }
 
 // Event implements the Metrics behaviour to return a new Event.
 func (r *Recorder) Event(name string, tags ...Tag) Event {
-	m := &RecorderEvent{RecorderMetric: RecorderMetric{name, tags}}
-	r.register(name, m)
-	return m
+	return r.register(&RecorderEvent{RecorderMetric: RecorderMetric{name: name, tags: tags, recorder: r}}).(Event)
 }
 
 // Timer implements the Metrics behaviour to return a new Timer.
 func (r *Recorder) Timer(name string, tags ...Tag) Timer {
-	m := &RecorderTimer{RecorderMetric: RecorderMetric{name, tags}}
-	r.register(name, m)
-	return m
+	return r.register(&RecorderTimer{RecorderMetric: RecorderMetric{name: name, tags: tags, recorder: r}}).(Timer)
 }
 
 // Histogram implements the Metrics behaviour to return a new Histogram
 func (r *Recorder) Histogram(name string, tags ...Tag) Histogram {
-	m := &RecorderHistogram{RecorderMetric: RecorderMetric{name, tags}}
-	r.register(name, m)
-	return m
+	return r.register(&RecorderHistogram{RecorderMetric: RecorderMetric{name: name, tags: tags, recorder: r}}).(Histogram)
+}
+
+// Distribution implements the Metrics behaviour to return a new Distribution
+func (r *Recorder) Distribution(name string, tags ...Tag) Distribution {
+	return r.register(&RecorderDistribution{RecorderMetric: RecorderMetric{name: name, tags: tags, recorder: r}}).(Distribution)
+}
+
+// Set implements the Metrics behaviour to return a new Set
+func (r *Recorder) Set(name string, tags ...Tag) Set {
+	return r.register(&RecorderSet{RecorderMetric: RecorderMetric{name: name, tags: tags, recorder: r}}).(Set)
 }
 
-// Get returns the metric instance registered with the given name
+// ServiceCheck implements the Metrics behaviour to return a new ServiceCheck
+func (r *Recorder) ServiceCheck(name string, tags ...Tag) ServiceCheck {
+	m := &RecorderServiceCheck{RecorderMetric: RecorderMetric{name: name, tags: tags, recorder: r}, status: ServiceCheckUnknown}
+	return r.register(m).(ServiceCheck)
+}
+
+// Get returns the last metric instance registered with the given name, whatever its tags
 func (r *Recorder) Get(name string) Metric {
 	r.mu.RLock()
 	defer r.mu.RUnlock()
 
-	return r.registry[name]
+	for i := len(r.registry) - 1; i >= 0; i-- {
+		if r.registry[i].Name() == name {
+			return r.registry[i]
+		}
+	}
+
+	return nil
+}
+
+// Find returns the last metric instance registered with the given name and exactly
+// the given tags, in any order, or nil if there is none. The metrics returned by
+// WithTag and WithTags are registered with all their tags.
+func (r *Recorder) Find(name string, tags ...Tag) Metric {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for i := len(r.registry) - 1; i >= 0; i-- {
+		if m := r.registry[i]; m.Name() == name && sameTags(m.Tags(), tags) {
+			return m
+		}
+	}
+
+	return nil
+}
+
+// All returns all the registered metrics in registration order
+func (r *Recorder) All() []Metric {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return append([]Metric(nil), r.registry...)
+}
+
+// Reset removes all the registered metrics
+func (r *Recorder) Reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.registry = nil
 }
 
-func (r *Recorder) register(name string, metric Metric) {
+// register returns the registered metric with the same type, name and tags
+// as the given one if there is any, or registers the given one otherwise
+func (r *Recorder) register(metric Metric) Metric {
 	r.mu.Lock()
-	r.registry[name] = metric
-	r.mu.Unlock()
+	defer r.mu.Unlock()
+
+	for i := len(r.registry) - 1; i >= 0; i-- {
+		m := r.registry[i]
+		if reflect.TypeOf(m) == reflect.TypeOf(metric) && m.Name() == metric.Name() && sameTags(m.Tags(), metric.Tags()) {
+			return m
+		}
+	}
+
+	r.registry = append(r.registry, metric)
+	return metric
+}
+
+// sameTags returns whether both lists have the same tags, regardless of their order
+func sameTags(a, b Tags) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	used := make([]bool, len(b))
+	for _, ta := range a {
+		found := false
+		for i, tb := range b {
+			// the values are compared deeply, they can be of uncomparable types like slices
+			if !used[i] && ta.Key == tb.Key && reflect.DeepEqual(ta.Value, tb.Value) {
+				used[i] = true
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	return true
 }
 
 // HasTag return whether the given metric is tagged with the given key/value pair.
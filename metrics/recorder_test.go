@@ -28,6 +28,79 @@ func TestMetricsRecorderRegistry(t *testing.T) {
 	a.Nil(r.Get("does-not-exists"))
 }
 
+func TestRecorderKeyedByNameAndTags(t *testing.T) {
+	a := assert.New(t)
+
+	r := metrics.NewRecorder()
+
+	ok := r.Timer("requests", metrics.NewTag("code", 200))
+	ko := r.Timer("requests", metrics.NewTag("code", 500))
+	a.NotSame(ok, ko)
+	a.Same(ok, r.Timer("requests", metrics.NewTag("code", 200)))
+
+	ok.Record(time.Second)
+	ko.Record(time.Minute)
+	ko.Record(time.Hour)
+
+	a.Equal([]time.Duration{time.Second}, r.Find("requests", metrics.NewTag("code", 200)).(*metrics.RecorderTimer).Durations())
+	a.Equal([]time.Duration{time.Minute, time.Hour}, r.Find("requests", metrics.NewTag("code", 500)).(*metrics.RecorderTimer).Durations())
+	a.Nil(r.Find("requests"))
+	a.Nil(r.Find("requests", metrics.NewTag("code", 404)))
+
+	// tags are matched in any order, and adding tags returns the metric registered with them
+	base := r.Counter("counter", metrics.NewTag("a", 1))
+	c := base.WithTag("b", 2)
+	c.Inc()
+	a.NotSame(base, c)
+	a.Same(c, r.Find("counter", metrics.NewTag("b", 2), metrics.NewTag("a", 1)))
+	a.Same(c, r.Counter("counter", metrics.NewTag("b", 2), metrics.NewTag("a", 1)))
+	a.Same(base, r.Find("counter", metrics.NewTag("a", 1)))
+
+	// different metric types do not share instances
+	counter := r.Counter("metric")
+	gauge := r.Gauge("metric")
+	a.NotEqual(counter, gauge)
+
+	a.Equal([]metrics.Metric{ok, ko, base, c, counter, gauge}, r.All())
+
+	r.Reset()
+	a.Empty(r.All())
+	a.Nil(r.Get("requests"))
+	a.Nil(r.Find("counter", metrics.NewTag("a", 1), metrics.NewTag("b", 2)))
+}
+
+func TestRecorderWithTagAfterCreation(t *testing.T) {
+	a := assert.New(t)
+
+	r := metrics.NewRecorder()
+
+	// the pattern of the instrumentation decorators, that tag the metrics with the result
+	for _, code := range []int{200, 500, 200} {
+		r.Counter("requests").WithTag("code", code).Inc()
+
+		timer := r.Timer("requests_duration", metrics.NewTag("service", "api"))
+		timer.Start()
+		timer.WithTags(metrics.NewTag("code", code)).Stop()
+	}
+
+	a.EqualValues(2, r.Find("requests", metrics.NewTag("code", 200)).(*metrics.RecorderCounter).Value())
+	a.EqualValues(1, r.Find("requests", metrics.NewTag("code", 500)).(*metrics.RecorderCounter).Value())
+	a.EqualValues(0, r.Find("requests").(*metrics.RecorderCounter).Value())
+	a.Len(r.All(), 6)
+
+	timer := r.Find("requests_duration", metrics.NewTag("service", "api"), metrics.NewTag("code", 200)).(*metrics.RecorderTimer)
+	a.Len(timer.Durations(), 2, "the start time is kept when tagging")
+	a.Len(r.Find("requests_duration", metrics.NewTag("service", "api"), metrics.NewTag("code", 500)).(*metrics.RecorderTimer).Durations(), 1)
+
+	// the options are kept too
+	c := r.Counter("sampled").WithSampleRate(0.5).WithTag("code", 200)
+	a.Equal(0.5, c.(*metrics.RecorderCounter).SampleRate())
+	e := r.Event("deploy").WithOptions(metrics.WithEventSourceType("jenkins")).WithTag("env", "prod")
+	a.Equal("jenkins", e.(*metrics.RecorderEvent).SourceType())
+	sc := r.ServiceCheck("check").WithHostname("host1").WithTag("env", "prod")
+	a.Equal("host1", sc.(*metrics.RecorderServiceCheck).Hostname())
+}
+
 func TestMetricsRecorder(t *testing.T) {
 	a := assert.New(t)
 
@@ -57,25 +130,28 @@ func TestMetricsRecorder(t *testing.T) {
 
 		a.EqualValues(2, c.Value())
 
-		// test counter tags
+		// test counter tags, adding tags returns the counter with the tags added
 		a.Equal(c.Tags(), tags)
-		c.WithTags(moreTags...) // another way to set tags
+		tagged, _ := c.WithTags(moreTags...).(*metrics.RecorderCounter) // another way to set tags
 
-		c.Inc()
-		a.EqualValues(3, c.Value())
+		tagged.Inc()
+		a.EqualValues(1, tagged.Value())
+		a.EqualValues(2, c.Value())
 
-		a.Equal(append(tags, moreTags...), c.Tags())
+		a.Equal(append(tags, moreTags...), tagged.Tags())
+		a.Equal(tags, c.Tags())
+		a.Same(tagged, r.Counter(metricName, append(tags, moreTags...)...))
 
 		// test counter add from inc
 		c.Add(10)
-		a.EqualValues(13, c.Value())
+		a.EqualValues(12, c.Value())
 
-		// test counter add
+		// test counter add, the same name and tags return the same counter
 
 		c, _ = r.Counter(metricName, tags...).(*metrics.RecorderCounter)
 		c.WithTags(tags...)
 		c.Add(10)
-		a.EqualValues(23, c.Value())
+		a.EqualValues(22, c.Value())
 
 		// test gauge
 		metricName = "gauge"
@@ -87,12 +163,13 @@ func TestMetricsRecorder(t *testing.T) {
 
 		// test gauge tags
 		a.Equal(g.Tags(), tags)
-		g.WithTags(moreTags...) // another way to set tags
-		g.Update(math.Ln2)
-		a.EqualValues(math.Ln2, g.Value())
-		a.EqualValues(g.Tags(), append(tags, moreTags...))
-		g.WithTag(lastTagKey, lastTagValue) // and another way to add one tag
-		a.Equal(g.Tags(), append(append(tags, moreTags...), lastTag))
+		taggedGauge := g.WithTags(moreTags...) // another way to set tags
+		taggedGauge.Update(math.Ln2)
+		a.EqualValues(math.Ln2, taggedGauge.(*metrics.RecorderGauge).Value())
+		a.EqualValues(math.E, g.Value())
+		a.EqualValues(taggedGauge.Tags(), append(tags, moreTags...))
+		taggedGauge = taggedGauge.WithTag(lastTagKey, lastTagValue) // and another way to add one tag
+		a.Equal(taggedGauge.Tags(), append(append(tags, moreTags...), lastTag))
 
 		// test event
 		metricName = "event"
@@ -104,12 +181,12 @@ func TestMetricsRecorder(t *testing.T) {
 
 		// test event tags
 		a.Equal(e.Tags(), tags)
-		e.WithTags(moreTags...) // another way to set tags
-		e.SendWithText("msg2")
-		a.Equal("event|msg2", e.Event())
-		a.Equal(append(tags, moreTags...), e.Tags())
-		e.WithTag(lastTagKey, lastTagValue) // and another way to add one tag
-		a.Equal(e.Tags(), append(append(tags, moreTags...), lastTag))
+		taggedEvent, _ := e.WithTags(moreTags...).(*metrics.RecorderEvent) // another way to set tags
+		taggedEvent.SendWithText("msg2")
+		a.Equal("event|msg2", taggedEvent.Event())
+		a.Equal("event|msg", e.Event())
+		a.Equal(append(tags, moreTags...), taggedEvent.Tags())
+		a.Equal(taggedEvent.WithTag(lastTagKey, lastTagValue).Tags(), append(append(tags, moreTags...), lastTag)) // and another way to add one tag
 
 		// test Timer
 		metricName = "timer"
@@ -119,10 +196,11 @@ func TestMetricsRecorder(t *testing.T) {
 
 		// test timer tags
 		a.Equal(t.Tags(), tags)
-		t.WithTags(moreTags...) // another way to set tags
-		a.Equal(t.Tags(), append(tags, moreTags...))
-		t.WithTag(lastTagKey, lastTagValue) // and another way to add one tag
-		a.Equal(t.Tags(), append(append(tags, moreTags...), lastTag))
+		taggedTimer := t.WithTags(moreTags...) // another way to set tags
+		a.Equal(taggedTimer.Tags(), append(tags, moreTags...))
+		taggedTimer = taggedTimer.WithTag(lastTagKey, lastTagValue) // and another way to add one tag
+		a.Equal(taggedTimer.Tags(), append(append(tags, moreTags...), lastTag))
+		a.Equal(t.Tags(), tags)
 
 		// test Histogram
 		metricName = "histogram"
@@ -133,10 +211,11 @@ func TestMetricsRecorder(t *testing.T) {
 
 		// test histogram tags
 		a.Equal(h.Tags(), tags)
-		h.WithTags(moreTags...) // another way to set tags
-		a.Equal(h.Tags(), append(tags, moreTags...))
-		h.WithTag(lastTagKey, lastTagValue) // and another way to add one tag
-		a.Equal(h.Tags(), append(append(tags, moreTags...), lastTag))
+		taggedHistogram := h.WithTags(moreTags...) // another way to set tags
+		a.Equal(taggedHistogram.Tags(), append(tags, moreTags...))
+		taggedHistogram = taggedHistogram.WithTag(lastTagKey, lastTagValue) // and another way to add one tag
+		a.Equal(taggedHistogram.Tags(), append(append(tags, moreTags...), lastTag))
+		a.Empty(taggedHistogram.(*metrics.RecorderHistogram).Values())
 	}
 }
 
@@ -203,3 +282,124 @@ func TestRecorder_ConcurrentSafety(t *testing.T) {
 	})
 	a.Equal([]uint64{42, 42, 666, 666}, h.Values())
 }
+
+func TestRecorderUncomparableTagValues(t *testing.T) {
+	a := assert.New(t)
+	r := metrics.NewRecorder()
+
+	counter := r.Counter("counter", metrics.NewTag("regions", []string{"eu", "us"}))
+	a.NotPanics(func() {
+		a.Equal(counter, r.Counter("counter", metrics.NewTag("regions", []string{"eu", "us"})))
+	})
+	a.NotEqual(counter, r.Counter("counter", metrics.NewTag("regions", []string{"eu"})))
+}
+
+func TestRecorderDistributionAndSet(t *testing.T) {
+	a := assert.New(t)
+	r := metrics.NewRecorder()
+
+	d, _ := r.Distribution("distribution", metrics.NewTag("foo", "bar")).(*metrics.RecorderDistribution)
+	d.AddValue(1.5)
+	tagged := d.WithTag("bar", "baz")
+	tagged.AddValue(2)
+
+	a.Equal([]float64{1.5}, d.Values())
+	a.Equal([]float64{2}, tagged.(*metrics.RecorderDistribution).Values())
+	a.Equal(metrics.Tags{metrics.NewTag("foo", "bar"), metrics.NewTag("bar", "baz")}, tagged.Tags())
+	a.Equal(tagged, r.Get("distribution"))
+
+	s, _ := r.Set("set").(*metrics.RecorderSet)
+	s.Add("alice")
+	s.Add("bob")
+	s.Add("alice")
+
+	a.Equal([]interface{}{"alice", "bob"}, s.Values())
+	a.Equal(s, r.Get("set"))
+
+	// the values can be of uncomparable types
+	users, _ := r.Set("users").(*metrics.RecorderSet)
+	a.NotPanics(func() {
+		users.Add([]byte("u1"))
+		users.Add([]byte("u1"))
+	})
+	a.Equal([]interface{}{[]byte("u1")}, users.Values())
+}
+
+func TestRecorderEventOptions(t *testing.T) {
+	a := assert.New(t)
+	r := metrics.NewRecorder()
+
+	now := time.Now()
+
+	e, _ := r.Event("deploy").WithOptions(
+		metrics.WithEventPriority(metrics.EventPriorityLow),
+		metrics.WithEventAlertType(metrics.EventAlertWarning),
+		metrics.WithEventAggregationKey("deploy-1"),
+		metrics.WithEventSourceType("jenkins"),
+		metrics.WithEventDate(now),
+	).(*metrics.RecorderEvent)
+	e.SendWithText("started")
+
+	a.Equal("deploy|started", e.Event())
+	a.Equal(metrics.EventPriorityLow, e.Priority())
+	a.Equal(metrics.EventAlertWarning, e.AlertType())
+	a.Equal("deploy-1", e.AggregationKey())
+	a.Equal("jenkins", e.SourceType())
+	a.Equal(now, e.Date())
+}
+
+func TestRecorderServiceCheck(t *testing.T) {
+	a := assert.New(t)
+	r := metrics.NewRecorder()
+
+	now := time.Now()
+
+	c, _ := r.ServiceCheck("check", metrics.NewTag("foo", "bar")).(*metrics.RecorderServiceCheck)
+	a.Equal(metrics.ServiceCheckUnknown, c.Status())
+
+	c.WithHostname("host1").WithTimestamp(now).SendWithMessage(metrics.ServiceCheckWarning, "slow")
+	a.Equal(metrics.ServiceCheckWarning, c.Status())
+	a.Equal("slow", c.Message())
+	a.Equal("host1", c.Hostname())
+	a.Equal(now, c.Timestamp())
+
+	c.Send(metrics.ServiceCheckOK)
+	a.Equal(metrics.ServiceCheckOK, c.Status())
+	a.Equal("", c.Message())
+	a.Equal(c, r.Get("check"))
+}
+
+func TestRecorderSampleRate(t *testing.T) {
+	a := assert.New(t)
+	r := metrics.NewRecorder()
+
+	c, _ := r.Counter("counter").WithSampleRate(0.1).(*metrics.RecorderCounter)
+	c.Inc()
+	c.Inc()
+
+	a.EqualValues(2, c.Value(), "the recorder doesn't sample")
+	a.Equal(0.1, c.SampleRate())
+
+	h, _ := r.Histogram("histogram").WithSampleRate(0.5).(*metrics.RecorderHistogram)
+	a.Equal(0.5, h.SampleRate())
+}
+
+func TestRecorderTimerDurations(t *testing.T) {
+	a := assert.New(t)
+
+	r := metrics.NewRecorder()
+	timer := r.Timer("timer").(*metrics.RecorderTimer)
+
+	timer.Record(time.Second)
+	timer.Time(func() { time.Sleep(time.Millisecond) })
+	d := timer.StartStopwatch().Stop()
+	timer.Start()
+	timer.Stop()
+
+	durations := timer.Durations()
+	a.Len(durations, 4)
+	a.Equal(time.Second, durations[0])
+	a.True(durations[1] >= time.Millisecond)
+	a.Equal(d, durations[2])
+	a.Equal(timer.Duration(), durations[3])
+}
@@ -0,0 +1,156 @@
+package metrics
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"net/http"
+	"sort"
+)
+
+// Registry is a Metrics implementation that keeps the current value of every series in
+// memory, so the metrics of an application can be inspected locally without any agent,
+// see Snapshot. It is an http.Handler that responds with the snapshot in JSON, meant to
+// be mounted in a debug route like /debug/metrics, and Var publishes it with expvar.
+//
+// Counters are summed, gauges keep their last value, sets count their unique values and
+// histograms, timers and distributions keep the count, sum, min and max of their
+// observations. Sending events and service checks is reported to the error handler as an error.
+type Registry struct {
+	*store
+}
+
+// SeriesSnapshot is the value of a series of a Registry, a series being the combination of
+// the metric name and its tags.
+type SeriesSnapshot struct {
+	// Name is the name of the metric
+	Name string
+	// Kind is either counter, gauge, set, histogram, timer or distribution
+	Kind string
+	// Tags are the tags of the series, sorted by key
+	Tags Tags
+	// Value is the total of a counter, the last value of a gauge or the number of unique values of a set
+	Value float64
+	// Count is the number of observations of a histogram, timer or distribution
+	Count uint64
+	// Sum is the sum of the observations of a histogram, timer or distribution, timers are in milliseconds
+	Sum float64
+	// Min is the smallest observation of a histogram, timer or distribution
+	Min float64
+	// Max is the largest observation of a histogram, timer or distribution
+	Max float64
+}
+
+// NewRegistry returns an empty Registry.
+func NewRegistry(eh ErrorHandler) *Registry {
+	return &Registry{store: newStore("registry", eh, map[Op]string{
+		OpCounterAdd:         "counter",
+		OpGaugeUpdate:        "gauge",
+		OpSetAdd:             "set",
+		OpHistogramUpdate:    "histogram",
+		OpTimerStop:          "timer",
+		OpDistributionUpdate: "distribution",
+	})}
+}
+
+// Snapshot returns the current value of all the series, sorted by name and tags.
+func (r *Registry) Snapshot() []SeriesSnapshot {
+	type keyed struct {
+		key string
+		SeriesSnapshot
+	}
+
+	var all []keyed
+	r.each(func(m *storeMetric) {
+		for _, key := range m.keys {
+			s := m.series[key]
+			series := SeriesSnapshot{Name: m.name, Kind: m.kind, Tags: append(Tags(nil), s.tags...)}
+			switch m.kind {
+			case "counter", "gauge", "set":
+				series.Value = s.value
+			default:
+				series.Count, series.Sum, series.Min, series.Max = s.count, s.value, s.min, s.max
+			}
+			all = append(all, keyed{key: key, SeriesSnapshot: series})
+		}
+	})
+
+	sort.Slice(all, func(i, j int) bool {
+		if all[i].Name != all[j].Name {
+			return all[i].Name < all[j].Name
+		}
+		return all[i].key < all[j].key
+	})
+
+	snapshot := make([]SeriesSnapshot, len(all))
+	for i := range all {
+		snapshot[i] = all[i].SeriesSnapshot
+	}
+
+	return snapshot
+}
+
+// Reset forgets all the series.
+func (r *Registry) Reset() {
+	r.reset()
+}
+
+// ServeHTTP implements http.Handler, writing the snapshot of the registry in JSON.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(r.snapshotResponse()); err != nil {
+		r.eh(err)
+	}
+}
+
+// Var returns an expvar.Var with the snapshot of the registry, in the same JSON as ServeHTTP,
+// to be published with expvar.Publish.
+func (r *Registry) Var() expvar.Var {
+	return expvar.Func(func() interface{} {
+		return r.snapshotResponse()
+	})
+}
+
+// registryResponse is the JSON representation of the snapshot of a Registry
+type registryResponse struct {
+	Series []registrySeriesResponse `json:"series"`
+}
+
+type registrySeriesResponse struct {
+	Name  string            `json:"name"`
+	Kind  string            `json:"kind"`
+	Tags  map[string]string `json:"tags,omitempty"`
+	Value *float64          `json:"value,omitempty"`
+	Count *uint64           `json:"count,omitempty"`
+	Sum   *float64          `json:"sum,omitempty"`
+	Min   *float64          `json:"min,omitempty"`
+	Max   *float64          `json:"max,omitempty"`
+}
+
+func (r *Registry) snapshotResponse() registryResponse {
+	snapshot := r.Snapshot()
+
+	resp := registryResponse{Series: make([]registrySeriesResponse, len(snapshot))}
+	for i := range snapshot {
+		s := &snapshot[i]
+
+		series := registrySeriesResponse{Name: s.Name, Kind: s.Kind}
+		if len(s.Tags) > 0 {
+			series.Tags = make(map[string]string, len(s.Tags))
+			for _, t := range s.Tags {
+				series.Tags[t.Key] = fmt.Sprintf("%v", t.Value)
+			}
+		}
+
+		switch s.Kind {
+		case "counter", "gauge", "set":
+			series.Value = &s.Value
+		default:
+			series.Count, series.Sum, series.Min, series.Max = &s.Count, &s.Sum, &s.Min, &s.Max
+		}
+
+		resp.Series[i] = series
+	}
+
+	return resp
+}
@@ -0,0 +1,97 @@
+package metrics_test
+
+import (
+	"expvar"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/socialpoint-labs/bsk/metrics"
+)
+
+func TestRegistryImplementsMetrics(t *testing.T) {
+	check := func(m metrics.Metrics) {}
+	check(metrics.NewRegistry(nil))
+}
+
+func TestRegistrySnapshot(t *testing.T) {
+	a := assert.New(t)
+
+	errs := make(chan error, 1)
+	registry := metrics.NewRegistry(func(err error) { errs <- err })
+	a.Empty(registry.Snapshot())
+
+	registry.Counter("requests", metrics.NewTag("code", 200)).Add(2)
+	registry.Counter("requests", metrics.NewTag("code", 200)).Inc()
+	registry.Counter("requests", metrics.NewTag("code", 500)).Inc()
+	registry.Gauge("memory").Update(100)
+	registry.Gauge("memory").Update(50)
+	players := registry.Set("players")
+	players.Add("alice")
+	players.Add("bob")
+	players.Add("alice")
+	histogram := registry.Histogram("size")
+	histogram.AddValue(10)
+	histogram.AddValue(30)
+	registry.Timer("latency").Record(250 * time.Millisecond)
+
+	a.Equal([]metrics.SeriesSnapshot{
+		{Name: "latency", Kind: "timer", Count: 1, Sum: 250, Min: 250, Max: 250},
+		{Name: "memory", Kind: "gauge", Value: 50},
+		{Name: "players", Kind: "set", Value: 2},
+		{Name: "requests", Kind: "counter", Tags: metrics.Tags{metrics.NewTag("code", 200)}, Value: 3},
+		{Name: "requests", Kind: "counter", Tags: metrics.Tags{metrics.NewTag("code", 500)}, Value: 1},
+		{Name: "size", Kind: "histogram", Count: 2, Sum: 40, Min: 10, Max: 30},
+	}, registry.Snapshot())
+
+	registry.Event("deploy").Send()
+	a.EqualError(<-errs, "registry: operation event send not supported")
+
+	registry.Reset()
+	a.Empty(registry.Snapshot())
+}
+
+func TestRegistrySnapshotNormalizesTags(t *testing.T) {
+	a := assert.New(t)
+
+	registry := metrics.NewRegistry(nil)
+
+	// the same tags in a different order are the same series
+	registry.Counter("requests", metrics.NewTag("path", "/"), metrics.NewTag("code", 200)).Inc()
+	registry.Counter("requests", metrics.NewTag("code", 200), metrics.NewTag("path", "/")).Inc()
+
+	// a repeated key keeps the last value
+	registry.Counter("requests", metrics.NewTag("code", 200)).WithTag("code", 500).Inc()
+
+	a.Equal([]metrics.SeriesSnapshot{
+		{Name: "requests", Kind: "counter", Tags: metrics.Tags{metrics.NewTag("code", 200), metrics.NewTag("path", "/")}, Value: 2},
+		{Name: "requests", Kind: "counter", Tags: metrics.Tags{metrics.NewTag("code", 500)}, Value: 1},
+	}, registry.Snapshot())
+}
+
+func TestRegistryServeHTTP(t *testing.T) {
+	a := assert.New(t)
+
+	registry := metrics.NewRegistry(nil)
+	registry.Counter("requests", metrics.NewTag("code", 200)).Inc()
+	registry.Distribution("rtt").AddValue(1.5)
+
+	w := httptest.NewRecorder()
+	registry.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/debug/metrics", nil))
+
+	a.Equal(http.StatusOK, w.Code)
+	a.Equal("application/json", w.Header().Get("Content-Type"))
+
+	expected := `{"series":[
+		{"name":"requests","kind":"counter","tags":{"code":"200"},"value":1},
+		{"name":"rtt","kind":"distribution","count":1,"sum":1.5,"min":1.5,"max":1.5}
+	]}`
+	a.JSONEq(expected, w.Body.String())
+
+	// the expvar bridge renders the same JSON
+	var v expvar.Var = registry.Var()
+	a.JSONEq(expected, v.String())
+}
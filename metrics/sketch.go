@@ -0,0 +1,110 @@
+package metrics
+
+import (
+	"math"
+	"sort"
+)
+
+// the relative accuracy of the quantiles estimated by the sketches
+const sketchRelativeAccuracy = 0.01
+
+// sketch is a quantile sketch in the style of DDSketch. The positive values are
+// counted in buckets whose bounds grow logarithmically, so any quantile is estimated within
+// sketchRelativeAccuracy of the real value, and the memory used depends on the range of
+// the values instead of on the number of observations. Zero and negative values, like the
+// durations of timers that are too short to be measured, are counted apart as zeros.
+//
+// Sketches are not safe for concurrent use.
+type sketch struct {
+	logGamma float64
+	buckets  map[int]uint64
+	zeros    uint64
+
+	count uint64
+	sum   float64
+	min   float64
+	max   float64
+}
+
+func newSketch() *sketch {
+	gamma := (1 + sketchRelativeAccuracy) / (1 - sketchRelativeAccuracy)
+	return &sketch{logGamma: math.Log(gamma), buckets: make(map[int]uint64)}
+}
+
+// add counts the value in the sketch
+func (s *sketch) add(v float64) {
+	if s.count == 0 || v < s.min {
+		s.min = v
+	}
+	if s.count == 0 || v > s.max {
+		s.max = v
+	}
+	s.count++
+	s.sum += v
+
+	if v <= 0 {
+		s.zeros++
+		return
+	}
+
+	// the bucket i holds the values in (gamma^(i-1), gamma^i]
+	s.buckets[int(math.Ceil(math.Log(v)/s.logGamma))]++
+}
+
+// mean returns the mean of the values, or zero if there are no observations
+func (s *sketch) mean() float64 {
+	if s.count == 0 {
+		return 0
+	}
+
+	return s.sum / float64(s.count)
+}
+
+// quantiles returns the estimations of the given quantiles, that must be sorted in increasing
+// order, or zeros if there are no observations. The estimations never fall out of the range
+// of the observed values, and the quantiles 0 and 1 are the exact min and max.
+func (s *sketch) quantiles(qs ...float64) []float64 {
+	values := make([]float64, len(qs))
+	if s.count == 0 {
+		return values
+	}
+
+	indexes := make([]int, 0, len(s.buckets))
+	for i := range s.buckets {
+		indexes = append(indexes, i)
+	}
+	sort.Ints(indexes)
+
+	gamma := math.Exp(s.logGamma)
+	// acc is the number of observations before the bucket indexes[i]
+	acc := s.zeros
+	i := 0
+	for n, q := range qs {
+		// the extremes are known exactly
+		if q <= 0 {
+			values[n] = s.min
+			continue
+		}
+		if q >= 1 {
+			values[n] = s.max
+			continue
+		}
+
+		// the rank of the quantile among the observations, starting at 0
+		rank := uint64(q * float64(s.count-1))
+
+		var v float64
+		if rank >= s.zeros {
+			for i < len(indexes)-1 && acc+s.buckets[indexes[i]] <= rank {
+				acc += s.buckets[indexes[i]]
+				i++
+			}
+			// the value with the same relative distance to both bounds of the bucket
+			v = 2 * math.Pow(gamma, float64(indexes[i])) / (gamma + 1)
+		}
+
+		values[n] = math.Max(s.min, math.Min(s.max, v))
+	}
+
+	return values
+}
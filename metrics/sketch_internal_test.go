@@ -0,0 +1,40 @@
+package metrics
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSketchQuantiles(t *testing.T) {
+	a := assert.New(t)
+
+	s := newSketch()
+	a.Equal([]float64{0, 0}, s.quantiles(0.5, 0.99), "no observations")
+
+	for v := 1; v <= 1000; v++ {
+		s.add(float64(v))
+	}
+
+	a.EqualValues(1000, s.count)
+	a.Equal(1.0, s.min)
+	a.Equal(1000.0, s.max)
+	a.Equal(500.5, s.mean())
+
+	for i, q := range s.quantiles(0, 0.5, 0.9, 0.99, 1) {
+		expected := []float64{1, 500, 900, 990, 1000}[i]
+		a.InEpsilon(expected, q, sketchRelativeAccuracy, "quantile %d", i)
+	}
+}
+
+func TestSketchZerosAndNegatives(t *testing.T) {
+	a := assert.New(t)
+
+	s := newSketch()
+	s.add(0)
+	s.add(0)
+	s.add(-1)
+	s.add(10)
+
+	a.Equal([]float64{-1, 0, 10}, s.quantiles(0, 0.5, 1))
+}
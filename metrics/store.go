@@ -0,0 +1,271 @@
+package metrics
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// store keeps the current value of every series in memory, so the metrics can be read or
+// exported later instead of publishing every observation. It implements the constructors of
+// the Metrics interface for Registry, Prometheus and OTLP, that configure what it supports
+// and read the series to render them.
+type store struct {
+	eh      ErrorHandler
+	backend string        // prefixes the errors
+	kinds   map[Op]string // the kind of the metrics of every supported operation
+
+	// seconds keeps the timers in seconds instead of milliseconds
+	seconds bool
+	// histogramBuckets and timerBuckets are the sorted upper bounds of the buckets
+	histogramBuckets []float64
+	timerBuckets     []float64
+	// metricName and tagKey sanitize the names and the tag keys, they are kept as they are when nil
+	metricName func(string) string
+	tagKey     func(string) string
+
+	metrics map[string]*storeMetric
+	names   []string     // keeps the insertion order of the metrics
+	mu      sync.RWMutex // protects the metrics and their names
+}
+
+// storeMetric holds the series of a metric, all of them of the same kind
+type storeMetric struct {
+	name    string
+	kind    string
+	op      Op // the operation of the first observation
+	buckets []float64
+	series  map[string]*storeSeries
+	keys    []string // keeps the insertion order of the series
+}
+
+// storeSeries is the current value of a series, a combination of a metric and its tags
+type storeSeries struct {
+	key  string
+	tags Tags // sorted by key, without repeated keys
+
+	value    float64 // the sum for counters and histograms, the last value for gauges and the unique values for sets
+	count    uint64  // the number of observations of histograms
+	min, max float64
+	buckets  []uint64            // the observations of histograms in every bucket, not cumulative, the last one is +Inf
+	unique   map[string]struct{} // the unique values of sets
+}
+
+func newStore(backend string, eh ErrorHandler, kinds map[Op]string) *store {
+	if eh == nil {
+		eh = DiscardErrors
+	}
+
+	return &store{
+		eh:      eh,
+		backend: backend,
+		kinds:   kinds,
+		metrics: make(map[string]*storeMetric),
+	}
+}
+
+// Counter returns a new counter with the provided name and tags
+func (s *store) Counter(name string, tags ...Tag) Counter {
+	return &publisherCounter{publisherMetric{name: name, tags: tags, nf: s.notify}}
+}
+
+// Gauge returns a new Gauge with the provided name and tags
+func (s *store) Gauge(name string, tags ...Tag) Gauge {
+	return &publisherGauge{publisherMetric{name: name, tags: tags, nf: s.notify}}
+}
+
+// Event returns a new Event with the provided title and tags
+// Events are not supported, sending them is reported to the error handler
+func (s *store) Event(title string, tags ...Tag) Event {
+	return &publisherEvent{publisherMetric: publisherMetric{name: title, tags: tags, nf: s.notify}}
+}
+
+// Timer returns a new Timer with the provided name and tags
+func (s *store) Timer(name string, tags ...Tag) Timer {
+	return &timerEvent{publisherMetric: publisherMetric{name: name, tags: tags, nf: s.notify}}
+}
+
+// Histogram returns a new Histogram with the provided name and tags
+func (s *store) Histogram(name string, tags ...Tag) Histogram {
+	return &publisherHistogram{publisherMetric{name: name, tags: tags, nf: s.notify}}
+}
+
+// Distribution returns a new Distribution with the provided name and tags
+func (s *store) Distribution(name string, tags ...Tag) Distribution {
+	return &publisherDistribution{publisherMetric{name: name, tags: tags, nf: s.notify}}
+}
+
+// Set returns a new Set with the provided name and tags
+// Adding values to a set is reported to the error handler when sets are not supported
+func (s *store) Set(name string, tags ...Tag) Set {
+	return &publisherSet{publisherMetric{name: name, tags: tags, nf: s.notify}}
+}
+
+// ServiceCheck returns a new ServiceCheck with the provided name and tags
+// Service checks are not supported, sending them is reported to the error handler
+func (s *store) ServiceCheck(name string, tags ...Tag) ServiceCheck {
+	return &publisherServiceCheck{publisherMetric: publisherMetric{name: name, tags: tags, nf: s.notify}}
+}
+
+// each calls the function with every metric, in the order they were first observed,
+// holding the read lock so the metrics must not be modified
+func (s *store) each(f func(m *storeMetric)) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, name := range s.names {
+		f(s.metrics[name])
+	}
+}
+
+// reset forgets all the metrics
+func (s *store) reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.metrics = make(map[string]*storeMetric)
+	s.names = nil
+}
+
+// notify ignores the sample rate, all the observations are kept in the store
+func (s *store) notify(op Op, name string, value interface{}, tags Tags, _ float64) {
+	kind, ok := s.kinds[op]
+	if !ok {
+		s.eh(fmt.Errorf("%s: operation %v not supported", s.backend, op))
+		return
+	}
+
+	var v float64
+	if op != OpSetAdd {
+		var err error
+		if v, err = valueAsFloat64(value); err != nil {
+			s.eh(fmt.Errorf("could not publish metric `%s`: %w", name, err))
+			return
+		}
+	}
+
+	buckets := s.histogramBuckets
+	if op == OpTimerStop {
+		buckets = s.timerBuckets
+		if s.seconds {
+			// timers are notified in milliseconds
+			v /= 1000
+		}
+	}
+
+	if s.metricName != nil {
+		name = s.metricName(name)
+	}
+	tags = s.seriesTags(tags)
+	key := storeKey(tags)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	m, ok := s.metrics[name]
+	if !ok {
+		m = &storeMetric{name: name, kind: kind, op: op, buckets: buckets, series: make(map[string]*storeSeries)}
+		s.metrics[name] = m
+		s.names = append(s.names, name)
+	}
+	if m.kind != kind {
+		s.eh(fmt.Errorf("%s: metric `%s` already registered as %s", s.backend, name, m.kind))
+		return
+	}
+
+	series, ok := m.series[key]
+	if !ok {
+		series = &storeSeries{key: key, tags: tags}
+		switch op {
+		case OpSetAdd:
+			series.unique = make(map[string]struct{})
+		case OpHistogramUpdate, OpTimerStop, OpDistributionUpdate:
+			series.buckets = make([]uint64, len(m.buckets)+1)
+		}
+		m.series[key] = series
+		m.keys = append(m.keys, key)
+	}
+
+	switch op {
+	case OpCounterAdd:
+		series.value += v
+	case OpGaugeUpdate:
+		series.value = v
+	case OpSetAdd:
+		series.unique[fmt.Sprintf("%v", value)] = struct{}{}
+		series.value = float64(len(series.unique))
+	default:
+		if series.count == 0 || v < series.min {
+			series.min = v
+		}
+		if series.count == 0 || v > series.max {
+			series.max = v
+		}
+		series.value += v
+		series.count++
+		series.buckets[sort.SearchFloat64s(m.buckets, v)]++
+	}
+}
+
+// seriesTags returns a copy of the tags with their keys sanitized, sorted by key and
+// without repeated keys, see normalizedTags
+func (s *store) seriesTags(tags Tags) Tags {
+	sanitized := make(Tags, len(tags))
+	for i, t := range tags {
+		sanitized[i] = t
+		if s.tagKey != nil {
+			sanitized[i].Key = s.tagKey(t.Key)
+		}
+	}
+
+	return normalizedTags(sanitized)
+}
+
+// normalizedTags returns the tags sorted by key, so the same tags in any order are the same
+// series, keeping the last value of a repeated key, as the keys of the series must be unique
+func normalizedTags(tags Tags) Tags {
+	normalized := true
+	for i := 1; i < len(tags); i++ {
+		if tags[i-1].Key >= tags[i].Key {
+			normalized = false
+			break
+		}
+	}
+	if normalized {
+		return tags
+	}
+
+	sorted := append(Tags(nil), tags...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Key < sorted[j].Key })
+
+	unique := sorted[:0]
+	for _, t := range sorted {
+		if len(unique) > 0 && unique[len(unique)-1].Key == t.Key {
+			unique[len(unique)-1] = t
+			continue
+		}
+		unique = append(unique, t)
+	}
+
+	return unique
+}
+
+// storeKey returns the key of the series of a metric with the given tags
+func storeKey(tags Tags) string {
+	var b strings.Builder
+	for i, t := range tags {
+		if i > 0 {
+			b.WriteByte('|')
+		}
+		fmt.Fprintf(&b, "%v:%v", t.Key, t.Value)
+	}
+	return b.String()
+}
+
+// sortedBuckets returns a sorted copy of the buckets
+func sortedBuckets(buckets []float64) []float64 {
+	sorted := append([]float64(nil), buckets...)
+	sort.Float64s(sorted)
+	return sorted
+}
@@ -35,3 +35,18 @@ func (m *taggedMetrics) Event(name string, tags ...Tag) Event {
 func (m *taggedMetrics) Histogram(name string, tags ...Tag) Histogram {
 	return m.Metrics.Histogram(name, m.tags...).WithTags(tags...)
 }
+
+// Provide a Distribution with the given name and tags
+func (m *taggedMetrics) Distribution(name string, tags ...Tag) Distribution {
+	return m.Metrics.Distribution(name, m.tags...).WithTags(tags...)
+}
+
+// Provide a Set with the given name and tags
+func (m *taggedMetrics) Set(name string, tags ...Tag) Set {
+	return m.Metrics.Set(name, m.tags...).WithTags(tags...)
+}
+
+// Provide a ServiceCheck with the given name and tags
+func (m *taggedMetrics) ServiceCheck(name string, tags ...Tag) ServiceCheck {
+	return m.Metrics.ServiceCheck(name, m.tags...).WithTags(tags...)
+}
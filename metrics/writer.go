@@ -0,0 +1,169 @@
+package metrics
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+const dialTimeout = 5 * time.Second
+
+// dialWriter is an io.Writer that dials its connection on the first write, and
+// again on the write following a failed one, so a publisher keeps writing when
+// its backend restarts or is not ready yet when the application starts.
+type dialWriter struct {
+	network string
+	addr    string
+
+	conn net.Conn
+	mu   sync.Mutex // protects the connection
+}
+
+func newDialWriter(network, addr string) *dialWriter {
+	return &dialWriter{network: network, addr: addr}
+}
+
+func (w *dialWriter) Write(b []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.conn == nil {
+		conn, err := net.DialTimeout(w.network, w.addr, dialTimeout)
+		if err != nil {
+			return 0, err
+		}
+		w.conn = conn
+	}
+
+	n, err := w.conn.Write(b)
+	if err != nil {
+		_ = w.conn.Close()
+		w.conn = nil
+	}
+
+	return n, err
+}
+
+// ErrNotConnected is returned by the writes to a connection that is being dialed in the background.
+var ErrNotConnected = errors.New("metrics: not connected")
+
+// reconnectingWriter is an io.Writer over a connection that is dialed in the background,
+// retrying until it succeeds, and dialed again after a failed write. The writes fail with
+// ErrNotConnected while it is not connected, so the metrics are dropped until the
+// backend, e.g. the socket of a sidecar agent, is available.
+//
+// It doesn't dial until connect is called. A closed writer cannot be reused: it never
+// dials again and all its writes return ErrNotConnected.
+type reconnectingWriter struct {
+	network  string
+	addr     string
+	interval time.Duration
+
+	conn    net.Conn
+	dialing bool
+	closed  bool
+	mu      sync.Mutex // protects the connection and the dialing and closed flags
+
+	done chan struct{} // closed by Close, to stop dialing
+}
+
+// newReconnectingWriter returns a reconnecting writer that is not connected yet, see connect
+func newReconnectingWriter(network, addr string, interval time.Duration) *reconnectingWriter {
+	return &reconnectingWriter{network: network, addr: addr, interval: interval, done: make(chan struct{})}
+}
+
+// connect dials the connection, and keeps dialing in the background if it fails, unless the
+// writer is already connected, dialing or closed
+func (w *reconnectingWriter) connect() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.conn != nil || w.dialing || w.closed {
+		return
+	}
+
+	if conn, err := net.DialTimeout(w.network, w.addr, dialTimeout); err == nil {
+		w.conn = conn
+		return
+	}
+	w.redial()
+}
+
+func (w *reconnectingWriter) Write(b []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.conn == nil {
+		return 0, ErrNotConnected
+	}
+
+	n, err := w.conn.Write(b)
+	if err != nil {
+		_ = w.conn.Close()
+		w.conn = nil
+		w.redial()
+	}
+
+	return n, err
+}
+
+// Close closes the connection and stops dialing, the writes that follow return ErrNotConnected.
+// The writer cannot be connected again once it is closed.
+func (w *reconnectingWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	close(w.done)
+
+	if w.conn == nil {
+		return nil
+	}
+	err := w.conn.Close()
+	w.conn = nil
+
+	return err
+}
+
+// redial dials in the background until it succeeds or the writer is closed, unless it
+// is already dialing. It must be called with the lock held.
+func (w *reconnectingWriter) redial() {
+	if w.dialing || w.closed {
+		return
+	}
+	w.dialing = true
+
+	go func() {
+		retry := time.NewTicker(w.interval)
+		defer retry.Stop()
+
+		for {
+			conn, err := net.DialTimeout(w.network, w.addr, dialTimeout)
+			if err == nil {
+				w.mu.Lock()
+				defer w.mu.Unlock()
+
+				w.dialing = false
+				if w.closed {
+					_ = conn.Close()
+					return
+				}
+				w.conn = conn
+				return
+			}
+
+			select {
+			case <-retry.C:
+			case <-w.done:
+				w.mu.Lock()
+				w.dialing = false
+				w.mu.Unlock()
+				return
+			}
+		}
+	}()
+}
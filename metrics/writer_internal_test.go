@@ -0,0 +1,184 @@
+package metrics
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDialWriterRedialsAfterAFailedWrite(t *testing.T) {
+	a := assert.New(t)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	a.NoError(err)
+	defer listener.Close()
+
+	w := newDialWriter("tcp", listener.Addr().String())
+
+	_, err = w.Write([]byte("first\n"))
+	a.NoError(err)
+
+	conn, err := listener.Accept()
+	a.NoError(err)
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	a.NoError(err)
+	a.Equal("first\n", line)
+
+	// the server goes away, writes eventually fail and the writer dials again
+	a.NoError(conn.Close())
+	for err == nil {
+		_, err = w.Write([]byte("lost\n"))
+	}
+
+	_, err = w.Write([]byte("second\n"))
+	a.NoError(err)
+
+	conn, err = listener.Accept()
+	a.NoError(err)
+	defer conn.Close()
+	line, err = bufio.NewReader(conn).ReadString('\n')
+	a.NoError(err)
+	a.Equal("second\n", line)
+}
+
+func TestDialWriterErrorsWhenItCannotDial(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	addr := listener.Addr().String()
+	assert.NoError(t, listener.Close())
+
+	_, err = newDialWriter("tcp", addr).Write([]byte("line\n"))
+	assert.Error(t, err)
+}
+
+func TestReconnectingWriterConnectsWhenTheSocketAppears(t *testing.T) {
+	a := assert.New(t)
+
+	addr := filepath.Join(t.TempDir(), "dsd.socket")
+	w := newReconnectingWriter("unixgram", addr, time.Millisecond)
+	defer w.Close()
+	w.connect()
+
+	_, err := w.Write([]byte("lost"))
+	a.Equal(ErrNotConnected, err)
+
+	server, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: addr, Net: "unixgram"})
+	a.NoError(err)
+	defer server.Close()
+
+	a.Eventually(func() bool {
+		_, err := w.Write([]byte("packet"))
+		return err == nil
+	}, time.Second, time.Millisecond)
+
+	packet := make([]byte, 1024)
+	n, err := server.Read(packet)
+	a.NoError(err)
+	a.Equal("packet", string(packet[:n]))
+
+	// the server goes away, and the writer connects again when it is back
+	a.NoError(server.Close())
+	a.Eventually(func() bool {
+		_, err := w.Write([]byte("lost"))
+		return err == ErrNotConnected
+	}, time.Second, time.Millisecond)
+
+	a.NoError(os.Remove(addr))
+	server, err = net.ListenUnixgram("unixgram", &net.UnixAddr{Name: addr, Net: "unixgram"})
+	a.NoError(err)
+	defer server.Close()
+
+	a.Eventually(func() bool {
+		_, err := w.Write([]byte("again"))
+		return err == nil
+	}, time.Second, time.Millisecond)
+
+	n, err = server.Read(packet)
+	a.NoError(err)
+	a.Equal("again", string(packet[:n]))
+}
+
+func TestReconnectingWriterDoesNotDialUntilConnected(t *testing.T) {
+	a := assert.New(t)
+
+	addr := filepath.Join(t.TempDir(), "dsd.socket")
+	server, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: addr, Net: "unixgram"})
+	a.NoError(err)
+	defer server.Close()
+
+	w := newReconnectingWriter("unixgram", addr, time.Millisecond)
+	defer w.Close()
+
+	_, err = w.Write([]byte("lost"))
+	a.Equal(ErrNotConnected, err)
+
+	w.connect()
+	_, err = w.Write([]byte("packet"))
+	a.NoError(err)
+
+	packet := make([]byte, 1024)
+	n, err := server.Read(packet)
+	a.NoError(err)
+	a.Equal("packet", string(packet[:n]))
+}
+
+func TestReconnectingWriterStopsDialingWhenClosed(t *testing.T) {
+	a := assert.New(t)
+
+	addr := filepath.Join(t.TempDir(), "dsd.socket")
+	w := newReconnectingWriter("unixgram", addr, time.Millisecond)
+	w.connect()
+	a.NoError(w.Close())
+	a.NoError(w.Close(), "closing twice is harmless")
+
+	dialing := func() bool {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		return w.dialing
+	}
+	a.Eventually(func() bool { return !dialing() }, time.Second, time.Millisecond)
+
+	server, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: addr, Net: "unixgram"})
+	a.NoError(err)
+	defer server.Close()
+
+	time.Sleep(10 * time.Millisecond)
+	_, err = w.Write([]byte("lost"))
+	a.Equal(ErrNotConnected, err)
+	a.False(dialing())
+
+	// a closed writer cannot be reused
+	w.connect()
+	_, err = w.Write([]byte("lost"))
+	a.Equal(ErrNotConnected, err)
+	a.False(dialing())
+}
+
+func TestDialDataDogUnixStopsDialingWhenRunReturns(t *testing.T) {
+	a := assert.New(t)
+
+	addr := filepath.Join(t.TempDir(), "dsd.socket")
+	publisher, err := DialDataDogUnix(WithDDUnixAddress(addr), WithDDLazyConnection())
+	a.NoError(err)
+
+	w := publisher.writer.(*reconnectingWriter)
+	w.mu.Lock()
+	a.False(w.dialing, "it doesn't dial until it runs")
+	w.mu.Unlock()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	publisher.Run(ctx)
+
+	a.Eventually(func() bool {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		return w.closed && !w.dialing
+	}, time.Second, time.Millisecond)
+}